@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"strings"
 
 	"github.com/ogundaremathew/navii"
 )
@@ -12,6 +13,8 @@ func main() {
 	var (
 		downloadData = flag.Bool("download-data", false, "Download and process geographical data")
 		outputPath   = flag.String("output", "location_data.json", "Output path for geographical data")
+		countries    = flag.String("countries", "", "Comma-separated countries to download postal codes for")
+		baseURL      = flag.String("base-url", "", "Source URL of countries.json and cities.json")
 		help         = flag.Bool("help", false, "Show help information")
 	)
 
@@ -27,7 +30,15 @@ func main() {
 		fmt.Println("========================")
 		fmt.Printf("Ensuring geographical data availability at: %s\n\n", *outputPath)
 
-		err := navii.SmartDownloadData("", *outputPath)
+		opts := navii.PostInstallOptions{
+			OutputPath: *outputPath,
+			BaseURL:    *baseURL,
+		}
+		if *countries != "" {
+			opts.TargetCountries = strings.Split(*countries, ",")
+		}
+
+		err := navii.RunPostInstallWithOptions(opts)
 		if err != nil {
 			log.Fatalf("❌ Failed to ensure data availability: %v", err)
 		}
@@ -51,11 +62,14 @@ func showHelp() {
 	fmt.Println("Flags:")
 	fmt.Println("  -download-data    Download and process geographical data")
 	fmt.Println("  -output string    Output path for geographical data (default \"location_data.json\")")
+	fmt.Println("  -countries string Comma-separated countries to download postal codes for")
+	fmt.Println("  -base-url string  Source URL of countries.json and cities.json")
 	fmt.Println("  -help            Show this help information")
 	fmt.Println()
 	fmt.Println("Examples:")
 	fmt.Println("  navii -download-data")
 	fmt.Println("  navii -download-data -output /path/to/data.json")
+	fmt.Println("  navii -download-data -countries US,GB")
 	fmt.Println("  navii -help")
 	fmt.Println()
 	fmt.Println("For more information, visit: https://github.com/ogundaremathew/navii")
@@ -1,32 +1,323 @@
-// Package yuniq provides geographical navigation and state management functionality
+// Package navii provides geographical navigation and state management functionality
 package navii
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"os"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
+// DefaultDBPath is the database file used when no path is given
+var DefaultDBPath = ".navii.db"
+
+// legacyDBPath is the default file name used before the package was renamed
+const legacyDBPath = ".yuniq.db"
+
+// resolveDBPath returns dbPath, or the default database path when it is empty.
+// The lookup order for the default is: DefaultDBPath if it exists, then the
+// legacy .yuniq.db if it exists, then DefaultDBPath.
+func resolveDBPath(dbPath string) string {
+	if dbPath != "" {
+		return dbPath
+	}
+
+	if _, err := os.Stat(DefaultDBPath); err == nil {
+		return DefaultDBPath
+	}
+	if _, err := os.Stat(legacyDBPath); err == nil {
+		return legacyDBPath
+	}
+	return DefaultDBPath
+}
+
 // DB handles database operations
 type DB struct {
-	db *sql.DB
+	*dbHandle
+
+	// ctx bounds every query run through this DB; nil means context.Background
+	ctx context.Context
+
+	// tx is the transaction every query joins, on a DB returned by beginTx
+	tx *sql.Tx
+}
+
+// dbHandle is the connection and settings shared by a DB and the copies
+// returned by WithContext
+type dbHandle struct {
+	db               *sql.DB
+	ownsConn         bool
+	strictReferences bool
+	sourceFilter     SourceFilter
+	caseSensitive    bool
+
+	// stmts caches prepared statements for queries run on every navigation step
+	stmtsMu sync.Mutex
+	stmts   map[string]*sql.Stmt
+}
+
+// WithContext returns a DB sharing this one's connection and settings whose
+// queries run under ctx, so they are abandoned once ctx is cancelled. Every
+// method is available this way; the common ones also have XxxContext forms.
+func (db *DB) WithContext(ctx context.Context) *DB {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return &DB{dbHandle: db.dbHandle, ctx: ctx, tx: db.tx}
+}
+
+// querier runs statements on the connection pool or on a transaction
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// conn returns where queries run: the DB's transaction if it has one
+func (db *DB) conn() querier {
+	if db.tx != nil {
+		return db.tx
+	}
+	return db.db
+}
+
+// txConn is the transaction a multi-statement method runs in
+type txConn interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	Prepare(query string) (*sql.Stmt, error)
+	Stmt(stmt *sql.Stmt) *sql.Stmt
+	Commit() error
+	Rollback() error
+}
+
+// joinedTx is the enclosing transaction as seen by a method that would begin
+// its own. Committing or rolling back is left to whoever began it, so an error
+// in any method rolls back the enclosing transaction as a whole.
+type joinedTx struct {
+	*sql.Tx
+}
+
+func (joinedTx) Commit() error   { return nil }
+func (joinedTx) Rollback() error { return nil }
+
+// begin starts a transaction for a multi-statement method, or joins the DB's
+// transaction if it has one
+func (db *DB) begin() (txConn, error) {
+	if db.tx != nil {
+		return joinedTx{db.tx}, nil
+	}
+	return db.db.BeginTx(db.queryCtx(), nil)
+}
+
+// beginTx returns a DB whose queries all run in one new transaction, ended by
+// its commit or rollback
+func (db *DB) beginTx() (*DB, error) {
+	tx, err := db.db.BeginTx(db.queryCtx(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{dbHandle: db.dbHandle, ctx: db.ctx, tx: tx}, nil
+}
+
+// commit commits the transaction started by beginTx
+func (db *DB) commit() error {
+	return db.tx.Commit()
+}
+
+// rollback rolls back the transaction started by beginTx
+func (db *DB) rollback() error {
+	return db.tx.Rollback()
+}
+
+// inTx returns stmt bound to the DB's transaction, if it has one
+func (db *DB) inTx(stmt *sql.Stmt) *sql.Stmt {
+	if db.tx != nil {
+		return db.tx.Stmt(stmt)
+	}
+	return stmt
+}
+
+// queryCtx returns the context queries run under
+func (db *DB) queryCtx() context.Context {
+	if db.ctx == nil {
+		return context.Background()
+	}
+	return db.ctx
 }
 
 // NewDB creates a new database instance
 func NewDB(dbPath string) (*DB, error) {
-	if dbPath == "" {
-		dbPath = ".yuniq.db"
+	return NewDBWithPragmas(dbPath, nil)
+}
+
+// NewDBWithPragmas creates a new database instance that runs the given pragmas,
+// e.g. {"cache_size": "-64000", "temp_store": "MEMORY", "mmap_size": "268435456"},
+// on every connection the pool opens. Per-connection pragmas such as these would
+// otherwise only reach the single connection they happened to run on.
+func NewDBWithPragmas(dbPath string, pragmas map[string]string) (*DB, error) {
+	dbPath = resolveDBPath(dbPath)
+
+	driverName := "sqlite3"
+	if len(pragmas) > 0 {
+		var err error
+		if driverName, err = pragmaDriver(pragmas); err != nil {
+			return nil, err
+		}
 	}
 
-	database, err := sql.Open("sqlite3", dbPath+"?_foreign_keys=on&_journal_mode=WAL")
+	database, err := sql.Open(driverName, dbPath+"?_foreign_keys=on&_journal_mode=WAL")
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
-	db := &DB{db: database}
+	db := &DB{dbHandle: &dbHandle{db: database, ownsConn: true}}
+	if err := db.initTables(); err != nil {
+		database.Close()
+		if isCorruptError(err) {
+			return nil, fmt.Errorf("%w: %s: %v", ErrCorruptDatabase, dbPath, err)
+		}
+		return nil, fmt.Errorf("failed to initialize tables: %w", err)
+	}
+
+	return db, nil
+}
+
+// isCorruptError reports whether err is SQLite rejecting the database file
+// itself, as opposed to a failing statement
+func isCorruptError(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.Code == sqlite3.ErrNotADB || sqliteErr.Code == sqlite3.ErrCorrupt
+}
+
+// BackupCorruptDatabase moves a database file, along with its WAL and shared
+// memory files, aside to "<path>.corrupt-<timestamp>" so that a fresh database
+// can be created in its place. It returns the path of the backup.
+func BackupCorruptDatabase(dbPath string) (string, error) {
+	dbPath = resolveDBPath(dbPath)
+	backupPath := dbPath + ".corrupt-" + time.Now().Format("20060102T150405")
+
+	if err := os.Rename(dbPath, backupPath); err != nil {
+		return "", fmt.Errorf("failed to back up corrupt database: %w", err)
+	}
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Rename(dbPath+suffix, backupPath+suffix); err != nil && !os.IsNotExist(err) {
+			return backupPath, fmt.Errorf("failed to back up corrupt database: %w", err)
+		}
+	}
+	return backupPath, nil
+}
+
+var (
+	pragmaNamePattern  = regexp.MustCompile(`^[A-Za-z_]+$`)
+	pragmaValuePattern = regexp.MustCompile(`^-?[A-Za-z0-9_]+$`)
+
+	// pragmaDrivers maps each distinct pragma set to the driver registered for
+	// it, since database/sql drivers cannot be unregistered
+	pragmaDriversMu sync.Mutex
+	pragmaDrivers   = make(map[string]string)
+)
+
+// pragmaDriver returns the name of a sqlite3 driver whose connect hook runs the
+// given pragmas, registering it on first use
+func pragmaDriver(pragmas map[string]string) (string, error) {
+	names := make([]string, 0, len(pragmas))
+	for name, value := range pragmas {
+		if !pragmaNamePattern.MatchString(name) || !pragmaValuePattern.MatchString(value) {
+			return "", fmt.Errorf("invalid pragma %s = %s", name, value)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	statements := make([]string, len(names))
+	for i, name := range names {
+		statements[i] = fmt.Sprintf("PRAGMA %s = %s", name, pragmas[name])
+	}
+	key := strings.Join(statements, ";")
+
+	pragmaDriversMu.Lock()
+	defer pragmaDriversMu.Unlock()
+
+	if driverName, ok := pragmaDrivers[key]; ok {
+		return driverName, nil
+	}
+
+	driverName := fmt.Sprintf("sqlite3_navii_%d", len(pragmaDrivers))
+	sql.Register(driverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			for _, statement := range statements {
+				if _, err := conn.Exec(statement, nil); err != nil {
+					return fmt.Errorf("failed to apply %s: %w", statement, err)
+				}
+			}
+			return nil
+		},
+	})
+	pragmaDrivers[key] = driverName
+
+	return driverName, nil
+}
+
+// prepared returns a cached prepared statement for query, preparing it on first use
+func (db *DB) prepared(query string) (*sql.Stmt, error) {
+	db.stmtsMu.Lock()
+	defer db.stmtsMu.Unlock()
+
+	if stmt, ok := db.stmts[query]; ok {
+		return stmt, nil
+	}
+
+	stmt, err := db.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	if db.stmts == nil {
+		db.stmts = make(map[string]*sql.Stmt)
+	}
+	db.stmts[query] = stmt
+	return stmt, nil
+}
+
+// closeStatements closes and forgets every cached prepared statement
+func (db *DB) closeStatements() error {
+	db.stmtsMu.Lock()
+	defer db.stmtsMu.Unlock()
+
+	var firstErr error
+	for query, stmt := range db.stmts {
+		if err := stmt.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(db.stmts, query)
+	}
+	return firstErr
+}
+
+// NewDBFromSQL wraps an existing database handle, creating the tables if needed.
+// The caller keeps ownership of the handle: Close will not close it, and any
+// pragmas (foreign keys, journal mode) are left to the caller's configuration.
+func NewDBFromSQL(database *sql.DB) (*DB, error) {
+	if database == nil {
+		return nil, fmt.Errorf("database handle must not be nil")
+	}
+
+	db := &DB{dbHandle: &dbHandle{db: database}}
 	if err := db.initTables(); err != nil {
+		if isCorruptError(err) {
+			return nil, fmt.Errorf("%w: %v", ErrCorruptDatabase, err)
+		}
 		return nil, fmt.Errorf("failed to initialize tables: %w", err)
 	}
 
@@ -49,6 +340,7 @@ func (db *DB) initTables() error {
 			stateShort TEXT NOT NULL,
 			state TEXT NOT NULL,
 			countryShort TEXT NOT NULL,
+			county TEXT,
 			used BOOLEAN NOT NULL DEFAULT 0,
 			external BOOLEAN NOT NULL DEFAULT 0,
 			PRIMARY KEY (stateShort, countryShort),
@@ -63,6 +355,9 @@ func (db *DB) initTables() error {
 			stateShort TEXT NOT NULL,
 			countryShort TEXT NOT NULL,
 			county TEXT,
+			latitude REAL,
+			longitude REAL,
+			timezone TEXT,
 			used BOOLEAN NOT NULL DEFAULT 0,
 			external BOOLEAN NOT NULL DEFAULT 0,
 			FOREIGN KEY (stateShort, countryShort) REFERENCES states(stateShort, countryShort) ON DELETE CASCADE,
@@ -76,6 +371,7 @@ func (db *DB) initTables() error {
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			zip TEXT NOT NULL,
 			countryShort TEXT NOT NULL,
+			stateShort TEXT,
 			used BOOLEAN NOT NULL DEFAULT 0,
 			external BOOLEAN NOT NULL DEFAULT 0,
 			FOREIGN KEY (countryShort) REFERENCES countries(countryShort) ON DELETE CASCADE,
@@ -86,6 +382,8 @@ func (db *DB) initTables() error {
 		CREATE TABLE IF NOT EXISTS queries (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			query TEXT NOT NULL UNIQUE,
+			normalized TEXT,
+			weight INTEGER NOT NULL DEFAULT 1,
 			used BOOLEAN NOT NULL DEFAULT 0,
 			external BOOLEAN NOT NULL DEFAULT 0
 		);
@@ -101,109 +399,236 @@ func (db *DB) initTables() error {
 			page TEXT,
 			completed BOOLEAN NOT NULL DEFAULT 0,
 			external BOOLEAN NOT NULL DEFAULT 0,
+			targetCountry TEXT,
+			navIndex INTEGER,
+			completedAt DATETIME,
 			FOREIGN KEY (countryShort) REFERENCES countries(countryShort) ON DELETE CASCADE,
 			FOREIGN KEY (queryId) REFERENCES queries(id) ON DELETE SET NULL,
 			FOREIGN KEY (zipId) REFERENCES zips(id) ON DELETE SET NULL,
 			FOREIGN KEY (cityId) REFERENCES cities(id) ON DELETE SET NULL,
 			FOREIGN KEY (stateShort, countryShort) REFERENCES states(stateShort, countryShort) ON DELETE SET NULL
 		);
+		CREATE TABLE IF NOT EXISTS country_metadata (
+			countryShort TEXT PRIMARY KEY,
+			country TEXT NOT NULL,
+			iso3 TEXT,
+			region TEXT,
+			subregion TEXT,
+			currency TEXT,
+			currencyName TEXT,
+			timezones TEXT
+		);
+
+		CREATE TABLE IF NOT EXISTS bookmarks (
+			name TEXT PRIMARY KEY,
+			format TEXT NOT NULL,
+			targetCountry TEXT NOT NULL,
+			navIndex INTEGER NOT NULL,
+			createdAt DATETIME
+		);
+
+		CREATE TABLE IF NOT EXISTS nav_cursors (
+			format TEXT NOT NULL,
+			targetCountry TEXT NOT NULL,
+			navIndex INTEGER NOT NULL,
+			PRIMARY KEY (format, targetCountry)
+		);
+
+		CREATE TABLE IF NOT EXISTS metadata (
+			key TEXT PRIMARY KEY,
+			value TEXT NOT NULL
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_nav_sessions_identity ON nav_sessions(format, countryShort, queryId, zipId, cityId, stateShort);
 	`
 
-	_, err := db.db.Exec(schema)
-	return err
+	if _, err := db.conn().ExecContext(db.queryCtx(), schema); err != nil {
+		return err
+	}
+
+	return db.migrate()
 }
 
-// AddCountries adds countries to the database
-func (db *DB) AddCountries(countries []Country, external bool) error {
-	for _, country := range countries {
-		if country.CountryShort == "" || country.Country == "" {
-			return fmt.Errorf("all countries must have countryShort and country")
+// migrate brings databases created by older versions up to the current schema
+func (db *DB) migrate() error {
+	for _, table := range []string{"states", "cities", "zips"} {
+		if err := db.addColumnIfMissing(table, "usedAt", "DATETIME"); err != nil {
+			return err
+		}
+	}
+	for _, column := range []string{"latitude", "longitude"} {
+		if err := db.addColumnIfMissing("cities", column, "REAL"); err != nil {
+			return err
 		}
 	}
+	if err := db.addColumnIfMissing("zips", "stateShort", "TEXT"); err != nil {
+		return err
+	}
+	if err := db.addColumnIfMissing("states", "county", "TEXT"); err != nil {
+		return err
+	}
+	if err := db.addColumnIfMissing("queries", "weight", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+		return err
+	}
+	if err := db.addColumnIfMissing("nav_sessions", "targetCountry", "TEXT"); err != nil {
+		return err
+	}
+	if err := db.addColumnIfMissing("nav_sessions", "navIndex", "INTEGER"); err != nil {
+		return err
+	}
+	if err := db.addColumnIfMissing("nav_sessions", "completedAt", "DATETIME"); err != nil {
+		return err
+	}
+	if err := db.addColumnIfMissing("cities", "timezone", "TEXT"); err != nil {
+		return err
+	}
+	if _, err := db.conn().ExecContext(db.queryCtx(), `CREATE INDEX IF NOT EXISTS idx_cities_timezone ON cities(timezone)`); err != nil {
+		return err
+	}
+	if err := db.addColumnIfMissing("country_metadata", "timezones", "TEXT"); err != nil {
+		return err
+	}
+	if err := db.addColumnIfMissing("queries", "normalized", "TEXT"); err != nil {
+		return err
+	}
+	if err := db.backfillNormalizedQueries(); err != nil {
+		return err
+	}
+	if _, err := db.conn().ExecContext(db.queryCtx(), `CREATE UNIQUE INDEX IF NOT EXISTS idx_queries_normalized ON queries(normalized)`); err != nil {
+		return err
+	}
+	return nil
+}
 
-	tx, err := db.db.Begin()
+// backfillNormalizedQueries sets the normalized form of queries stored before
+// it was tracked. Of several existing queries that normalize alike, only the
+// oldest gets it; the rest stay as they are but no longer block new queries.
+func (db *DB) backfillNormalizedQueries() error {
+	rows, err := db.conn().QueryContext(db.queryCtx(), `SELECT id, query FROM queries WHERE normalized IS NULL ORDER BY id`)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
+	type pending struct {
+		id         int
+		normalized string
+	}
+	var updates []pending
+	for rows.Next() {
+		var id int
+		var query string
+		if err := rows.Scan(&id, &query); err != nil {
+			rows.Close()
+			return err
+		}
+		updates = append(updates, pending{id, normalizeQuery(query)})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(updates) == 0 {
+		return nil
+	}
 
-	stmt, err := tx.Prepare(`
-		INSERT OR IGNORE INTO countries (countryShort, country, used, external)
-		VALUES (?, ?, ?, ?)
-	`)
+	tx, err := db.begin()
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
+	defer tx.Rollback()
 
-	for _, country := range countries {
-		_, err := stmt.Exec(country.CountryShort, country.Country, country.Used, external)
+	for _, u := range updates {
+		_, err := tx.Exec(`UPDATE queries SET normalized = ? WHERE id = ? AND NOT EXISTS (SELECT 1 FROM queries WHERE normalized = ?)`, u.normalized, u.id, u.normalized)
 		if err != nil {
 			return err
 		}
 	}
-
 	return tx.Commit()
 }
 
-// AddStates adds states to the database
-func (db *DB) AddStates(states []State, external bool) error {
-	for _, state := range states {
-		if state.StateShort == "" || state.State == "" || state.CountryShort == "" {
-			return fmt.Errorf("all states must have stateShort, state, and countryShort")
-		}
-	}
+// normalizeQuery returns the form queries are deduplicated by: trimmed, with
+// inner whitespace collapsed to single spaces and lowercased
+func normalizeQuery(query string) string {
+	return strings.ToLower(collapseSpaces(query))
+}
 
-	tx, err := db.db.Begin()
-	if err != nil {
-		return err
+// collapseSpaces trims query and collapses inner whitespace to single spaces
+func collapseSpaces(query string) string {
+	return strings.Join(strings.Fields(query), " ")
+}
+
+// queryKey returns the form new queries are deduplicated by, following
+// SetCaseSensitiveQueries
+func (db *DB) queryKey(query string) string {
+	if db.caseSensitive {
+		return collapseSpaces(query)
 	}
-	defer tx.Rollback()
+	return normalizeQuery(query)
+}
 
-	stmt, err := tx.Prepare(`
-		INSERT OR IGNORE INTO states (stateShort, state, countryShort, used, external)
-		VALUES (?, ?, ?, ?, ?)
-	`)
+// addColumnIfMissing adds a column to a table unless it already exists
+func (db *DB) addColumnIfMissing(table, column, definition string) error {
+	rows, err := db.conn().QueryContext(db.queryCtx(), fmt.Sprintf("PRAGMA table_info(%s)", table))
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
+	defer rows.Close()
 
-	for _, state := range states {
-		_, err := stmt.Exec(state.StateShort, state.State, state.CountryShort, state.Used, external)
-		if err != nil {
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			colType    string
+			notNull    bool
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultVal, &primaryKey); err != nil {
 			return err
 		}
+		if name == column {
+			return nil
+		}
 	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
 
-	return tx.Commit()
+	_, err = db.conn().ExecContext(db.queryCtx(), fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
 }
 
-// AddCities adds cities to the database
-func (db *DB) AddCities(cities []City, external bool) error {
-	for _, city := range cities {
-		if city.City == "" || city.StateShort == "" || city.CountryShort == "" {
-			return fmt.Errorf("all cities must have city, stateShort, and countryShort")
+// normalizeCode trims and uppercases a country or state short code so codes
+// added by hand match the uppercase codes of the downloaded data
+func normalizeCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// AddCountries adds countries to the database
+func (db *DB) AddCountries(countries []Country, external bool) error {
+	for _, country := range countries {
+		if normalizeCode(country.CountryShort) == "" || country.Country == "" {
+			return fmt.Errorf("all countries must have countryShort and country")
 		}
 	}
 
-	tx, err := db.db.Begin()
+	tx, err := db.begin()
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
 	stmt, err := tx.Prepare(`
-		INSERT OR IGNORE INTO cities (city, stateShort, countryShort, county, used, external)
-		VALUES (?, ?, ?, ?, ?, ?)
+		INSERT OR IGNORE INTO countries (countryShort, country, used, external)
+		VALUES (?, ?, ?, ?)
 	`)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	for _, city := range cities {
-		_, err := stmt.Exec(city.City, city.StateShort, city.CountryShort, city.County, city.Used, external)
+	for _, country := range countries {
+		_, err := stmt.Exec(normalizeCode(country.CountryShort), country.Country, country.Used, external)
 		if err != nil {
 			return err
 		}
@@ -212,64 +637,117 @@ func (db *DB) AddCities(cities []City, external bool) error {
 	return tx.Commit()
 }
 
-// AddZips adds zip codes to the database
-func (db *DB) AddZips(zips []Zip, external bool) error {
-	for _, zip := range zips {
-		if zip.Zip == "" || zip.CountryShort == "" {
-			return fmt.Errorf("all zips must have zip and countryShort")
-		}
-	}
+// singleTimezoneCountries selects the countries whose metadata lists exactly
+// one timezone, which their cities can be assumed to be in
+const singleTimezoneCountries = `SELECT countryShort FROM country_metadata WHERE timezones != '' AND timezones NOT LIKE '%,%'`
 
-	tx, err := db.db.Begin()
+// AddCountryMetadata stores downloaded country metadata, replacing existing entries
+func (db *DB) AddCountryMetadata(countries []CountryData) error {
+	tx, err := db.begin()
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
 	stmt, err := tx.Prepare(`
-		INSERT OR IGNORE INTO zips (zip, countryShort, used, external)
-		VALUES (?, ?, ?, ?)
+		INSERT OR REPLACE INTO country_metadata (countryShort, country, iso3, region, subregion, currency, currencyName, timezones)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
 	`)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	for _, zip := range zips {
-		_, err := stmt.Exec(zip.Zip, zip.CountryShort, zip.Used, external)
+	for _, country := range countries {
+		if country.ISO2 == "" || country.Name == "" {
+			continue
+		}
+		zones := make([]string, 0, len(country.Timezones))
+		for _, tz := range country.Timezones {
+			zones = append(zones, tz.ZoneName)
+		}
+		_, err := stmt.Exec(strings.ToUpper(country.ISO2), country.Name, strings.ToUpper(country.ISO3), country.Region, country.Subregion, country.Currency, country.CurrencyName, strings.Join(zones, ","))
 		if err != nil {
 			return err
 		}
 	}
 
+	// Cities added before the metadata take their country's only timezone
+	_, err = tx.Exec(`
+		UPDATE cities SET timezone = (SELECT m.timezones FROM country_metadata m WHERE m.countryShort = cities.countryShort)
+		WHERE timezone IS NULL AND countryShort IN (` + singleTimezoneCountries + `)
+	`)
+	if err != nil {
+		return err
+	}
+
 	return tx.Commit()
 }
 
-// AddQueries adds queries to the database
-func (db *DB) AddQueries(queries []string, external bool) error {
-	for _, query := range queries {
-		if query == "" {
-			return fmt.Errorf("all queries must be non-empty strings")
+// GetCountryMetadata retrieves stored metadata for an ISO2 code, or nil if unknown
+func (db *DB) GetCountryMetadata(countryShort string) (*CountryData, error) {
+	return db.getCountryMetadata("countryShort", countryShort)
+}
+
+// GetCountryMetadataByISO3 retrieves metadata for a three-letter country code,
+// or nil if it is not known
+func (db *DB) GetCountryMetadataByISO3(iso3 string) (*CountryData, error) {
+	return db.getCountryMetadata("iso3", iso3)
+}
+
+// getCountryMetadata retrieves the metadata row whose column matches code
+func (db *DB) getCountryMetadata(column, code string) (*CountryData, error) {
+	var c CountryData
+	var iso3, region, subregion, currency, currencyName, timezones sql.NullString
+	query := fmt.Sprintf(`SELECT countryShort, country, iso3, region, subregion, currency, currencyName, timezones FROM country_metadata WHERE %s = ?`, column)
+	err := db.conn().QueryRowContext(db.queryCtx(), query, strings.ToUpper(code)).Scan(
+		&c.ISO2, &c.Name, &iso3, &region, &subregion, &currency, &currencyName, &timezones)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.ISO3 = iso3.String
+	c.Region = region.String
+	c.Subregion = subregion.String
+	c.Currency = currency.String
+	c.CurrencyName = currencyName.String
+	if timezones.String != "" {
+		for _, zone := range strings.Split(timezones.String, ",") {
+			c.Timezones = append(c.Timezones, CountryTimezone{ZoneName: zone})
+		}
+	}
+	return &c, nil
+}
+
+// AddStates adds states to the database
+func (db *DB) AddStates(states []State, external bool) error {
+	for _, state := range states {
+		if normalizeCode(state.StateShort) == "" || state.State == "" || normalizeCode(state.CountryShort) == "" {
+			return fmt.Errorf("all states must have stateShort, state, and countryShort")
 		}
 	}
 
-	tx, err := db.db.Begin()
+	tx, err := db.begin()
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
 	stmt, err := tx.Prepare(`
-		INSERT OR IGNORE INTO queries (query, used, external)
-		VALUES (?, ?, ?)
+		INSERT OR IGNORE INTO states (stateShort, state, countryShort, county, used, external)
+		VALUES (?, ?, ?, ?, ?, ?)
 	`)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	for _, query := range queries {
-		_, err := stmt.Exec(query, false, external)
+	for _, state := range states {
+		_, err := stmt.Exec(normalizeCode(state.StateShort), state.State, normalizeCode(state.CountryShort), state.County, state.Used, external)
 		if err != nil {
 			return err
 		}
@@ -278,270 +756,1623 @@ func (db *DB) AddQueries(queries []string, external bool) error {
 	return tx.Commit()
 }
 
-// ClearQueries removes external queries
-func (db *DB) ClearQueries() error {
-	_, err := db.db.Exec(`DELETE FROM queries WHERE external = 1`)
-	return err
+// SetStrictReferences makes AddCities fail when a city references a state
+// that does not exist, instead of the insert being silently ignored
+func (db *DB) SetStrictReferences(strict bool) {
+	db.strictReferences = strict
 }
 
-// GetQueries retrieves all queries
-func (db *DB) GetQueries() ([]Query, error) {
-	rows, err := db.db.Query(`SELECT id, query, used, external FROM queries`)
-	if err != nil {
+// SetCaseSensitiveQueries makes AddQueries and AddWeightedQueries treat
+// queries differing only in case as distinct, e.g. for case-significant
+// search terms. Whitespace is normalized either way. Queries already stored
+// keep the form they were deduplicated under, so set this before adding any.
+func (db *DB) SetCaseSensitiveQueries(caseSensitive bool) {
+	db.caseSensitive = caseSensitive
+}
+
+// SetSourceFilter restricts GetCountries, GetStates, GetCities, GetZips and the
+// per-country counts to external or builtin rows. With SourceFilterExternal,
+// countries and states are also kept when they contain external rows, so
+// external cities added under a downloaded country remain reachable.
+func (db *DB) SetSourceFilter(filter SourceFilter) {
+	db.sourceFilter = filter
+}
+
+// sourceCondition returns the SQL condition applying the source filter to a
+// table, qualifying columns with alias when set, or "" when nothing is filtered
+func (db *DB) sourceCondition(table, alias string) string {
+	if alias == "" {
+		alias = table
+	}
+
+	switch db.sourceFilter {
+	case SourceFilterBuiltin:
+		return alias + ".external = 0"
+	case SourceFilterExternal:
+		switch table {
+		case "countries":
+			return fmt.Sprintf(`(%[1]s.external = 1
+				OR EXISTS (SELECT 1 FROM states xs WHERE xs.countryShort = %[1]s.countryShort AND xs.external = 1)
+				OR EXISTS (SELECT 1 FROM cities xc WHERE xc.countryShort = %[1]s.countryShort AND xc.external = 1)
+				OR EXISTS (SELECT 1 FROM zips xz WHERE xz.countryShort = %[1]s.countryShort AND xz.external = 1))`, alias)
+		case "states":
+			return fmt.Sprintf(`(%[1]s.external = 1
+				OR EXISTS (SELECT 1 FROM cities xc WHERE xc.stateShort = %[1]s.stateShort AND xc.countryShort = %[1]s.countryShort AND xc.external = 1))`, alias)
+		default:
+			return alias + ".external = 1"
+		}
+	}
+	return ""
+}
+
+// withSourceCondition appends the source filter for table to a WHERE clause
+func (db *DB) withSourceCondition(where, table, alias string) string {
+	condition := db.sourceCondition(table, alias)
+	switch {
+	case condition == "":
+		return where
+	case where == "":
+		return condition
+	default:
+		return "(" + where + ") AND " + condition
+	}
+}
+
+// missingStateReferences returns the stateShort/countryShort pairs referenced
+// by cities that are not present in the states table
+func missingStateReferences(tx txConn, cities []City) ([]string, error) {
+	stmt, err := tx.Prepare("SELECT COUNT(*) FROM states WHERE stateShort = ? AND countryShort = ?")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	seen := make(map[string]bool)
+	var missing []string
+	for _, city := range cities {
+		stateShort, countryShort := normalizeCode(city.StateShort), normalizeCode(city.CountryShort)
+		ref := stateShort + "/" + countryShort
+		if seen[ref] {
+			continue
+		}
+		seen[ref] = true
+
+		var count int
+		if err := stmt.QueryRow(stateShort, countryShort).Scan(&count); err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			missing = append(missing, ref)
+		}
+	}
+
+	return missing, nil
+}
+
+// AddCities adds cities to the database
+func (db *DB) AddCities(cities []City, external bool) error {
+	for _, city := range cities {
+		if city.City == "" || normalizeCode(city.StateShort) == "" || normalizeCode(city.CountryShort) == "" {
+			return fmt.Errorf("all cities must have city, stateShort, and countryShort")
+		}
+	}
+
+	tx, err := db.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if db.strictReferences {
+		missing, err := missingStateReferences(tx, cities)
+		if err != nil {
+			return err
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("cities reference unknown states: %s", strings.Join(missing, ", "))
+		}
+	}
+
+	zones, err := singleTimezones(tx)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT OR IGNORE INTO cities (city, stateShort, countryShort, county, latitude, longitude, timezone, used, external)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, city := range cities {
+		countryShort := normalizeCode(city.CountryShort)
+		timezone := city.Timezone
+		if timezone == nil {
+			if zone, ok := zones[countryShort]; ok {
+				timezone = &zone
+			}
+		}
+		_, err := stmt.Exec(city.City, normalizeCode(city.StateShort), countryShort, city.County, city.Latitude, city.Longitude, timezone, city.Used, external)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// singleTimezones maps each country with exactly one known timezone to it
+func singleTimezones(tx txConn) (map[string]string, error) {
+	rows, err := tx.Query(`SELECT countryShort, timezones FROM country_metadata WHERE countryShort IN (` + singleTimezoneCountries + `)`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	zones := make(map[string]string)
+	for rows.Next() {
+		var countryShort, zone string
+		if err := rows.Scan(&countryShort, &zone); err != nil {
+			return nil, err
+		}
+		zones[countryShort] = zone
+	}
+	return zones, rows.Err()
+}
+
+// AddZips adds zip codes to the database
+func (db *DB) AddZips(zips []Zip, external bool) error {
+	for _, zip := range zips {
+		if zip.Zip == "" || normalizeCode(zip.CountryShort) == "" {
+			return fmt.Errorf("all zips must have zip and countryShort")
+		}
+	}
+
+	tx, err := db.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		INSERT OR IGNORE INTO zips (zip, countryShort, stateShort, used, external)
+		VALUES (?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, zip := range zips {
+		var stateShort *string
+		if zip.StateShort != nil {
+			normalized := normalizeCode(*zip.StateShort)
+			stateShort = &normalized
+		}
+		_, err := stmt.Exec(zip.Zip, normalizeCode(zip.CountryShort), stateShort, zip.Used, external)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// AddZipPrefixes truncates zip codes to the given prefix length and adds the
+// distinct prefixes to the database
+func (db *DB) AddZipPrefixes(zips []Zip, prefixLength int, external bool) error {
+	seen := make(map[string]bool)
+	var prefixes []Zip
+	for _, zip := range zips {
+		prefix := PostalCodePrefix(zip.Zip, prefixLength)
+		key := zip.CountryShort + "#" + prefix
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		zip.Zip = prefix
+		prefixes = append(prefixes, zip)
+	}
+
+	return db.AddZips(prefixes, external)
+}
+
+// PruneBuiltinLocations deletes builtin (non-external) locations that are not
+// among the given ones, such as those a replaced data file no longer lists.
+// States and countries that added data or saved sessions still refer to are
+// kept. It returns the number of rows deleted.
+func (db *DB) PruneBuiltinLocations(countries []Country, states []State, cities []City, zips []Zip) (int, error) {
+	keep := make(map[string]bool, len(countries)+len(states)+len(cities)+len(zips))
+	for _, c := range countries {
+		keep["country#"+normalizeCode(c.CountryShort)] = true
+	}
+	for _, s := range states {
+		keep["state#"+normalizeCode(s.CountryShort)+"#"+normalizeCode(s.StateShort)] = true
+	}
+	for _, c := range cities {
+		keep["city#"+normalizeCode(c.CountryShort)+"#"+normalizeCode(c.StateShort)+"#"+c.City] = true
+	}
+	for _, z := range zips {
+		keep["zip#"+normalizeCode(z.CountryShort)+"#"+z.Zip] = true
+	}
+
+	tx, err := db.begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Children go first, so a parent is only deleted once nothing refers to it
+	levels := []struct {
+		key    string
+		query  string
+		delete string
+	}{
+		{"zip", `SELECT countryShort || '#' || zip, id FROM zips WHERE external = 0`,
+			`DELETE FROM zips WHERE id = ?`},
+		{"city", `SELECT countryShort || '#' || stateShort || '#' || city, id FROM cities WHERE external = 0`,
+			`DELETE FROM cities WHERE id = ?`},
+		{"state", `SELECT countryShort || '#' || stateShort, rowid FROM states WHERE external = 0`,
+			`DELETE FROM states WHERE rowid = ?
+				AND NOT EXISTS (SELECT 1 FROM cities c WHERE c.stateShort = states.stateShort AND c.countryShort = states.countryShort)
+				AND NOT EXISTS (SELECT 1 FROM nav_sessions ns WHERE ns.stateShort = states.stateShort AND ns.countryShort = states.countryShort)`},
+		{"country", `SELECT countryShort, rowid FROM countries WHERE external = 0`,
+			`DELETE FROM countries WHERE rowid = ?
+				AND NOT EXISTS (SELECT 1 FROM states s WHERE s.countryShort = countries.countryShort)
+				AND NOT EXISTS (SELECT 1 FROM cities c WHERE c.countryShort = countries.countryShort)
+				AND NOT EXISTS (SELECT 1 FROM zips z WHERE z.countryShort = countries.countryShort)
+				AND NOT EXISTS (SELECT 1 FROM nav_sessions ns WHERE ns.countryShort = countries.countryShort)`},
+	}
+
+	removed := 0
+	for _, level := range levels {
+		rows, err := tx.Query(level.query)
+		if err != nil {
+			return 0, err
+		}
+		var stale []int64
+		for rows.Next() {
+			var key string
+			var id int64
+			if err := rows.Scan(&key, &id); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			if !keep[level.key+"#"+key] {
+				stale = append(stale, id)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+
+		for _, id := range stale {
+			result, err := tx.Exec(level.delete, id)
+			if err != nil {
+				return 0, err
+			}
+			n, err := result.RowsAffected()
+			if err != nil {
+				return 0, err
+			}
+			removed += int(n)
+		}
+	}
+
+	return removed, tx.Commit()
+}
+
+// AddQueries adds queries to the database. Queries are trimmed and
+// deduplicated ignoring case and whitespace, keeping the first spelling added.
+func (db *DB) AddQueries(queries []string, external bool) error {
+	for _, query := range queries {
+		if strings.TrimSpace(query) == "" {
+			return fmt.Errorf("all queries must be non-empty strings")
+		}
+	}
+
+	tx, err := db.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		INSERT OR IGNORE INTO queries (query, normalized, used, external)
+		VALUES (?, ?, ?, ?)
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, query := range queries {
+		_, err := stmt.Exec(strings.TrimSpace(query), db.queryKey(query), false, external)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// AddWeightedQueries adds queries with a weight, the number of times each is
+// run over every location in query formats. Weights below 1 are stored as 1 and
+// existing queries have their weight updated.
+func (db *DB) AddWeightedQueries(weights map[string]int, external bool) error {
+	queries := make([]string, 0, len(weights))
+	for query := range weights {
+		if strings.TrimSpace(query) == "" {
+			return fmt.Errorf("all queries must be non-empty strings")
+		}
+		queries = append(queries, query)
+	}
+	// Insert in a stable order so query IDs don't depend on map iteration
+	sort.Strings(queries)
+
+	tx, err := db.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO queries (query, normalized, weight, used, external)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(normalized) DO UPDATE SET weight = excluded.weight
+		ON CONFLICT(query) DO UPDATE SET weight = excluded.weight
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, query := range queries {
+		weight := weights[query]
+		if weight < 1 {
+			weight = 1
+		}
+		if _, err := stmt.Exec(strings.TrimSpace(query), db.queryKey(query), weight, false, external); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ClearQueries removes external queries
+func (db *DB) ClearQueries() error {
+	_, err := db.conn().ExecContext(db.queryCtx(), `DELETE FROM queries WHERE external = 1`)
+	return err
+}
+
+// GetQueriesContext is GetQueries bounded by ctx
+func (db *DB) GetQueriesContext(ctx context.Context) ([]Query, error) {
+	return db.WithContext(ctx).GetQueries()
+}
+
+// GetQueries retrieves all queries
+func (db *DB) GetQueries() ([]Query, error) {
+	rows, err := db.conn().QueryContext(db.queryCtx(), `SELECT id, query, weight, used, external FROM queries`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var queries []Query
+	for rows.Next() {
+		var q Query
+		err := rows.Scan(&q.ID, &q.Query, &q.Weight, &q.Used, &q.External)
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, q)
+	}
+
+	return queries, rows.Err()
+}
+
+// GetCountriesContext is GetCountries bounded by ctx
+func (db *DB) GetCountriesContext(ctx context.Context, targetCountry string) ([]Country, error) {
+	return db.WithContext(ctx).GetCountries(targetCountry)
+}
+
+// GetCountries retrieves countries based on target
+func (db *DB) GetCountries(targetCountry string) ([]Country, error) {
+	var query string
+	var args []interface{}
+
+	where := ""
+	if targetCountry != "all" {
+		where = `countryShort = ?`
+		args = []interface{}{targetCountry}
+	}
+
+	query = `SELECT countryShort, country, used, external FROM countries`
+	if where = db.withSourceCondition(where, "countries", ""); where != "" {
+		query += " WHERE " + where
+	}
+
+	rows, err := db.conn().QueryContext(db.queryCtx(), query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var countries []Country
+	for rows.Next() {
+		var c Country
+		err := rows.Scan(&c.CountryShort, &c.Country, &c.Used, &c.External)
+		if err != nil {
+			return nil, err
+		}
+		countries = append(countries, c)
+	}
+
+	return countries, rows.Err()
+}
+
+// GetStatesContext is GetStates bounded by ctx
+func (db *DB) GetStatesContext(ctx context.Context, countryShorts []string) ([]State, error) {
+	return db.WithContext(ctx).GetStates(countryShorts)
+}
+
+// GetStates retrieves states for given countries
+func (db *DB) GetStates(countryShorts []string) ([]State, error) {
+	if len(countryShorts) == 0 {
+		return []State{}, nil
+	}
+
+	placeholders := strings.Repeat("?,", len(countryShorts))
+	placeholders = placeholders[:len(placeholders)-1] // Remove trailing comma
+
+	where := db.withSourceCondition(fmt.Sprintf(`countryShort IN (%s)`, placeholders), "states", "")
+	query := `SELECT stateShort, state, countryShort, county, used, external FROM states WHERE ` + where
+
+	args := make([]interface{}, len(countryShorts))
+	for i, cs := range countryShorts {
+		args[i] = cs
+	}
+
+	rows, err := db.conn().QueryContext(db.queryCtx(), query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var states []State
+	for rows.Next() {
+		var s State
+		err := rows.Scan(&s.StateShort, &s.State, &s.CountryShort, &s.County, &s.Used, &s.External)
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, s)
+	}
+
+	return states, rows.Err()
+}
+
+// GetStatesWithContent retrieves states for given countries that have at least one city
+func (db *DB) GetStatesWithContent(countryShorts []string) ([]State, error) {
+	if len(countryShorts) == 0 {
+		return []State{}, nil
+	}
+
+	placeholders := strings.Repeat("?,", len(countryShorts))
+	placeholders = placeholders[:len(placeholders)-1]
+
+	query := fmt.Sprintf(`
+		SELECT s.stateShort, s.state, s.countryShort, s.county, s.used, s.external FROM states s
+		WHERE s.countryShort IN (%s)
+		AND EXISTS (SELECT 1 FROM cities c WHERE c.stateShort = s.stateShort AND c.countryShort = s.countryShort)
+	`, placeholders)
+	if condition := db.sourceCondition("states", "s"); condition != "" {
+		query += " AND " + condition
+	}
+
+	args := make([]interface{}, len(countryShorts))
+	for i, cs := range countryShorts {
+		args[i] = cs
+	}
+
+	rows, err := db.conn().QueryContext(db.queryCtx(), query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var states []State
+	for rows.Next() {
+		var s State
+		err := rows.Scan(&s.StateShort, &s.State, &s.CountryShort, &s.County, &s.Used, &s.External)
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, s)
+	}
+
+	return states, rows.Err()
+}
+
+// GetCitiesContext is GetCities bounded by ctx
+func (db *DB) GetCitiesContext(ctx context.Context, countryShorts []string, stateShorts []string) ([]City, error) {
+	return db.WithContext(ctx).GetCities(countryShorts, stateShorts)
+}
+
+// GetCities retrieves cities for given countries and states
+func (db *DB) GetCities(countryShorts []string, stateShorts []string) ([]City, error) {
+	if len(countryShorts) == 0 && len(stateShorts) == 0 {
+		return []City{}, nil
+	}
+
+	var query string
+	var args []interface{}
+
+	if len(stateShorts) > 0 {
+		// Build query for state-country combinations
+		var conditions []string
+		for _, stateShort := range stateShorts {
+			for _, countryShort := range countryShorts {
+				conditions = append(conditions, "(stateShort = ? AND countryShort = ?)")
+				args = append(args, stateShort, countryShort)
+			}
+		}
+		query = `SELECT id, city, stateShort, countryShort, county, latitude, longitude, timezone, used, external FROM cities WHERE ` +
+			db.withSourceCondition(strings.Join(conditions, " OR "), "cities", "")
+	} else if len(countryShorts) > 0 {
+		placeholders := strings.Repeat("?,", len(countryShorts))
+		placeholders = placeholders[:len(placeholders)-1]
+		query = `SELECT id, city, stateShort, countryShort, county, latitude, longitude, timezone, used, external FROM cities WHERE ` +
+			db.withSourceCondition(fmt.Sprintf(`countryShort IN (%s)`, placeholders), "cities", "")
+		for _, cs := range countryShorts {
+			args = append(args, cs)
+		}
+	} else {
+		query = `SELECT id, city, stateShort, countryShort, county, latitude, longitude, timezone, used, external FROM cities`
+		if where := db.sourceCondition("cities", ""); where != "" {
+			query += " WHERE " + where
+		}
+	}
+
+	rows, err := db.conn().QueryContext(db.queryCtx(), query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cities []City
+	for rows.Next() {
+		var c City
+		err := rows.Scan(&c.ID, &c.City, &c.StateShort, &c.CountryShort, &c.County, &c.Latitude, &c.Longitude, &c.Timezone, &c.Used, &c.External)
+		if err != nil {
+			return nil, err
+		}
+		cities = append(cities, c)
+	}
+
+	return cities, rows.Err()
+}
+
+// GetUnusedCities retrieves the cities of the given countries not yet marked used
+func (db *DB) GetUnusedCities(countryShorts []string) ([]City, error) {
+	return db.getCitiesByUsed(countryShorts, false)
+}
+
+// GetUsedCities retrieves the cities of the given countries already marked used
+func (db *DB) GetUsedCities(countryShorts []string) ([]City, error) {
+	return db.getCitiesByUsed(countryShorts, true)
+}
+
+// getCitiesByUsed retrieves the cities of the given countries by used flag
+func (db *DB) getCitiesByUsed(countryShorts []string, used bool) ([]City, error) {
+	if len(countryShorts) == 0 {
+		return []City{}, nil
+	}
+
+	query := fmt.Sprintf(`SELECT id, city, stateShort, countryShort, county, latitude, longitude, timezone, used, external FROM cities WHERE used = ? AND countryShort IN (%s)`, placeholders(len(countryShorts)))
+
+	args := make([]interface{}, 0, len(countryShorts)+1)
+	args = append(args, used)
+	for _, cs := range countryShorts {
+		args = append(args, cs)
+	}
+
+	rows, err := db.conn().QueryContext(db.queryCtx(), query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cities []City
+	for rows.Next() {
+		var c City
+		err := rows.Scan(&c.ID, &c.City, &c.StateShort, &c.CountryShort, &c.County, &c.Latitude, &c.Longitude, &c.Timezone, &c.Used, &c.External)
+		if err != nil {
+			return nil, err
+		}
+		cities = append(cities, c)
+	}
+
+	return cities, rows.Err()
+}
+
+// GetCitiesInTimezone returns the cities in an IANA timezone such as
+// "America/Chicago". Cities without a known timezone are never returned.
+func (db *DB) GetCitiesInTimezone(tz string) ([]City, error) {
+	where := db.withSourceCondition(`timezone = ?`, "cities", "")
+	rows, err := db.conn().QueryContext(db.queryCtx(), `SELECT id, city, stateShort, countryShort, county, latitude, longitude, timezone, used, external FROM cities WHERE `+where, tz)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cities []City
+	for rows.Next() {
+		var c City
+		err := rows.Scan(&c.ID, &c.City, &c.StateShort, &c.CountryShort, &c.County, &c.Latitude, &c.Longitude, &c.Timezone, &c.Used, &c.External)
+		if err != nil {
+			return nil, err
+		}
+		cities = append(cities, c)
+	}
+
+	return cities, rows.Err()
+}
+
+// countCitiesByState counts the cities of every state, and how many of them
+// name a county, keyed by country then state code
+func (db *DB) countCitiesByState() (cities, counties map[string]map[string]int, err error) {
+	query := `SELECT countryShort, stateShort, COUNT(*), COUNT(county) FROM cities`
+	if where := db.withSourceCondition("", "cities", ""); where != "" {
+		query += ` WHERE ` + where
+	}
+	query += ` GROUP BY countryShort, stateShort`
+
+	rows, err := db.conn().QueryContext(db.queryCtx(), query)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	cities = make(map[string]map[string]int)
+	counties = make(map[string]map[string]int)
+	for rows.Next() {
+		var countryShort, stateShort string
+		var cityCount, countyCount int
+		if err := rows.Scan(&countryShort, &stateShort, &cityCount, &countyCount); err != nil {
+			return nil, nil, err
+		}
+		if cities[countryShort] == nil {
+			cities[countryShort] = make(map[string]int)
+			counties[countryShort] = make(map[string]int)
+		}
+		cities[countryShort][stateShort] = cityCount
+		counties[countryShort][stateShort] = countyCount
+	}
+	return cities, counties, rows.Err()
+}
+
+// countZipsByState counts the zips of every state, keyed by country then
+// state code, with zips that have no state under ""
+func (db *DB) countZipsByState() (map[string]map[string]int, error) {
+	query := `SELECT countryShort, COALESCE(stateShort, ''), COUNT(*) FROM zips`
+	if where := db.withSourceCondition("", "zips", ""); where != "" {
+		query += ` WHERE ` + where
+	}
+	query += ` GROUP BY countryShort, COALESCE(stateShort, '')`
+
+	rows, err := db.conn().QueryContext(db.queryCtx(), query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	zips := make(map[string]map[string]int)
+	for rows.Next() {
+		var countryShort, stateShort string
+		var count int
+		if err := rows.Scan(&countryShort, &stateShort, &count); err != nil {
+			return nil, err
+		}
+		if zips[countryShort] == nil {
+			zips[countryShort] = make(map[string]int)
+		}
+		zips[countryShort][stateShort] = count
+	}
+	return zips, rows.Err()
+}
+
+// GetZipsContext is GetZips bounded by ctx
+func (db *DB) GetZipsContext(ctx context.Context, countryShorts []string) ([]Zip, error) {
+	return db.WithContext(ctx).GetZips(countryShorts)
+}
+
+// GetZips retrieves zips for given countries
+func (db *DB) GetZips(countryShorts []string) ([]Zip, error) {
+	if len(countryShorts) == 0 {
+		return []Zip{}, nil
+	}
+
+	placeholders := strings.Repeat("?,", len(countryShorts))
+	placeholders = placeholders[:len(placeholders)-1]
+
+	where := db.withSourceCondition(fmt.Sprintf(`countryShort IN (%s)`, placeholders), "zips", "")
+	query := `SELECT id, zip, countryShort, stateShort, used, external FROM zips WHERE ` + where
+
+	args := make([]interface{}, len(countryShorts))
+	for i, cs := range countryShorts {
+		args[i] = cs
+	}
+
+	rows, err := db.conn().QueryContext(db.queryCtx(), query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var zips []Zip
+	for rows.Next() {
+		var z Zip
+		err := rows.Scan(&z.ID, &z.Zip, &z.CountryShort, &z.StateShort, &z.Used, &z.External)
+		if err != nil {
+			return nil, err
+		}
+		zips = append(zips, z)
+	}
+
+	return zips, rows.Err()
+}
+
+// GetCity retrieves a city by ID, or nil if it does not exist
+func (db *DB) GetCity(id int) (*City, error) {
+	var c City
+	err := db.conn().QueryRowContext(db.queryCtx(), `SELECT id, city, stateShort, countryShort, county, latitude, longitude, timezone, used, external FROM cities WHERE id = ?`, id).Scan(
+		&c.ID, &c.City, &c.StateShort, &c.CountryShort, &c.County, &c.Latitude, &c.Longitude, &c.Timezone, &c.Used, &c.External)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// GetState retrieves a state by its short code and country, or nil if it does not exist
+func (db *DB) GetState(stateShort, countryShort string) (*State, error) {
+	var s State
+	err := db.conn().QueryRowContext(db.queryCtx(), `SELECT stateShort, state, countryShort, county, used, external FROM states WHERE stateShort = ? AND countryShort = ?`,
+		normalizeCode(stateShort), normalizeCode(countryShort)).Scan(
+		&s.StateShort, &s.State, &s.CountryShort, &s.County, &s.Used, &s.External)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// GetZip retrieves a zip by ID, or nil if it does not exist
+func (db *DB) GetZip(id int) (*Zip, error) {
+	var z Zip
+	err := db.conn().QueryRowContext(db.queryCtx(), `SELECT id, zip, countryShort, stateShort, used, external FROM zips WHERE id = ?`, id).Scan(
+		&z.ID, &z.Zip, &z.CountryShort, &z.StateShort, &z.Used, &z.External)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &z, nil
+}
+
+// GetQuery retrieves a query by ID, or nil if it does not exist
+func (db *DB) GetQuery(id int) (*Query, error) {
+	var q Query
+	err := db.conn().QueryRowContext(db.queryCtx(), `SELECT id, query, weight, used, external FROM queries WHERE id = ?`, id).Scan(
+		&q.ID, &q.Query, &q.Weight, &q.Used, &q.External)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+// SaveNavSessionContext is SaveNavSession bounded by ctx
+func (db *DB) SaveNavSessionContext(ctx context.Context, session NavSession) error {
+	return db.WithContext(ctx).SaveNavSession(session)
+}
+
+// SaveNavSession saves a navigation session. A session for the same nav (format,
+// entity IDs, target country and navigation index) is updated in place rather
+// than duplicated, and a completed session is never reopened by the update.
+func (db *DB) SaveNavSession(session NavSession) error {
+	_, err := db.upsertNavSession(session)
+	return err
+}
+
+// upsertNavSession saves a navigation session and returns its row ID
+func (db *DB) upsertNavSession(session NavSession) (int, error) {
+	tx, err := db.begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	selectStmt, err := db.prepared(`
+		SELECT id FROM nav_sessions
+		WHERE format = ? AND countryShort = ? AND queryId IS ? AND zipId IS ? AND cityId IS ? AND stateShort IS ?
+			AND targetCountry IS ? AND navIndex IS ?
+		ORDER BY id LIMIT 1
+	`)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int
+	err = tx.Stmt(selectStmt).QueryRow(session.Format, session.CountryShort, session.QueryID, session.ZipID, session.CityID, session.StateShort,
+		session.TargetCountry, session.NavIndex).Scan(&id)
+
+	switch {
+	case err == sql.ErrNoRows:
+		var insertStmt *sql.Stmt
+		insertStmt, err = db.prepared(`
+			INSERT INTO nav_sessions (format, countryShort, queryId, zipId, cityId, stateShort, page, completed, external, targetCountry, navIndex)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`)
+		if err != nil {
+			return 0, err
+		}
+
+		var result sql.Result
+		result, err = tx.Stmt(insertStmt).Exec(session.Format, session.CountryShort, session.QueryID, session.ZipID, session.CityID, session.StateShort, session.Page, session.Completed, session.External, session.TargetCountry, session.NavIndex)
+		if err == nil {
+			var lastID int64
+			lastID, err = result.LastInsertId()
+			id = int(lastID)
+		}
+	case err == nil:
+		var updateStmt *sql.Stmt
+		updateStmt, err = db.prepared(`UPDATE nav_sessions SET page = ?, completed = MAX(completed, ?), external = ? WHERE id = ?`)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Stmt(updateStmt).Exec(session.Page, session.Completed, session.External, id)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return id, tx.Commit()
+}
+
+// UpdateNavSession updates a navigation session
+func (db *DB) UpdateNavSession(id int, updates map[string]interface{}) error {
+	if len(updates) == 0 {
+		return nil
+	}
+
+	var setParts []string
+	var args []interface{}
+
+	for key, value := range updates {
+		setParts = append(setParts, fmt.Sprintf("%s = ?", key))
+		args = append(args, value)
+	}
+	args = append(args, id)
+
+	query := fmt.Sprintf("UPDATE nav_sessions SET %s WHERE id = ?", strings.Join(setParts, ", "))
+	_, err := db.conn().ExecContext(db.queryCtx(), query, args...)
+	return err
+}
+
+// GetCurrentNavSession retrieves the current navigation session
+func (db *DB) GetCurrentNavSession() (*NavSession, error) {
+	stmt, err := db.prepared(`SELECT id, format, countryShort, queryId, zipId, cityId, stateShort, page, completed, external, targetCountry, navIndex FROM nav_sessions WHERE completed = 0 LIMIT 1`)
+	if err != nil {
+		return nil, err
+	}
+
+	var session NavSession
+	err = db.inTx(stmt).QueryRowContext(db.queryCtx()).Scan(
+		&session.ID, &session.Format, &session.CountryShort, &session.QueryID, &session.ZipID, &session.CityID, &session.StateShort, &session.Page, &session.Completed, &session.External, &session.TargetCountry, &session.NavIndex)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+// GetResumableNavSession returns the most recent incomplete session served
+// under a format and target, the one a restarted run should resume. Sessions
+// saved before targets were recorded match any target.
+func (db *DB) GetResumableNavSession(format, targetCountry string) (*NavSession, error) {
+	var session NavSession
+	err := db.conn().QueryRowContext(db.queryCtx(), `
+		SELECT id, format, countryShort, queryId, zipId, cityId, stateShort, page, completed, external, targetCountry, navIndex
+		FROM nav_sessions
+		WHERE completed = 0 AND format = ? AND (targetCountry = ? OR targetCountry IS NULL)
+		ORDER BY id DESC LIMIT 1
+	`, format, targetCountry).Scan(
+		&session.ID, &session.Format, &session.CountryShort, &session.QueryID, &session.ZipID, &session.CityID, &session.StateShort, &session.Page, &session.Completed, &session.External, &session.TargetCountry, &session.NavIndex)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+// GetActiveSessionFormat returns the format of the most recent incomplete
+// session. The boolean is false when there is no incomplete session.
+func (db *DB) GetActiveSessionFormat() (NavFormat, bool, error) {
+	var format string
+	err := db.conn().QueryRowContext(db.queryCtx(), `SELECT format FROM nav_sessions WHERE completed = 0 ORDER BY id DESC LIMIT 1`).Scan(&format)
+
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	return NavFormat(format), true, nil
+}
+
+// GetCompletedNavs returns the entities of every completed session as navs
+func (db *DB) GetCompletedNavs() ([]Nav, error) {
+	rows, err := db.conn().QueryContext(db.queryCtx(), `
+		SELECT q.query, z.zip, c.city, c.county, s.state, s.stateShort, co.country, ns.countryShort
+		FROM nav_sessions ns
+		LEFT JOIN queries q ON q.id = ns.queryId
+		LEFT JOIN zips z ON z.id = ns.zipId
+		LEFT JOIN cities c ON c.id = ns.cityId
+		LEFT JOIN states s ON s.stateShort = ns.stateShort AND s.countryShort = ns.countryShort
+		LEFT JOIN countries co ON co.countryShort = ns.countryShort
+		WHERE ns.completed = 1
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var navs []Nav
+	for rows.Next() {
+		var nav Nav
+		err := rows.Scan(&nav.Query, &nav.Zip, &nav.City, &nav.County, &nav.State, &nav.StateShort, &nav.Country, &nav.CountryShort)
+		if err != nil {
+			return nil, err
+		}
+		navs = append(navs, nav)
+	}
+
+	return navs, rows.Err()
+}
+
+// GetCompletedNavIndices returns the navigation order indices of completed
+// sessions recorded under a format and target country. Sessions saved before
+// indices were tracked are not included.
+func (db *DB) GetCompletedNavIndices(format, targetCountry string) ([]int, error) {
+	rows, err := db.conn().QueryContext(db.queryCtx(), `
+		SELECT navIndex FROM nav_sessions
+		WHERE completed = 1 AND format = ? AND targetCountry = ? AND navIndex IS NOT NULL
+		ORDER BY navIndex
+	`, format, targetCountry)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var indices []int
+	for rows.Next() {
+		var index int
+		if err := rows.Scan(&index); err != nil {
+			return nil, err
+		}
+		indices = append(indices, index)
+	}
+
+	return indices, rows.Err()
+}
+
+// GetNavSession retrieves a navigation session by ID, or nil if it does not exist
+func (db *DB) GetNavSession(id int) (*NavSession, error) {
+	stmt, err := db.prepared(`SELECT id, format, countryShort, queryId, zipId, cityId, stateShort, page, completed, external, targetCountry, navIndex FROM nav_sessions WHERE id = ?`)
+	if err != nil {
+		return nil, err
+	}
+
+	var session NavSession
+	err = db.inTx(stmt).QueryRowContext(db.queryCtx(), id).Scan(
+		&session.ID, &session.Format, &session.CountryShort, &session.QueryID, &session.ZipID, &session.CityID, &session.StateShort, &session.Page, &session.Completed, &session.External, &session.TargetCountry, &session.NavIndex)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+// SaveBookmark stores a named navigation position, replacing any bookmark with the same name
+func (db *DB) SaveBookmark(bookmark Bookmark) error {
+	_, err := db.conn().ExecContext(db.queryCtx(), `
+		INSERT OR REPLACE INTO bookmarks (name, format, targetCountry, navIndex, createdAt)
+		VALUES (?, ?, ?, ?, ?)
+	`, bookmark.Name, bookmark.Format, bookmark.TargetCountry, bookmark.Index, time.Now().UTC())
+	return err
+}
+
+// GetBookmark retrieves a bookmark by name, or nil if it does not exist
+func (db *DB) GetBookmark(name string) (*Bookmark, error) {
+	var b Bookmark
+	err := db.conn().QueryRowContext(db.queryCtx(), `SELECT name, format, targetCountry, navIndex, createdAt FROM bookmarks WHERE name = ?`, name).Scan(
+		&b.Name, &b.Format, &b.TargetCountry, &b.Index, &b.CreatedAt)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &b, nil
+}
+
+// SaveNavCursor persists the current navOrder index for a format and target country
+func (db *DB) SaveNavCursor(format, targetCountry string, index int) error {
+	stmt, err := db.prepared(`
+		INSERT OR REPLACE INTO nav_cursors (format, targetCountry, navIndex)
+		VALUES (?, ?, ?)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.inTx(stmt).ExecContext(db.queryCtx(), format, targetCountry, index)
+	return err
+}
+
+// GetNavCursor retrieves the persisted navOrder index for a format and target
+// country. The boolean is false when no cursor has been saved.
+func (db *DB) GetNavCursor(format, targetCountry string) (int, bool, error) {
+	var index int
+	err := db.conn().QueryRowContext(db.queryCtx(), `SELECT navIndex FROM nav_cursors WHERE format = ? AND targetCountry = ?`, format, targetCountry).Scan(&index)
+
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	return index, true, nil
+}
+
+// GetAllNavSessions retrieves all navigation sessions
+func (db *DB) GetAllNavSessions() ([]NavSession, error) {
+	return db.getNavSessions("")
+}
+
+// GetIncompleteSessions returns every session that was started but never
+// completed, oldest first, such as crawls that died part way through a page
+func (db *DB) GetIncompleteSessions() ([]NavSession, error) {
+	return db.getNavSessions(`WHERE completed = 0 ORDER BY id`)
+}
+
+// getNavSessions returns the sessions selected by a WHERE/ORDER BY clause
+func (db *DB) getNavSessions(clause string) ([]NavSession, error) {
+	rows, err := db.conn().QueryContext(db.queryCtx(), `SELECT id, format, countryShort, queryId, zipId, cityId, stateShort, page, completed, external, targetCountry, navIndex FROM nav_sessions `+clause)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []NavSession
+	for rows.Next() {
+		var s NavSession
+		err := rows.Scan(&s.ID, &s.Format, &s.CountryShort, &s.QueryID, &s.ZipID, &s.CityID, &s.StateShort, &s.Page, &s.Completed, &s.External, &s.TargetCountry, &s.NavIndex)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+
+	return sessions, rows.Err()
+}
+
+// CountCompletedNavSessions returns the number of distinct navigation order
+// indices completed under a format and target country
+func (db *DB) CountCompletedNavSessions(format, targetCountry string) (int, error) {
+	var total int
+	err := db.conn().QueryRowContext(db.queryCtx(), `
+		SELECT COUNT(DISTINCT navIndex) FROM nav_sessions
+		WHERE completed = 1 AND format = ? AND targetCountry = ? AND navIndex IS NOT NULL
+	`, format, targetCountry).Scan(&total)
+	return total, err
+}
+
+// CountIncomplete returns the number of sessions that were started but never completed
+func (db *DB) CountIncomplete() (int, error) {
+	var total int
+	err := db.conn().QueryRowContext(db.queryCtx(), `SELECT COUNT(*) FROM nav_sessions WHERE completed = 0`).Scan(&total)
+	return total, err
+}
+
+// CountZipsByCountry returns the number of zips stored for each country that
+// has any, honoring the source filter
+func (db *DB) CountZipsByCountry() (map[string]int, error) {
+	return db.countByCountry("zips")
+}
+
+// CountStatesByCountry returns the number of states per country, honoring the
+// source filter
+func (db *DB) CountStatesByCountry() (map[string]int, error) {
+	return db.countByCountry("states")
+}
+
+// countByCountry counts the rows of table per country that pass the source filter
+func (db *DB) countByCountry(table string) (map[string]int, error) {
+	query := `SELECT countryShort, COUNT(*) FROM ` + table
+	if where := db.withSourceCondition("", table, ""); where != "" {
+		query += " WHERE " + where
+	}
+	query += " GROUP BY countryShort"
+
+	rows, err := db.conn().QueryContext(db.queryCtx(), query)
+	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var queries []Query
+	counts := make(map[string]int)
 	for rows.Next() {
-		var q Query
-		err := rows.Scan(&q.ID, &q.Query, &q.Used, &q.External)
-		if err != nil {
+		var countryShort string
+		var count int
+		if err := rows.Scan(&countryShort, &count); err != nil {
 			return nil, err
 		}
-		queries = append(queries, q)
+		counts[countryShort] = count
 	}
 
-	return queries, rows.Err()
+	return counts, rows.Err()
 }
 
-// GetCountries retrieves countries based on target
-func (db *DB) GetCountries(targetCountry string) ([]Country, error) {
-	var query string
-	var args []interface{}
-
-	if targetCountry == "all" {
-		query = `SELECT countryShort, country, used, external FROM countries`
-	} else {
-		query = `SELECT countryShort, country, used, external FROM countries WHERE countryShort = ?`
-		args = []interface{}{targetCountry}
+// StateCityCounts returns the states of a country, ordered by name, with the
+// number of cities in each. States without cities are included with a zero count.
+func (db *DB) StateCityCounts(countryShort string) ([]StateCityCount, error) {
+	cityJoin := "c.stateShort = s.stateShort AND c.countryShort = s.countryShort"
+	if condition := db.sourceCondition("cities", "c"); condition != "" {
+		cityJoin += " AND " + condition
 	}
 
-	rows, err := db.db.Query(query, args...)
+	query := fmt.Sprintf(`
+		SELECT s.stateShort, s.state, s.countryShort, s.county, s.used, s.external, COUNT(c.id)
+		FROM states s
+		LEFT JOIN cities c ON %s
+		WHERE %s
+		GROUP BY s.stateShort, s.countryShort
+		ORDER BY s.state
+	`, cityJoin, db.withSourceCondition("s.countryShort = ?", "states", "s"))
+
+	rows, err := db.conn().QueryContext(db.queryCtx(), query, normalizeCode(countryShort))
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var countries []Country
+	var counts []StateCityCount
 	for rows.Next() {
-		var c Country
-		err := rows.Scan(&c.CountryShort, &c.Country, &c.Used, &c.External)
-		if err != nil {
+		var sc StateCityCount
+		s := &sc.State
+		if err := rows.Scan(&s.StateShort, &s.State, &s.CountryShort, &s.County, &s.Used, &s.External, &sc.CityCount); err != nil {
 			return nil, err
 		}
-		countries = append(countries, c)
+		counts = append(counts, sc)
 	}
 
-	return countries, rows.Err()
+	return counts, rows.Err()
 }
 
-// GetStates retrieves states for given countries
-func (db *DB) GetStates(countryShorts []string) ([]State, error) {
-	if len(countryShorts) == 0 {
-		return []State{}, nil
+// CountCitiesByCounty returns, per country, how many cities have a county and
+// how many lack one, honoring the source filter
+func (db *DB) CountCitiesByCounty() (withCounty, withoutCounty map[string]int, err error) {
+	query := `
+		SELECT countryShort,
+			SUM(CASE WHEN county IS NOT NULL AND county != '' THEN 1 ELSE 0 END),
+			SUM(CASE WHEN county IS NULL OR county = '' THEN 1 ELSE 0 END)
+		FROM cities`
+	if where := db.withSourceCondition("", "cities", ""); where != "" {
+		query += " WHERE " + where
 	}
+	query += " GROUP BY countryShort"
 
-	placeholders := strings.Repeat("?,", len(countryShorts))
-	placeholders = placeholders[:len(placeholders)-1] // Remove trailing comma
+	rows, err := db.conn().QueryContext(db.queryCtx(), query)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	withCounty = make(map[string]int)
+	withoutCounty = make(map[string]int)
+	for rows.Next() {
+		var countryShort string
+		var with, without int
+		if err := rows.Scan(&countryShort, &with, &without); err != nil {
+			return nil, nil, err
+		}
+		withCounty[countryShort] = with
+		withoutCounty[countryShort] = without
+	}
+
+	return withCounty, withoutCounty, rows.Err()
+}
 
-	query := fmt.Sprintf(`SELECT stateShort, state, countryShort, used, external FROM states WHERE countryShort IN (%s)`, placeholders)
+// MarkCountriesUsed marks the given countries as used in a single statement
+func (db *DB) MarkCountriesUsed(countryShorts []string) error {
+	if len(countryShorts) == 0 {
+		return nil
+	}
 
 	args := make([]interface{}, len(countryShorts))
 	for i, cs := range countryShorts {
 		args[i] = cs
 	}
 
-	rows, err := db.db.Query(query, args...)
-	if err != nil {
-		return nil, err
+	query := fmt.Sprintf(`UPDATE countries SET used = 1 WHERE countryShort IN (%s)`, placeholders(len(countryShorts)))
+	return db.execMarkUsed(query, len(countryShorts), args...)
+}
+
+// MarkStatesUsed marks the given states as used in a single statement
+func (db *DB) MarkStatesUsed(states []State) error {
+	if len(states) == 0 {
+		return nil
 	}
-	defer rows.Close()
 
-	var states []State
-	for rows.Next() {
-		var s State
-		err := rows.Scan(&s.StateShort, &s.State, &s.CountryShort, &s.Used, &s.External)
-		if err != nil {
-			return nil, err
-		}
-		states = append(states, s)
+	var conditions []string
+	args := []interface{}{time.Now().UTC()}
+	for _, state := range states {
+		conditions = append(conditions, "(stateShort = ? AND countryShort = ?)")
+		args = append(args, state.StateShort, state.CountryShort)
 	}
 
-	return states, rows.Err()
+	query := fmt.Sprintf(`UPDATE states SET used = 1, usedAt = ? WHERE %s`, strings.Join(conditions, " OR "))
+	return db.execMarkUsed(query, len(states), args...)
 }
 
-// GetCities retrieves cities for given countries and states
-func (db *DB) GetCities(countryShorts []string, stateShorts []string) ([]City, error) {
-	if len(countryShorts) == 0 && len(stateShorts) == 0 {
-		return []City{}, nil
+// MarkCitiesUsed marks the cities with the given IDs as used in a single statement
+func (db *DB) MarkCitiesUsed(ids []int) error {
+	return db.markUsedByID("cities", ids, true)
+}
+
+// MarkZipsUsed marks the zips with the given IDs as used in a single statement
+func (db *DB) MarkZipsUsed(ids []int) error {
+	return db.markUsedByID("zips", ids, true)
+}
+
+// MarkQueriesUsed marks the queries with the given IDs as used in a single statement
+func (db *DB) MarkQueriesUsed(ids []int) error {
+	return db.markUsedByID("queries", ids, false)
+}
+
+// markUsedByID sets used (and optionally usedAt) for rows of table with the given IDs
+func (db *DB) markUsedByID(table string, ids []int, trackUsedAt bool) error {
+	if len(ids) == 0 {
+		return nil
 	}
 
-	var query string
 	var args []interface{}
+	set := "used = 1"
+	if trackUsedAt {
+		set += ", usedAt = ?"
+		args = append(args, time.Now().UTC())
+	}
+	for _, id := range ids {
+		args = append(args, id)
+	}
 
-	if len(stateShorts) > 0 {
-		// Build query for state-country combinations
-		var conditions []string
-		for _, stateShort := range stateShorts {
-			for _, countryShort := range countryShorts {
-				conditions = append(conditions, "(stateShort = ? AND countryShort = ?)")
-				args = append(args, stateShort, countryShort)
-			}
-		}
-		query = fmt.Sprintf(`SELECT id, city, stateShort, countryShort, county, used, external FROM cities WHERE %s`, strings.Join(conditions, " OR "))
-	} else if len(countryShorts) > 0 {
-		placeholders := strings.Repeat("?,", len(countryShorts))
-		placeholders = placeholders[:len(placeholders)-1]
-		query = fmt.Sprintf(`SELECT id, city, stateShort, countryShort, county, used, external FROM cities WHERE countryShort IN (%s)`, placeholders)
-		for _, cs := range countryShorts {
-			args = append(args, cs)
-		}
-	} else {
-		query = `SELECT id, city, stateShort, countryShort, county, used, external FROM cities`
+	query := fmt.Sprintf(`UPDATE %s SET %s WHERE id IN (%s)`, table, set, placeholders(len(ids)))
+	return db.execMarkUsed(query, len(ids), args...)
+}
+
+// execMarkUsed runs a mark-used update. The single-entity form issued on every
+// navigation step is served from the statement cache; larger batches vary in
+// shape and are executed directly.
+func (db *DB) execMarkUsed(query string, n int, args ...interface{}) error {
+	if n != 1 {
+		_, err := db.conn().ExecContext(db.queryCtx(), query, args...)
+		return err
 	}
 
-	rows, err := db.db.Query(query, args...)
+	stmt, err := db.prepared(query)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer rows.Close()
 
-	var cities []City
-	for rows.Next() {
-		var c City
-		err := rows.Scan(&c.ID, &c.City, &c.StateShort, &c.CountryShort, &c.County, &c.Used, &c.External)
-		if err != nil {
-			return nil, err
-		}
-		cities = append(cities, c)
-	}
+	_, err = db.inTx(stmt).ExecContext(db.queryCtx(), args...)
+	return err
+}
 
-	return cities, rows.Err()
+// placeholders returns a comma-separated list of n SQL placeholders
+func placeholders(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	p := strings.Repeat("?,", n)
+	return p[:len(p)-1]
 }
 
-// GetZips retrieves zips for given countries
-func (db *DB) GetZips(countryShorts []string) ([]Zip, error) {
-	if len(countryShorts) == 0 {
-		return []Zip{}, nil
+// GetStaleEntities retrieves used states, cities and zips last visited before
+// the given time. Entities marked used before usedAt was tracked count as stale.
+func (db *DB) GetStaleEntities(before time.Time) (*StaleEntities, error) {
+	cutoff := before.UTC()
+	stale := &StaleEntities{}
+
+	stateRows, err := db.conn().QueryContext(db.queryCtx(), `SELECT stateShort, state, countryShort, county, used, external FROM states WHERE used = 1 AND (usedAt IS NULL OR usedAt < ?)`, cutoff)
+	if err != nil {
+		return nil, err
 	}
+	defer stateRows.Close()
 
-	placeholders := strings.Repeat("?,", len(countryShorts))
-	placeholders = placeholders[:len(placeholders)-1]
+	for stateRows.Next() {
+		var s State
+		if err := stateRows.Scan(&s.StateShort, &s.State, &s.CountryShort, &s.County, &s.Used, &s.External); err != nil {
+			return nil, err
+		}
+		stale.States = append(stale.States, s)
+	}
+	if err := stateRows.Err(); err != nil {
+		return nil, err
+	}
 
-	query := fmt.Sprintf(`SELECT id, zip, countryShort, used, external FROM zips WHERE countryShort IN (%s)`, placeholders)
+	cityRows, err := db.conn().QueryContext(db.queryCtx(), `SELECT id, city, stateShort, countryShort, county, latitude, longitude, timezone, used, external FROM cities WHERE used = 1 AND (usedAt IS NULL OR usedAt < ?)`, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	defer cityRows.Close()
 
-	args := make([]interface{}, len(countryShorts))
-	for i, cs := range countryShorts {
-		args[i] = cs
+	for cityRows.Next() {
+		var c City
+		if err := cityRows.Scan(&c.ID, &c.City, &c.StateShort, &c.CountryShort, &c.County, &c.Latitude, &c.Longitude, &c.Timezone, &c.Used, &c.External); err != nil {
+			return nil, err
+		}
+		stale.Cities = append(stale.Cities, c)
+	}
+	if err := cityRows.Err(); err != nil {
+		return nil, err
 	}
 
-	rows, err := db.db.Query(query, args...)
+	zipRows, err := db.conn().QueryContext(db.queryCtx(), `SELECT id, zip, countryShort, stateShort, used, external FROM zips WHERE used = 1 AND (usedAt IS NULL OR usedAt < ?)`, cutoff)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	defer zipRows.Close()
 
-	var zips []Zip
-	for rows.Next() {
+	for zipRows.Next() {
 		var z Zip
-		err := rows.Scan(&z.ID, &z.Zip, &z.CountryShort, &z.Used, &z.External)
-		if err != nil {
+		if err := zipRows.Scan(&z.ID, &z.Zip, &z.CountryShort, &z.StateShort, &z.Used, &z.External); err != nil {
 			return nil, err
 		}
-		zips = append(zips, z)
+		stale.Zips = append(stale.Zips, z)
 	}
 
-	return zips, rows.Err()
+	return stale, zipRows.Err()
 }
 
-// SaveNavSession saves a navigation session
-func (db *DB) SaveNavSession(session NavSession) error {
-	_, err := db.db.Exec(`
-		INSERT INTO nav_sessions (format, countryShort, queryId, zipId, cityId, stateShort, page, completed, external)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, session.Format, session.CountryShort, session.QueryID, session.ZipID, session.CityID, session.StateShort, session.Page, session.Completed, session.External)
-	return err
+// ResetStaleEntities clears the used flag on states, cities and zips last
+// visited before the given time
+func (db *DB) ResetStaleEntities(before time.Time) error {
+	tx, err := db.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"states", "cities", "zips"} {
+		query := fmt.Sprintf(`UPDATE %s SET used = 0, usedAt = NULL WHERE used = 1 AND (usedAt IS NULL OR usedAt < ?)`, table)
+		if _, err := tx.Exec(query, before.UTC()); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
 }
 
-// UpdateNavSession updates a navigation session
-func (db *DB) UpdateNavSession(id int, updates map[string]interface{}) error {
-	if len(updates) == 0 {
-		return nil
+const (
+	orphanStatesWhere = `NOT EXISTS (SELECT 1 FROM countries c WHERE c.countryShort = states.countryShort)`
+	orphanCitiesWhere = `NOT EXISTS (SELECT 1 FROM states s WHERE s.stateShort = cities.stateShort AND s.countryShort = cities.countryShort)`
+)
+
+// FindOrphans lists states that reference a missing country and cities that
+// reference a missing state
+func (db *DB) FindOrphans() (*Orphans, error) {
+	orphans := &Orphans{}
+
+	stateRows, err := db.conn().QueryContext(db.queryCtx(), `SELECT stateShort, state, countryShort, county, used, external FROM states WHERE `+orphanStatesWhere)
+	if err != nil {
+		return nil, err
 	}
+	defer stateRows.Close()
 
-	var setParts []string
-	var args []interface{}
+	for stateRows.Next() {
+		var s State
+		if err := stateRows.Scan(&s.StateShort, &s.State, &s.CountryShort, &s.County, &s.Used, &s.External); err != nil {
+			return nil, err
+		}
+		orphans.States = append(orphans.States, s)
+	}
+	if err := stateRows.Err(); err != nil {
+		return nil, err
+	}
 
-	for key, value := range updates {
-		setParts = append(setParts, fmt.Sprintf("%s = ?", key))
-		args = append(args, value)
+	cityRows, err := db.conn().QueryContext(db.queryCtx(), `SELECT id, city, stateShort, countryShort, county, latitude, longitude, timezone, used, external FROM cities WHERE `+orphanCitiesWhere)
+	if err != nil {
+		return nil, err
 	}
-	args = append(args, id)
+	defer cityRows.Close()
 
-	query := fmt.Sprintf("UPDATE nav_sessions SET %s WHERE id = ?", strings.Join(setParts, ", "))
-	_, err := db.db.Exec(query, args...)
-	return err
+	for cityRows.Next() {
+		var c City
+		if err := cityRows.Scan(&c.ID, &c.City, &c.StateShort, &c.CountryShort, &c.County, &c.Latitude, &c.Longitude, &c.Timezone, &c.Used, &c.External); err != nil {
+			return nil, err
+		}
+		orphans.Cities = append(orphans.Cities, c)
+	}
+
+	return orphans, cityRows.Err()
 }
 
-// GetCurrentNavSession retrieves the current navigation session
-func (db *DB) GetCurrentNavSession() (*NavSession, error) {
-	var session NavSession
-	err := db.db.QueryRow(`SELECT id, format, countryShort, queryId, zipId, cityId, stateShort, page, completed, external FROM nav_sessions WHERE completed = 0 LIMIT 1`).Scan(
-		&session.ID, &session.Format, &session.CountryShort, &session.QueryID, &session.ZipID, &session.CityID, &session.StateShort, &session.Page, &session.Completed, &session.External)
+// PruneOrphans deletes the rows FindOrphans reports in a single transaction and
+// returns how many were removed. States go first so cities left without a state
+// by that delete are pruned as well.
+func (db *DB) PruneOrphans() (int, error) {
+	tx, err := db.begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
 
-	if err == sql.ErrNoRows {
-		return nil, nil
+	removed := 0
+	for _, query := range []string{
+		`DELETE FROM states WHERE ` + orphanStatesWhere,
+		`DELETE FROM cities WHERE ` + orphanCitiesWhere,
+	} {
+		result, err := tx.Exec(query)
+		if err != nil {
+			return 0, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		removed += int(n)
 	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// ResetCompletedBefore deletes the sessions of a format and target country
+// completed before the given time and clears the used flag on the queries,
+// zips, cities and states they covered. Sessions of other formats and targets
+// are left alone. It returns the navigation indices the deleted sessions recorded.
+func (db *DB) ResetCompletedBefore(before time.Time, format, targetCountry string) ([]int, error) {
+	tx, err := db.begin()
 	if err != nil {
 		return nil, err
 	}
+	defer tx.Rollback()
 
-	return &session, nil
-}
+	const stale = `ns.completed = 1 AND (ns.completedAt IS NULL OR ns.completedAt < ?) AND ns.format = ? AND ns.targetCountry = ?`
+	args := []interface{}{before.UTC(), format, targetCountry}
 
-// GetAllNavSessions retrieves all navigation sessions
-func (db *DB) GetAllNavSessions() ([]NavSession, error) {
-	rows, err := db.db.Query(`SELECT id, format, countryShort, queryId, zipId, cityId, stateShort, page, completed, external FROM nav_sessions`)
+	rows, err := tx.Query(`SELECT ns.navIndex FROM nav_sessions ns WHERE `+stale+` AND ns.navIndex IS NOT NULL`, args...)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	var sessions []NavSession
+	var indices []int
 	for rows.Next() {
-		var s NavSession
-		err := rows.Scan(&s.ID, &s.Format, &s.CountryShort, &s.QueryID, &s.ZipID, &s.CityID, &s.StateShort, &s.Page, &s.Completed, &s.External)
-		if err != nil {
+		var index int
+		if err := rows.Scan(&index); err != nil {
+			rows.Close()
 			return nil, err
 		}
-		sessions = append(sessions, s)
+		indices = append(indices, index)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
-	return sessions, rows.Err()
+	queries := []string{
+		`UPDATE queries SET used = 0 WHERE id IN (SELECT ns.queryId FROM nav_sessions ns WHERE ` + stale + `)`,
+		`UPDATE zips SET used = 0, usedAt = NULL WHERE id IN (SELECT ns.zipId FROM nav_sessions ns WHERE ` + stale + `)`,
+		`UPDATE cities SET used = 0, usedAt = NULL WHERE id IN (SELECT ns.cityId FROM nav_sessions ns WHERE ` + stale + `)`,
+		`UPDATE states SET used = 0, usedAt = NULL WHERE EXISTS (SELECT 1 FROM nav_sessions ns WHERE ns.stateShort = states.stateShort AND ns.countryShort = states.countryShort AND ` + stale + `)`,
+		`DELETE FROM nav_sessions AS ns WHERE ` + stale,
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query, args...); err != nil {
+			return nil, err
+		}
+	}
+
+	return indices, tx.Commit()
+}
+
+// DeleteNavSession deletes a single navigation session
+func (db *DB) DeleteNavSession(id int) error {
+	_, err := db.conn().ExecContext(db.queryCtx(), `DELETE FROM nav_sessions WHERE id = ?`, id)
+	return err
 }
 
 // ResetNavSessions deletes all navigation sessions
 func (db *DB) ResetNavSessions() error {
-	_, err := db.db.Exec(`DELETE FROM nav_sessions`)
+	if _, err := db.conn().ExecContext(db.queryCtx(), `DELETE FROM nav_sessions`); err != nil {
+		return err
+	}
+	_, err := db.conn().ExecContext(db.queryCtx(), `DELETE FROM nav_cursors`)
 	return err
 }
 
-// ResetDatabase resets all usage flags and sessions
-func (db *DB) ResetDatabase() error {
-	tx, err := db.db.Begin()
+// ResetDatabase resets all usage flags and, as selected by opts, clears
+// sessions and external data, all in one transaction. Without opts it uses
+// DefaultResetOptions, resetting flags and sessions and keeping external data.
+// Each step is idempotent, so a failed reset can simply be retried.
+func (db *DB) ResetDatabase(opts ...ResetOptions) error {
+	options := DefaultResetOptions
+	if len(opts) > 0 {
+		options = opts[0]
+	}
+
+	tx, err := db.begin()
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
-	queries := []string{
+	var queries []string
+	if options.ClearExternal {
+		// Children first; sessions pointing at removed rows follow the foreign keys
+		queries = append(queries,
+			`DELETE FROM zips WHERE external = 1`,
+			`DELETE FROM cities WHERE external = 1`,
+			`DELETE FROM states WHERE external = 1`,
+			`DELETE FROM countries WHERE external = 1`,
+			`DELETE FROM queries WHERE external = 1`,
+		)
+	}
+	queries = append(queries,
 		`UPDATE countries SET used = 0`,
 		`UPDATE states SET used = 0`,
 		`UPDATE cities SET used = 0`,
 		`UPDATE zips SET used = 0`,
 		`UPDATE queries SET used = 0`,
-		`DELETE FROM nav_sessions`,
+	)
+	if options.ClearSessions {
+		queries = append(queries,
+			`DELETE FROM nav_sessions`,
+			`DELETE FROM nav_cursors`,
+		)
 	}
 
 	for _, query := range queries {
@@ -557,11 +2388,56 @@ func (db *DB) ResetDatabase() error {
 // CountTotal returns the total number of countries
 func (db *DB) CountTotal() (int, error) {
 	var total int
-	err := db.db.QueryRow("SELECT COUNT(*) FROM countries").Scan(&total)
+	err := db.conn().QueryRowContext(db.queryCtx(), "SELECT COUNT(*) FROM countries").Scan(&total)
 	return total, err
 }
 
-// Close closes the database connection
+// dataHashKey is the metadata key holding the hash of the data file the
+// builtin locations were seeded from
+const dataHashKey = "locationDataHash"
+
+// GetMetadata returns a value from the metadata table; ok is false when the
+// key is not set
+func (db *DB) GetMetadata(key string) (value string, ok bool, err error) {
+	err = db.conn().QueryRowContext(db.queryCtx(), `SELECT value FROM metadata WHERE key = ?`, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// SetMetadata stores a value in the metadata table, replacing any previous one
+func (db *DB) SetMetadata(key, value string) error {
+	_, err := db.conn().ExecContext(db.queryCtx(), `INSERT INTO metadata (key, value) VALUES (?, ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value`, key, value)
+	return err
+}
+
+// Checkpoint folds the write-ahead log back into the main database file and
+// truncates the -wal sidecar to zero bytes
+func (db *DB) Checkpoint() error {
+	_, err := db.db.ExecContext(db.queryCtx(), `PRAGMA wal_checkpoint(TRUNCATE)`)
+	return err
+}
+
+// Close checkpoints the WAL and closes the database connection, so no -wal/-shm
+// data is left behind. Handles supplied by the caller are left open, though the
+// statements cached on them are always closed.
 func (db *DB) Close() error {
-	return db.db.Close()
+	stmtErr := db.closeStatements()
+	if !db.ownsConn {
+		return stmtErr
+	}
+
+	checkpointErr := db.Checkpoint()
+	if err := db.db.Close(); err != nil {
+		return err
+	}
+	if checkpointErr != nil {
+		return checkpointErr
+	}
+	return stmtErr
 }
@@ -1,5 +1,7 @@
 package navii
 
+import "time"
+
 // ============================================================================
 // TYPE DEFINITIONS (equivalent to db.types.ts and core.types.ts)
 // ============================================================================
@@ -15,54 +17,103 @@ type Country struct {
 
 // State represents a state/province entity
 type State struct {
-	ID           *int   `json:"id,omitempty" db:"id"`
-	State        string `json:"state" db:"state"`
-	StateShort   string `json:"stateShort" db:"stateShort"`
-	CountryShort string `json:"countryShort" db:"countryShort"`
-	Used         bool   `json:"used" db:"used"`
-	External     bool   `json:"external" db:"external"`
-}
-
-// City represents a city entity
-type City struct {
 	ID           *int    `json:"id,omitempty" db:"id"`
-	City         string  `json:"city" db:"city"`
+	State        string  `json:"state" db:"state"`
 	StateShort   string  `json:"stateShort" db:"stateShort"`
 	CountryShort string  `json:"countryShort" db:"countryShort"`
-	County       *string `json:"county,omitempty" db:"county"`
+	County       *string `json:"county,omitempty" db:"county"` // For countries that nest states under counties
 	Used         bool    `json:"used" db:"used"`
 	External     bool    `json:"external" db:"external"`
 }
 
+// City represents a city entity
+type City struct {
+	ID           *int     `json:"id,omitempty" db:"id"`
+	City         string   `json:"city" db:"city"`
+	StateShort   string   `json:"stateShort" db:"stateShort"`
+	CountryShort string   `json:"countryShort" db:"countryShort"`
+	County       *string  `json:"county,omitempty" db:"county"`
+	Latitude     *float64 `json:"latitude,omitempty" db:"latitude"`
+	Longitude    *float64 `json:"longitude,omitempty" db:"longitude"`
+	Timezone     *string  `json:"timezone,omitempty" db:"timezone"` // IANA name; defaults to the country's when it has only one
+	Used         bool     `json:"used" db:"used"`
+	External     bool     `json:"external" db:"external"`
+}
+
 // Zip represents a postal code entity
 type Zip struct {
-	ID           *int   `json:"id,omitempty" db:"id"`
-	Zip          string `json:"zip" db:"zip"`
-	CountryShort string `json:"countryShort" db:"countryShort"`
-	Used         bool   `json:"used" db:"used"`
-	External     bool   `json:"external" db:"external"`
+	ID           *int    `json:"id,omitempty" db:"id"`
+	Zip          string  `json:"zip" db:"zip"`
+	CountryShort string  `json:"countryShort" db:"countryShort"`
+	StateShort   *string `json:"stateShort,omitempty" db:"stateShort"` // Only set when zip state enrichment was enabled
+	Used         bool    `json:"used" db:"used"`
+	External     bool    `json:"external" db:"external"`
 }
 
 // Query represents a search query entity
 type Query struct {
 	ID       *int   `json:"id,omitempty" db:"id"`
 	Query    string `json:"query" db:"query"`
+	Weight   int    `json:"weight" db:"weight"` // Times the query is run over every location
 	Used     bool   `json:"used" db:"used"`
 	External bool   `json:"external" db:"external"`
 }
 
+// StaleEntities groups entities whose last visit is older than a cutoff
+type StaleEntities struct {
+	States []State `json:"states"`
+	Cities []City  `json:"cities"`
+	Zips   []Zip   `json:"zips"`
+}
+
+// Orphans groups states and cities whose parent rows are missing, which can
+// happen when foreign keys were not enforced or the database was edited externally
+type Orphans struct {
+	States []State `json:"states"` // States without a matching country
+	Cities []City  `json:"cities"` // Cities without a matching state
+}
+
+// StateCityCount pairs a state with the number of cities it contains
+type StateCityCount struct {
+	State     State `json:"state"`
+	CityCount int   `json:"cityCount"`
+}
+
+// CountryPreflight reports whether a country has the data each level of a
+// format needs. Missing lists the levels without data; a country missing any
+// is skipped or only partly navigated.
+type CountryPreflight struct {
+	CountryShort     string   `json:"countryShort"`
+	States           int      `json:"states"`
+	Cities           int      `json:"cities"`
+	CitiesWithCounty int      `json:"citiesWithCounty"`
+	Zips             int      `json:"zips"`
+	Missing          []string `json:"missing,omitempty"`
+}
+
 // NavSession represents a navigation session
 type NavSession struct {
-	ID           int     `json:"id" db:"id"`
-	Format       string  `json:"format" db:"format"`
-	CountryShort string  `json:"countryShort" db:"countryShort"`
-	QueryID      *int    `json:"queryId,omitempty" db:"queryId"`
-	ZipID        *int    `json:"zipId,omitempty" db:"zipId"`
-	CityID       *int    `json:"cityId,omitempty" db:"cityId"`
-	StateShort   *string `json:"stateShort,omitempty" db:"stateShort"`
-	Page         string  `json:"page" db:"page"`
-	Completed    bool    `json:"completed" db:"completed"`
-	External     bool    `json:"external" db:"external"`
+	ID            int     `json:"id" db:"id"`
+	Format        string  `json:"format" db:"format"`
+	CountryShort  string  `json:"countryShort" db:"countryShort"`
+	QueryID       *int    `json:"queryId,omitempty" db:"queryId"`
+	ZipID         *int    `json:"zipId,omitempty" db:"zipId"`
+	CityID        *int    `json:"cityId,omitempty" db:"cityId"`
+	StateShort    *string `json:"stateShort,omitempty" db:"stateShort"`
+	Page          string  `json:"page" db:"page"`
+	Completed     bool    `json:"completed" db:"completed"`
+	External      bool    `json:"external" db:"external"`
+	TargetCountry *string `json:"targetCountry,omitempty" db:"targetCountry"` // Init target the session was served under
+	NavIndex      *int    `json:"navIndex,omitempty" db:"navIndex"`           // Position in the navigation order when last served
+}
+
+// Bookmark is a named navigation position that can be returned to later
+type Bookmark struct {
+	Name          string    `json:"name" db:"name"`
+	Format        string    `json:"format" db:"format"`
+	TargetCountry string    `json:"targetCountry" db:"targetCountry"`
+	Index         int       `json:"index" db:"navIndex"`
+	CreatedAt     time.Time `json:"createdAt" db:"createdAt"`
 }
 
 // NavFormat represents different navigation format types
@@ -80,6 +131,13 @@ type Nav struct {
 	County       *string `json:"county,omitempty"`
 }
 
+// NavSegment is the half-open range of navOrder indices belonging to one country
+type NavSegment struct {
+	CountryShort string `json:"countryShort"`
+	Start        int    `json:"start"`
+	End          int    `json:"end"`
+}
+
 // PageNav represents pagination information
 type PageNav struct {
 	Pages []int `json:"pages"`
@@ -94,14 +152,70 @@ type NavResponse struct {
 	Placeholder string      `json:"placeholder"`
 	Page        interface{} `json:"page"` // Can be PageNav or "completed" or nil
 	HasNext     bool        `json:"hasNext"`
+	Index       int         `json:"index"` // Zero-based position in the navigation order, -1 when not part of it
+	Total       int         `json:"total"` // Length of the navigation order
+
+	// Used reports, per level ("query", "zip", "city", "state", "country"),
+	// whether the entity had already been marked used when it was loaded
+	Used map[string]bool `json:"used,omitempty"`
+}
+
+// NavStats is a snapshot of the state manager's progress counters
+type NavStats struct {
+	NavOrderLength int `json:"navOrderLength"`
+	CurrentIndex   int `json:"currentIndex"`
+	Completed      int `json:"completed"` // Completed sessions for the active format
+	QueriesCount   int `json:"queriesCount"`
+	CountriesCount int `json:"countriesCount"`
+	StatesCount    int `json:"statesCount"`
+	CitiesCount    int `json:"citiesCount"`
+	ZipsCount      int `json:"zipsCount"`
 }
 
 // InitOptions represents initialization options
 type InitOptions struct {
-	Format        NavFormat `json:"format"`
-	TargetCountry string    `json:"targetCountry"` // ISO2 code or "all"
+	Format                NavFormat           `json:"format"`
+	TargetCountry         string              `json:"targetCountry"`         // ISO2 or ISO3 code, or "all"
+	ExcludeCountries      []string            `json:"excludeCountries"`      // Countries skipped when TargetCountry is "all"
+	PriorityCountries     []string            `json:"priorityCountries"`     // Countries navigated first, in this order, when TargetCountry is "all"
+	ExcludeStates         map[string][]string `json:"excludeStates"`         // State codes skipped per country code, along with their cities and zips
+	RequireNonEmptyStates bool                `json:"requireNonEmptyStates"` // Skip states without cities
+	StrictReferences      bool                `json:"strictReferences"`      // Reject cities referencing unknown states
+	CaseSensitiveQueries  bool                `json:"caseSensitiveQueries"`  // Keep queries differing only in case apart
+	LazyCities            bool                `json:"lazyCities"`            // Load cities one country at a time
+	AutoCompleteNonPaged  bool                `json:"autoCompleteNonPaged"`  // Advancing completes items that never set pages
+	Limit                 int                 `json:"limit"`                 // Stop serving after this many items; 0 means no limit
+	SourceFilter          SourceFilter        `json:"sourceFilter"`          // Navigate all, only external or only builtin data
+	QueryOrder            QueryOrder          `json:"queryOrder"`            // Nesting of queries and locations in query formats
+	EnsureData            bool                `json:"ensureData"`            // Download location data when the database and data file are empty
+}
+
+// ResetOptions selects what ResetDatabase clears besides the used flags
+type ResetOptions struct {
+	ClearSessions bool `json:"clearSessions"` // Delete navigation sessions and cursors
+	ClearExternal bool `json:"clearExternal"` // Delete data added through the Add* methods
 }
 
+// DefaultResetOptions is what ResetDatabase does when called without options
+var DefaultResetOptions = ResetOptions{ClearSessions: true}
+
+// QueryOrder controls how query formats nest queries and locations
+type QueryOrder string
+
+const (
+	QueryOrderQueryMajor    QueryOrder = "query-major"    // Each query over every location, then the next query (default)
+	QueryOrderLocationMajor QueryOrder = "location-major" // Every query for a location, then the next location
+)
+
+// SourceFilter restricts which data is navigated by its origin
+type SourceFilter string
+
+const (
+	SourceFilterAll      SourceFilter = "all"      // Downloaded and externally added data
+	SourceFilterExternal SourceFilter = "external" // Only data added through the Add* methods
+	SourceFilterBuiltin  SourceFilter = "builtin"  // Only the downloaded baseline
+)
+
 // ICountryShort represents valid ISO2 country codes
 var ValidCountryCodes = []string{
 	"AD", "AE", "AF", "AG", "AI", "AL", "AM", "AO", "AQ", "AR", "AS", "AT", "AU", "AW", "AX", "AZ",
@@ -0,0 +1,230 @@
+package navii
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCloseLeavesNoWAL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := NewDB(path)
+	mustNoError(t, err)
+	mustNoError(t, db.AddCountries([]Country{{Country: "United States", CountryShort: "US"}}, false))
+	mustNoError(t, db.Close())
+
+	info, err := os.Stat(path + "-wal")
+	if err == nil && info.Size() > 0 {
+		t.Fatalf("-wal file holds %d bytes after Close", info.Size())
+	}
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+
+	db, err = NewDB(path)
+	mustNoError(t, err)
+	defer db.Close()
+	countries, err := db.GetCountries("all")
+	mustNoError(t, err)
+	if len(countries) != 1 {
+		t.Fatalf("got %d countries after reopening, want 1", len(countries))
+	}
+}
+
+func TestAddStatesNormalizesCodes(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "test.db"))
+	mustNoError(t, err)
+	defer db.Close()
+
+	mustNoError(t, db.AddCountries([]Country{{Country: "United States", CountryShort: "us"}}, false))
+	mustNoError(t, db.AddStates([]State{{State: "California", StateShort: "ca", CountryShort: "us"}}, true))
+	mustNoError(t, db.AddStates([]State{{State: "California", StateShort: "CA", CountryShort: "US"}}, false))
+	mustNoError(t, db.AddCities([]City{{City: "Los Angeles", StateShort: "ca", CountryShort: "us"}}, true))
+
+	states, err := db.GetStates([]string{"US"})
+	mustNoError(t, err)
+	if len(states) != 1 || states[0].StateShort != "CA" || states[0].CountryShort != "US" {
+		t.Fatalf("GetStates() = %+v, want one state CA in US", states)
+	}
+
+	cities, err := db.GetCities([]string{"US"}, []string{"CA"})
+	mustNoError(t, err)
+	if len(cities) != 1 {
+		t.Fatalf("got %d cities in CA, want 1", len(cities))
+	}
+}
+
+func TestResetDatabaseClearsExternalOnlyWhenAsked(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "test.db"))
+	mustNoError(t, err)
+	defer db.Close()
+
+	mustNoError(t, db.AddCountries([]Country{{Country: "United States", CountryShort: "US"}}, false))
+	mustNoError(t, db.AddCountries([]Country{{Country: "Canada", CountryShort: "CA"}}, true))
+	mustNoError(t, db.AddQueries([]string{"plumber"}, true))
+	mustNoError(t, db.SaveNavSession(NavSession{Format: string(NavFormatCity), CountryShort: "US"}))
+
+	count := func(table string) int {
+		t.Helper()
+		var n int
+		mustNoError(t, db.db.QueryRow(`SELECT COUNT(*) FROM `+table).Scan(&n))
+		return n
+	}
+
+	mustNoError(t, db.ResetDatabase())
+	if got := count("countries"); got != 2 {
+		t.Fatalf("%d countries after a default reset, want 2", got)
+	}
+	if got := count("queries"); got != 1 {
+		t.Fatalf("%d queries after a default reset, want 1", got)
+	}
+	if got := count("nav_sessions"); got != 0 {
+		t.Fatalf("%d sessions after a default reset, want 0", got)
+	}
+
+	mustNoError(t, db.ResetDatabase(ResetOptions{ClearSessions: true, ClearExternal: true}))
+	if got := count("countries"); got != 1 {
+		t.Fatalf("%d countries after clearing external data, want 1", got)
+	}
+	if got := count("queries"); got != 0 {
+		t.Fatalf("%d queries after clearing external data, want 0", got)
+	}
+}
+
+func TestAddQueriesDeduplicatesNormalizedText(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "test.db"))
+	mustNoError(t, err)
+	defer db.Close()
+
+	mustNoError(t, db.AddQueries([]string{"Plumber", "plumber"}, false))
+	mustNoError(t, db.AddQueries([]string{" plumber ", "PLUMBER  near me", "plumber near me"}, true))
+
+	queries, err := db.GetQueries()
+	mustNoError(t, err)
+	var got []string
+	for _, q := range queries {
+		got = append(got, q.Query)
+	}
+	if want := []string{"Plumber", "PLUMBER  near me"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("queries = %q, want %q", got, want)
+	}
+}
+
+func TestAddQueriesCaseSensitive(t *testing.T) {
+	sm := newTestStateManager(t)
+	mustNoError(t, sm.Init(InitOptions{Format: NavFormatQuery, TargetCountry: "US", CaseSensitiveQueries: true}))
+	mustNoError(t, sm.AddSearchQueries([]string{"Plumber", " Plumber ", "PLUMBER", "plumber"}))
+
+	queries, err := sm.db.GetQueries()
+	mustNoError(t, err)
+	var got []string
+	for _, q := range queries {
+		got = append(got, q.Query)
+	}
+	if want := []string{"plumber", "Plumber", "PLUMBER"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("queries = %q, want %q", got, want)
+	}
+}
+
+func TestStateCountyRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	// A database from before states had a county column
+	legacy, err := sql.Open("sqlite3", path)
+	mustNoError(t, err)
+	_, err = legacy.Exec(`
+		CREATE TABLE countries (
+			countryShort TEXT PRIMARY KEY,
+			country TEXT NOT NULL,
+			used BOOLEAN NOT NULL DEFAULT 0,
+			external BOOLEAN NOT NULL DEFAULT 0,
+			UNIQUE(country, countryShort)
+		);
+		CREATE TABLE states (
+			stateShort TEXT NOT NULL,
+			state TEXT NOT NULL,
+			countryShort TEXT NOT NULL,
+			used BOOLEAN NOT NULL DEFAULT 0,
+			external BOOLEAN NOT NULL DEFAULT 0,
+			PRIMARY KEY (stateShort, countryShort),
+			FOREIGN KEY (countryShort) REFERENCES countries(countryShort) ON DELETE CASCADE,
+			UNIQUE(state, stateShort, countryShort)
+		);
+		INSERT INTO countries (countryShort, country) VALUES ('IE', 'Ireland');
+		INSERT INTO states (stateShort, state, countryShort) VALUES ('L', 'Leinster', 'IE');
+	`)
+	mustNoError(t, err)
+	mustNoError(t, legacy.Close())
+
+	sm, err := NewStateManager(path)
+	mustNoError(t, err)
+	defer sm.Close()
+	mustNoError(t, sm.Init(InitOptions{Format: NavFormatState, TargetCountry: "all"}))
+
+	county := "Dublin"
+	mustNoError(t, sm.AddStates([]struct {
+		State        string  `json:"state"`
+		StateShort   string  `json:"stateShort"`
+		County       *string `json:"county,omitempty"`
+		CountryShort string  `json:"countryShort"`
+	}{{State: "Dublin City", StateShort: "D", County: &county, CountryShort: "IE"}}))
+	if sm.navTotal != 2 {
+		t.Fatalf("navTotal = %d after adding a state, want 2", sm.navTotal)
+	}
+
+	states, err := sm.db.GetStates([]string{"IE"})
+	mustNoError(t, err)
+	got := make(map[string]*string)
+	for _, s := range states {
+		got[s.StateShort] = s.County
+	}
+	if len(got) != 2 || got["L"] != nil || got["D"] == nil || *got["D"] != county {
+		t.Fatalf("GetStates() = %+v, want Leinster without a county and Dublin City in Dublin", states)
+	}
+
+	state, err := sm.db.GetState("d", "ie")
+	mustNoError(t, err)
+	if state == nil || state.County == nil || *state.County != county {
+		t.Fatalf("GetState(d, ie) = %+v, want county %q", state, county)
+	}
+}
+
+func TestCountsHonorSourceFilter(t *testing.T) {
+	db, err := NewDB(seedTestDatabase(t))
+	mustNoError(t, err)
+	defer db.Close()
+
+	county, zipState := "Washoe County", "NV"
+	mustNoError(t, db.AddStates([]State{{State: "Nevada", StateShort: "NV", CountryShort: "US"}}, true))
+	mustNoError(t, db.AddCities([]City{{City: "Reno", StateShort: "NV", CountryShort: "US", County: &county}}, true))
+	mustNoError(t, db.AddZips([]Zip{{Zip: "89501", CountryShort: "US", StateShort: &zipState}}, true))
+
+	for _, test := range []struct {
+		filter                         SourceFilter
+		zips, states, withCounty, none map[string]int
+	}{
+		{SourceFilterAll, map[string]int{"US": 2}, map[string]int{"US": 3, "CA": 1}, map[string]int{"US": 2, "CA": 0}, map[string]int{"US": 1, "CA": 1}},
+		{SourceFilterBuiltin, map[string]int{"US": 1}, map[string]int{"US": 2, "CA": 1}, map[string]int{"US": 1, "CA": 0}, map[string]int{"US": 1, "CA": 1}},
+		{SourceFilterExternal, map[string]int{"US": 1}, map[string]int{"US": 1}, map[string]int{"US": 1}, map[string]int{"US": 0}},
+	} {
+		db.SetSourceFilter(test.filter)
+
+		zips, err := db.CountZipsByCountry()
+		mustNoError(t, err)
+		if !reflect.DeepEqual(zips, test.zips) {
+			t.Errorf("%s: CountZipsByCountry() = %v, want %v", test.filter, zips, test.zips)
+		}
+		states, err := db.CountStatesByCountry()
+		mustNoError(t, err)
+		if !reflect.DeepEqual(states, test.states) {
+			t.Errorf("%s: CountStatesByCountry() = %v, want %v", test.filter, states, test.states)
+		}
+		withCounty, withoutCounty, err := db.CountCitiesByCounty()
+		mustNoError(t, err)
+		if !reflect.DeepEqual(withCounty, test.withCounty) || !reflect.DeepEqual(withoutCounty, test.none) {
+			t.Errorf("%s: CountCitiesByCounty() = %v, %v, want %v, %v", test.filter, withCounty, withoutCounty, test.withCounty, test.none)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package navii
+
+import (
+	"errors"
+	"net/http"
+)
+
+var (
+	// ErrCountryNotFound is returned when a country code is unknown or has no data
+	ErrCountryNotFound = errors.New("country not found")
+
+	// ErrUnknownFormat is returned by Init for a format that is not supported
+	ErrUnknownFormat = errors.New("unknown navigation format")
+
+	// ErrNoData is returned by Init when the database holds no countries at all
+	ErrNoData = errors.New("no location data")
+
+	// ErrSessionMismatch is returned by Init when the session being resumed is
+	// no longer part of the navigation order and its position is unknown
+	ErrSessionMismatch = errors.New("session does not match the navigation order")
+
+	// ErrCorruptDatabase is returned when opening a database file that SQLite
+	// reports as not a database or malformed
+	ErrCorruptDatabase = errors.New("database file is corrupt")
+)
+
+// APIError is an error shaped for a JSON response body
+type APIError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// HTTPStatus maps an error returned by this package to an HTTP status code.
+// Errors that are not one of the sentinels, such as database failures, map
+// to 500; a nil error maps to 200.
+func HTTPStatus(err error) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, ErrCountryNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrUnknownFormat):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrNoData), errors.Is(err, ErrSessionMismatch):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// ToAPIError converts an error into an APIError with the matching status code
+func ToAPIError(err error) APIError {
+	if err == nil {
+		return APIError{Code: http.StatusOK}
+	}
+	return APIError{Code: HTTPStatus(err), Message: err.Error()}
+}
@@ -1,32 +1,144 @@
 package navii
 
 import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
+	"strings"
+	"sync"
 )
 
+// LocationData holds the geographical data loaded from location_data.json.
+// CityDetails is only populated for extended (version 1+) files.
 type LocationData struct {
-	CityData map[string]map[string][]string `json:"cityData"`
-	ZipData  map[string][]string            `json:"zipData"`
+	Version     int                                `json:"version,omitempty"`
+	SchemaHash  string                             `json:"schemaHash,omitempty"` // LocationSchemaHash of the writer
+	CityData    map[string]map[string][]string     `json:"cityData"`
+	ZipData     map[string][]string                `json:"zipData"`
+	ZipStates   map[string]map[string]string       `json:"zipStates,omitempty"` // country -> zip -> stateShort
+	Countries   []CountryData                      `json:"countries,omitempty"` // Country metadata from the download
+	CityDetails map[string]map[string][]CityDetail `json:"-"`
 }
 
-// cachedLocationData holds the loaded data to avoid repeated file reads
-var cachedLocationData *LocationData
-var dataFilePath string
+// CityDetail is a city entry in the extended location data schema
+type CityDetail struct {
+	Name      string   `json:"name"`
+	County    *string  `json:"county,omitempty"`
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+	Timezone  *string  `json:"timezone,omitempty"`
+}
+
+// LocationDataVersionExtended is the first schema version whose city entries
+// are objects carrying county and coordinates instead of plain names
+const LocationDataVersionExtended = 1
+
+// extendedLocationData mirrors the on-disk layout of extended data files
+type extendedLocationData struct {
+	Version    int                                `json:"version"`
+	SchemaHash string                             `json:"schemaHash,omitempty"`
+	CityData   map[string]map[string][]CityDetail `json:"cityData"`
+	ZipData    map[string][]string                `json:"zipData"`
+	ZipStates  map[string]map[string]string       `json:"zipStates,omitempty"`
+	Countries  []CountryData                      `json:"countries,omitempty"`
+}
+
+// locationKeyFormat describes how the data file's maps are keyed. Any change
+// to the layout must be reflected here so LocationSchemaHash changes with it.
+const locationKeyFormat = "cityData:ISO2#CountryName/StateCode##StateName;zipData:ISO2"
+
+// LocationSchemaHash identifies the key layout written by this version. Data
+// files carrying a different hash are treated as stale and downloaded again.
+var LocationSchemaHash = func() string {
+	sum := sha256.Sum256([]byte(locationKeyFormat))
+	return hex.EncodeToString(sum[:8])
+}()
+
+var (
+	countryKeyPattern = regexp.MustCompile(`^[A-Z]{2}#.+`)
+	stateKeyPattern   = regexp.MustCompile(`^[^#]+##`)
+	zipKeyPattern     = regexp.MustCompile(`^[A-Z]{2}$`)
+)
+
+// hasExpectedLayout reports whether the data matches locationKeyFormat, both
+// by its recorded schema hash (when present) and by the shape of its keys
+func hasExpectedLayout(data *LocationData) bool {
+	if data.SchemaHash != "" && data.SchemaHash != LocationSchemaHash {
+		return false
+	}
+
+	for countryKey, states := range data.CityData {
+		if !countryKeyPattern.MatchString(countryKey) {
+			return false
+		}
+		for stateKey := range states {
+			if !stateKeyPattern.MatchString(stateKey) {
+				return false
+			}
+		}
+	}
+	for countryCode := range data.ZipData {
+		if !zipKeyPattern.MatchString(countryCode) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// cachedLocationData holds the loaded data to avoid repeated file reads.
+// locationDataOnce makes concurrent first callers share a single load; it is
+// replaced whenever the path changes or a load fails so the next call retries.
+var (
+	locationDataMu     sync.Mutex
+	locationDataOnce   = &sync.Once{}
+	cachedLocationData *LocationData
+	dataFilePath       string
+	dataFS             fs.FS
+)
 
 // SetDataFilePath sets the absolute path to the location data JSON file
 func SetDataFilePath(absolutePath string) {
+	locationDataMu.Lock()
+	defer locationDataMu.Unlock()
+
 	dataFilePath = absolutePath
+	dataFS = nil
 	// Clear cache when path changes
 	cachedLocationData = nil
+	locationDataOnce = &sync.Once{}
+}
+
+// SetDataFS makes GetLocationData read the data file at path within fsys, such
+// as an embed.FS, instead of the OS filesystem. SetDataFilePath switches back.
+func SetDataFS(fsys fs.FS, path string) {
+	locationDataMu.Lock()
+	defer locationDataMu.Unlock()
+
+	dataFilePath = path
+	dataFS = fsys
+	cachedLocationData = nil
+	locationDataOnce = &sync.Once{}
 }
 
 // GetDataFilePath returns the current data file path
 func GetDataFilePath() string {
-	if dataFilePath != "" {
-		return dataFilePath
+	locationDataMu.Lock()
+	path := dataFilePath
+	locationDataMu.Unlock()
+
+	if path != "" {
+		return path
 	}
 	// Default fallback: location_data.json in the same directory as this Go file
 	return getDefaultDataFilePath()
@@ -44,16 +156,35 @@ func getDefaultDataFilePath() string {
 // GetLocationData returns the populated location data from JSON file if available,
 // otherwise returns empty location data structure
 func GetLocationData() *LocationData {
+	locationDataMu.Lock()
+	once := locationDataOnce
+	locationDataMu.Unlock()
+
+	// Only one caller loads the file; the rest wait for it
+	once.Do(func() {
+		data, err := loadLocationDataFromJSON()
+		if err != nil {
+			return
+		}
+
+		locationDataMu.Lock()
+		if locationDataOnce == once {
+			cachedLocationData = data
+		}
+		locationDataMu.Unlock()
+	})
+
+	locationDataMu.Lock()
+	defer locationDataMu.Unlock()
+
 	// Return cached data if already loaded
 	if cachedLocationData != nil {
 		return cachedLocationData
 	}
 
-	// Try to load data from JSON file
-	data, err := loadLocationDataFromJSON()
-	if err == nil {
-		cachedLocationData = data
-		return cachedLocationData
+	// Let a later call retry, e.g. after the data file has been downloaded
+	if locationDataOnce == once {
+		locationDataOnce = &sync.Once{}
 	}
 
 	// Return empty structure if no data file exists or loading failed
@@ -68,8 +199,30 @@ func GetLocationDataFromPath(absolutePath string) (*LocationData, error) {
 	return loadLocationDataFromPath(absolutePath)
 }
 
+// GetLocationDataFromFS loads location data from a file within fsys
+func GetLocationDataFromFS(fsys fs.FS, path string) (*LocationData, error) {
+	file, err := fsys.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return decodeLocationData(file)
+}
+
 // loadLocationDataFromJSON loads location data from the configured JSON file path
 func loadLocationDataFromJSON() (*LocationData, error) {
+	locationDataMu.Lock()
+	fsys, fsPath := dataFS, dataFilePath
+	locationDataMu.Unlock()
+
+	if fsys != nil {
+		if fsPath == "" {
+			fsPath = "location_data.json"
+		}
+		return GetLocationDataFromFS(fsys, fsPath)
+	}
+
 	jsonPath := GetDataFilePath()
 	return loadLocationDataFromPath(jsonPath)
 }
@@ -82,19 +235,237 @@ func loadLocationDataFromPath(filePath string) (*LocationData, error) {
 		return nil, err
 	}
 
-	// Read the JSON file
-	data, err := os.ReadFile(absPath)
+	file, err := os.Open(absPath)
 	if err != nil {
 		return nil, err
 	}
+	defer file.Close()
+
+	return decodeLocationData(file)
+}
+
+// cityEntry is a city in either schema: a plain name in the original format
+// or a CityDetail object in the extended one
+type cityEntry CityDetail
+
+func (c *cityEntry) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &c.Name)
+	}
+	return json.Unmarshal(data, (*CityDetail)(c))
+}
+
+// decodeLocationData parses location data as a stream, decoding one state's
+// cities or one country's postal codes at a time so that a large file is
+// never held in memory as a whole. The schema follows the top-level "version"
+// field; city details are only kept for extended files.
+func decodeLocationData(r io.Reader) (*LocationData, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+
+	locationData := &LocationData{}
+	versionSeen := false
+	var details map[string]map[string][]CityDetail
+
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
 
-	// Parse JSON data
-	var locationData LocationData
-	if err := json.Unmarshal(data, &locationData); err != nil {
+		switch key {
+		case "version":
+			if err := dec.Decode(&locationData.Version); err != nil {
+				return nil, err
+			}
+			versionSeen = true
+		case "schemaHash":
+			if err := dec.Decode(&locationData.SchemaHash); err != nil {
+				return nil, err
+			}
+		case "countries":
+			if err := dec.Decode(&locationData.Countries); err != nil {
+				return nil, err
+			}
+		case "cityData":
+			// The version normally comes first; if not, details are kept until it is known
+			keepDetails := !versionSeen || locationData.Version >= LocationDataVersionExtended
+			locationData.CityData = make(map[string]map[string][]string)
+			if keepDetails {
+				details = make(map[string]map[string][]CityDetail)
+			}
+			err := decodeObject(dec, func(countryKey string) error {
+				states := make(map[string][]string)
+				locationData.CityData[countryKey] = states
+				if keepDetails {
+					details[countryKey] = make(map[string][]CityDetail)
+				}
+				return decodeObject(dec, func(stateKey string) error {
+					var entries []cityEntry
+					if err := dec.Decode(&entries); err != nil {
+						return err
+					}
+					names := make([]string, len(entries))
+					for i, entry := range entries {
+						names[i] = entry.Name
+					}
+					states[stateKey] = names
+					if keepDetails {
+						stateDetails := make([]CityDetail, len(entries))
+						for i, entry := range entries {
+							stateDetails[i] = CityDetail(entry)
+						}
+						details[countryKey][stateKey] = stateDetails
+					}
+					return nil
+				})
+			})
+			if err != nil {
+				return nil, err
+			}
+		case "zipData":
+			locationData.ZipData = make(map[string][]string)
+			err := decodeObject(dec, func(countryCode string) error {
+				var zips []string
+				if err := dec.Decode(&zips); err != nil {
+					return err
+				}
+				locationData.ZipData[countryCode] = zips
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		case "zipStates":
+			locationData.ZipStates = make(map[string]map[string]string)
+			err := decodeObject(dec, func(countryCode string) error {
+				var states map[string]string
+				if err := dec.Decode(&states); err != nil {
+					return err
+				}
+				locationData.ZipStates[countryCode] = states
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		default:
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
 		return nil, err
 	}
 
-	return &locationData, nil
+	if locationData.Version >= LocationDataVersionExtended {
+		locationData.CityDetails = details
+		if locationData.CityData == nil {
+			locationData.CityData = make(map[string]map[string][]string)
+		}
+		if locationData.ZipData == nil {
+			locationData.ZipData = make(map[string][]string)
+		}
+	}
+
+	return locationData, nil
+}
+
+// decodeObject walks a JSON object, or null, calling fn with each key while
+// the decoder is positioned at that key's value
+func decodeObject(dec *json.Decoder, fn func(key string) error) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		return nil
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '{' {
+		return fmt.Errorf("expected JSON object, got %v", token)
+	}
+
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if err := fn(token.(string)); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+// expectDelim reads the next token and checks that it is the given delimiter
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != want {
+		return fmt.Errorf("expected %v in location data, got %v", want, token)
+	}
+	return nil
+}
+
+// LocationDataHash returns the hex SHA-256 of the configured data file, read
+// from the data file system when one is set, or "" when there is no file
+func LocationDataHash() (string, error) {
+	locationDataMu.Lock()
+	fsys, fsPath := dataFS, dataFilePath
+	locationDataMu.Unlock()
+
+	if fsys != nil {
+		if fsPath == "" {
+			fsPath = "location_data.json"
+		}
+		file, err := fsys.Open(fsPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+		return hashReader(file)
+	}
+	return hashFile(GetDataFilePath())
+}
+
+// hashFile returns the hex SHA-256 of a file, or "" when it does not exist
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return hashReader(file)
+}
+
+func hashReader(r io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// reloadLocationData drops the cached location data so that the next
+// GetLocationData reads the data file again
+func reloadLocationData() {
+	locationDataMu.Lock()
+	defer locationDataMu.Unlock()
+
+	cachedLocationData = nil
+	locationDataOnce = &sync.Once{}
 }
 
 // IsDataPopulated checks if geographical data has been downloaded and populated
@@ -128,27 +499,161 @@ func GetPostalCodesForCountry(countryCode string) []string {
 	return data.ZipData[countryCode]
 }
 
-// GetAvailableCountries returns a list of available country codes
+// GetAvailableCountries returns the available country codes, sorted and without duplicates
 func GetAvailableCountries() []string {
 	data := GetLocationData()
 	countries := make([]string, 0, len(data.CityData))
+	seen := make(map[string]bool, len(data.CityData))
 
 	for countryKey := range data.CityData {
 		if len(countryKey) >= 2 {
 			countryCode := countryKey[:2]
-			// Check if already added
-			found := false
-			for _, existing := range countries {
-				if existing == countryCode {
-					found = true
-					break
-				}
-			}
-			if !found {
+			if !seen[countryCode] {
+				seen[countryCode] = true
 				countries = append(countries, countryCode)
 			}
 		}
 	}
 
+	// Map iteration order is random; sort for deterministic output
+	sort.Strings(countries)
 	return countries
 }
+
+// LocationDiff lists what changed between two LocationData snapshots, per
+// level. Countries are matched by ISO2 code, states by code within their
+// country and cities by name within their state; renames are not reported.
+type LocationDiff struct {
+	AddedCountries   []Country `json:"addedCountries"`
+	RemovedCountries []Country `json:"removedCountries"`
+	AddedStates      []State   `json:"addedStates"`
+	RemovedStates    []State   `json:"removedStates"`
+	AddedCities      []City    `json:"addedCities"`
+	RemovedCities    []City    `json:"removedCities"`
+}
+
+// Empty reports whether the two snapshots hold the same locations
+func (d *LocationDiff) Empty() bool {
+	return len(d.AddedCountries) == 0 && len(d.RemovedCountries) == 0 &&
+		len(d.AddedStates) == 0 && len(d.RemovedStates) == 0 &&
+		len(d.AddedCities) == 0 && len(d.RemovedCities) == 0
+}
+
+// String summarizes the diff as counts, e.g.
+// "countries +1/-0, states +3/-1, cities +120/-4"
+func (d *LocationDiff) String() string {
+	return fmt.Sprintf("countries +%d/-%d, states +%d/-%d, cities +%d/-%d",
+		len(d.AddedCountries), len(d.RemovedCountries),
+		len(d.AddedStates), len(d.RemovedStates),
+		len(d.AddedCities), len(d.RemovedCities))
+}
+
+// locationIndex is the country -> state -> city tree of a LocationData,
+// keyed by codes and city names
+type locationIndex map[string]*indexedCountry
+
+type indexedCountry struct {
+	name   string
+	states map[string]*indexedState
+}
+
+type indexedState struct {
+	name   string
+	cities map[string]bool
+}
+
+// indexLocations builds the tree of a LocationData. Country keys listed under
+// more than one name are merged, keeping the first name in key order.
+func indexLocations(data *LocationData) locationIndex {
+	index := make(locationIndex)
+	if data == nil {
+		return index
+	}
+
+	countryKeys := make([]string, 0, len(data.CityData))
+	for key := range data.CityData {
+		countryKeys = append(countryKeys, key)
+	}
+	sort.Strings(countryKeys)
+
+	for _, countryKey := range countryKeys {
+		countryShort, countryName, ok := strings.Cut(countryKey, "#")
+		if !ok {
+			continue
+		}
+		country, ok := index[countryShort]
+		if !ok {
+			country = &indexedCountry{name: countryName, states: make(map[string]*indexedState)}
+			index[countryShort] = country
+		}
+
+		for stateKey, cities := range data.CityData[countryKey] {
+			stateShort, stateName, ok := strings.Cut(stateKey, "##")
+			if !ok {
+				continue
+			}
+			state, ok := country.states[stateShort]
+			if !ok {
+				state = &indexedState{name: stateName, cities: make(map[string]bool)}
+				country.states[stateShort] = state
+			}
+			for _, city := range cities {
+				state.cities[city] = true
+			}
+		}
+	}
+	return index
+}
+
+// DiffLocationData compares two LocationData snapshots, such as the current
+// data file and a fresh download, and reports the countries, states and cities
+// added and removed. Results are sorted by country, state and city. A nil
+// snapshot counts as empty.
+func DiffLocationData(old, new *LocationData) *LocationDiff {
+	diff := &LocationDiff{}
+	oldIndex, newIndex := indexLocations(old), indexLocations(new)
+
+	diff.AddedCountries, diff.AddedStates, diff.AddedCities = locationsOnlyIn(newIndex, oldIndex)
+	diff.RemovedCountries, diff.RemovedStates, diff.RemovedCities = locationsOnlyIn(oldIndex, newIndex)
+	return diff
+}
+
+// locationsOnlyIn returns the locations of a that are missing from b. The
+// states and cities of a missing country are listed too.
+func locationsOnlyIn(a, b locationIndex) (countries []Country, states []State, cities []City) {
+	for _, countryShort := range sortedKeys(a) {
+		country := a[countryShort]
+		otherCountry := b[countryShort]
+		if otherCountry == nil {
+			countries = append(countries, Country{Country: country.name, CountryShort: countryShort})
+		}
+
+		for _, stateShort := range sortedKeys(country.states) {
+			state := country.states[stateShort]
+			var otherState *indexedState
+			if otherCountry != nil {
+				otherState = otherCountry.states[stateShort]
+			}
+			if otherState == nil {
+				states = append(states, State{State: state.name, StateShort: stateShort, CountryShort: countryShort})
+			}
+
+			for _, city := range sortedKeys(state.cities) {
+				if otherState == nil || !otherState.cities[city] {
+					cities = append(cities, City{City: city, StateShort: stateShort, CountryShort: countryShort})
+				}
+			}
+		}
+	}
+	return countries, states, cities
+}
+
+// sortedKeys returns the keys of a string-keyed map in order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
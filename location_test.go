@@ -0,0 +1,264 @@
+package navii
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+)
+
+// writeTestLocationData writes a location data file and points the package at it
+func writeTestLocationData(t *testing.T, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "location_data.json")
+	mustNoError(t, os.WriteFile(path, []byte(contents), 0644))
+	SetDataFilePath(path)
+	return path
+}
+
+func TestGetAvailableCountriesSortedAndUnique(t *testing.T) {
+	writeTestLocationData(t, `{
+		"cityData": {
+			"US#United States": {"CA##California": ["Los Angeles"]},
+			"GB#United Kingdom": {"ENG##England": ["London"]},
+			"US#USA": {"TX##Texas": ["Austin"]},
+			"CA#Canada": {"ON##Ontario": ["Toronto"]}
+		},
+		"zipData": {}
+	}`)
+
+	got := GetAvailableCountries()
+	if want := []string{"CA", "GB", "US"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("GetAvailableCountries() = %v, want %v", got, want)
+	}
+}
+
+// countingFS counts the files opened from an fs.FS
+type countingFS struct {
+	fs.FS
+	opens atomic.Int32
+}
+
+func (c *countingFS) Open(name string) (fs.File, error) {
+	c.opens.Add(1)
+	return c.FS.Open(name)
+}
+
+const testLocationJSON = `{"cityData": {"US#United States": {"CA##California": ["Los Angeles"]}}, "zipData": {"US": ["90001"]}}`
+
+// loadConcurrently calls GetLocationData from n goroutines released together
+func loadConcurrently(n int) {
+	var start, done sync.WaitGroup
+	start.Add(1)
+	done.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer done.Done()
+			start.Wait()
+			GetLocationData()
+		}()
+	}
+	start.Done()
+	done.Wait()
+}
+
+func TestGetLocationDataLoadsOnceForConcurrentCallers(t *testing.T) {
+	t.Cleanup(func() { SetDataFilePath("") })
+	fsys := &countingFS{FS: fstest.MapFS{"data.json": {Data: []byte(testLocationJSON)}}}
+	SetDataFS(fsys, "data.json")
+
+	loadConcurrently(100)
+	if got := fsys.opens.Load(); got != 1 {
+		t.Fatalf("data file opened %d times by 100 first callers, want 1", got)
+	}
+	if data := GetLocationData(); len(data.CityData) != 1 {
+		t.Fatalf("loaded %d countries, want 1", len(data.CityData))
+	}
+}
+
+func TestGetLocationDataRetriesAfterFailedLoad(t *testing.T) {
+	t.Cleanup(func() { SetDataFilePath("") })
+	files := fstest.MapFS{}
+	fsys := &countingFS{FS: files}
+	SetDataFS(fsys, "data.json")
+
+	if data := GetLocationData(); len(data.CityData) != 0 {
+		t.Fatalf("loaded %d countries from a missing file, want 0", len(data.CityData))
+	}
+
+	// The file appears later, as after a download
+	files["data.json"] = &fstest.MapFile{Data: []byte(testLocationJSON)}
+	if data := GetLocationData(); len(data.CityData) != 1 {
+		t.Fatalf("loaded %d countries once the file exists, want 1", len(data.CityData))
+	}
+	GetLocationData()
+	if got := fsys.opens.Load(); got != 2 {
+		t.Fatalf("data file opened %d times, want 2: one failure and one load", got)
+	}
+}
+
+func BenchmarkGetLocationDataConcurrentFirstCall(b *testing.B) {
+	b.Cleanup(func() { SetDataFilePath("") })
+	var opens int32
+	for i := 0; i < b.N; i++ {
+		fsys := &countingFS{FS: fstest.MapFS{"data.json": {Data: []byte(testLocationJSON)}}}
+		SetDataFS(fsys, "data.json")
+		loadConcurrently(100)
+		opens += fsys.opens.Load()
+	}
+	b.ReportMetric(float64(opens)/float64(b.N), "parses/op")
+}
+
+// decodeJSON decodes v as location data after encoding it as JSON
+func decodeJSON(t *testing.T, v interface{}) *LocationData {
+	t.Helper()
+
+	encoded, err := json.Marshal(v)
+	mustNoError(t, err)
+	data, err := decodeLocationData(bytes.NewReader(encoded))
+	mustNoError(t, err)
+	return data
+}
+
+func TestDecodeLocationDataRoundTripsOriginalSchema(t *testing.T) {
+	want := &LocationData{
+		SchemaHash: LocationSchemaHash,
+		CityData: map[string]map[string][]string{
+			"US#United States": {"CA##California": {"Los Angeles", "San Diego"}, "TX##Texas": {"Austin"}},
+			"CA#Canada":        {"ON##Ontario": {"Toronto"}},
+		},
+		ZipData:   map[string][]string{"US": {"90001", "73301"}},
+		ZipStates: map[string]map[string]string{"US": {"90001": "CA", "73301": "TX"}},
+		Countries: []CountryData{{Name: "United States", ISO2: "US", ISO3: "USA"}},
+	}
+
+	if got := decodeJSON(t, want); !reflect.DeepEqual(got, want) {
+		t.Fatalf("decoded %+v, want %+v", got, want)
+	}
+}
+
+func TestDecodeLocationDataRoundTripsExtendedSchema(t *testing.T) {
+	county, timezone := "Los Angeles County", "America/Los_Angeles"
+	latitude, longitude := 34.05, -118.24
+	details := map[string]map[string][]CityDetail{
+		"US#United States": {
+			"CA##California": {{Name: "Los Angeles", County: &county, Latitude: &latitude, Longitude: &longitude, Timezone: &timezone}},
+			"TX##Texas":      {{Name: "Austin"}},
+		},
+	}
+
+	got := decodeJSON(t, extendedLocationData{
+		Version:    LocationDataVersionExtended,
+		SchemaHash: LocationSchemaHash,
+		CityData:   details,
+		ZipData:    map[string][]string{"US": {"90001"}},
+	})
+	want := &LocationData{
+		Version:     LocationDataVersionExtended,
+		SchemaHash:  LocationSchemaHash,
+		CityData:    map[string]map[string][]string{"US#United States": {"CA##California": {"Los Angeles"}, "TX##Texas": {"Austin"}}},
+		ZipData:     map[string][]string{"US": {"90001"}},
+		CityDetails: details,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("decoded %+v, want %+v", got, want)
+	}
+}
+
+func TestDecodeLocationDataVersionAfterCityData(t *testing.T) {
+	extended, err := decodeLocationData(strings.NewReader(`{
+		"cityData": {"US#United States": {"CA##California": [{"name": "Los Angeles", "county": "Los Angeles County"}]}},
+		"zipData": {},
+		"version": 1
+	}`))
+	mustNoError(t, err)
+	if names := extended.CityData["US#United States"]["CA##California"]; !reflect.DeepEqual(names, []string{"Los Angeles"}) {
+		t.Fatalf("city names = %v, want [Los Angeles]", names)
+	}
+	cities := extended.CityDetails["US#United States"]["CA##California"]
+	if len(cities) != 1 || cities[0].County == nil || *cities[0].County != "Los Angeles County" {
+		t.Fatalf("city details = %+v, want Los Angeles with its county", cities)
+	}
+
+	// Details read ahead of a version 0 marker are dropped again
+	original, err := decodeLocationData(strings.NewReader(`{
+		"cityData": {"US#United States": {"CA##California": ["Los Angeles"]}},
+		"version": 0
+	}`))
+	mustNoError(t, err)
+	if original.CityDetails != nil {
+		t.Fatalf("CityDetails = %+v for a version 0 file, want nil", original.CityDetails)
+	}
+}
+
+func TestDecodeLocationDataNullSections(t *testing.T) {
+	for _, version := range []int{0, LocationDataVersionExtended} {
+		data, err := decodeLocationData(strings.NewReader(fmt.Sprintf(`{
+			"version": %d,
+			"cityData": {"US#United States": null, "CA#Canada": {"ON##Ontario": null}},
+			"zipData": null,
+			"zipStates": null,
+			"countries": null
+		}`, version)))
+		mustNoError(t, err)
+
+		if states := data.CityData["US#United States"]; states == nil || len(states) != 0 {
+			t.Errorf("version %d: states of a null country = %v, want an empty map", version, states)
+		}
+		if cities, ok := data.CityData["CA#Canada"]["ON##Ontario"]; !ok || len(cities) != 0 {
+			t.Errorf("version %d: cities of a null state = %v, want an empty list", version, cities)
+		}
+		if data.ZipData == nil || len(data.ZipData) != 0 || len(data.ZipStates) != 0 || data.Countries != nil {
+			t.Errorf("version %d: decoded zips %v, zip states %v and countries %v, want empty", version, data.ZipData, data.ZipStates, data.Countries)
+		}
+	}
+}
+
+func BenchmarkDecodeLocationData(b *testing.B) {
+	county := "County"
+	data := extendedLocationData{
+		Version:  LocationDataVersionExtended,
+		CityData: make(map[string]map[string][]CityDetail),
+		ZipData:  make(map[string][]string),
+	}
+	for c := 0; c < 50; c++ {
+		code := fmt.Sprintf("%c%c", 'A'+c/26, 'A'+c%26)
+		states := make(map[string][]CityDetail)
+		for s := 0; s < 20; s++ {
+			cities := make([]CityDetail, 200)
+			for i := range cities {
+				latitude, longitude := float64(i), float64(-i)
+				cities[i] = CityDetail{Name: fmt.Sprintf("City %d", i), County: &county, Latitude: &latitude, Longitude: &longitude}
+			}
+			states[fmt.Sprintf("S%d##State %d", s, s)] = cities
+		}
+		data.CityData[code+"#Country "+code] = states
+		zips := make([]string, 2000)
+		for i := range zips {
+			zips[i] = fmt.Sprintf("%05d", i)
+		}
+		data.ZipData[code] = zips
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(encoded)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := decodeLocationData(bytes.NewReader(encoded)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
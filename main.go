@@ -1,4 +1,4 @@
-// Package yuniq provides geographical navigation and state management functionality
+// Package navii provides geographical navigation and state management functionality
 package navii
 
 import (
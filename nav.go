@@ -0,0 +1,204 @@
+package navii
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// PageInfo unpacks the Page field. ok is false when no pagination has been
+// set; completed is true when the item was marked complete, in which case
+// pageNav is zero.
+func (nr *NavResponse) PageInfo() (pageNav PageNav, completed bool, ok bool) {
+	if nr == nil {
+		return PageNav{}, false, false
+	}
+
+	switch page := nr.Page.(type) {
+	case PageNav:
+		return page, false, true
+	case *PageNav:
+		if page == nil {
+			return PageNav{}, false, false
+		}
+		return *page, false, true
+	case string:
+		if page == "completed" {
+			return PageNav{}, true, true
+		}
+	}
+
+	return PageNav{}, false, false
+}
+
+// Key identifies a nav by the fields used to match it against a saved
+// session: query, zip, city, state and country code. A nil field and an empty
+// one produce different keys.
+func (n Nav) Key() string {
+	var b strings.Builder
+	for i, field := range []*string{n.Query, n.Zip, n.City, n.State, n.CountryShort} {
+		if i > 0 {
+			b.WriteByte(0x1f)
+		}
+		if field != nil {
+			b.WriteByte('=')
+			b.WriteString(*field)
+		}
+	}
+	return b.String()
+}
+
+// URLPathOptions controls how URLPath builds a path from a nav
+type URLPathOptions struct {
+	// Levels lists the levels to join, in order. Defaults to
+	// country, state, county, city, zip, query.
+	Levels      []string
+	OmitCountry bool
+	OmitState   bool
+}
+
+// defaultURLPathLevels is the level order used when URLPathOptions.Levels is empty
+var defaultURLPathLevels = []string{"country", "state", "county", "city", "zip", "query"}
+
+// URLPath joins the populated levels of the nav into a slugified path such as
+// "/us/ca/los-angeles". Country and state use their short codes when set.
+// Levels without a value are skipped.
+func (n Nav) URLPath(opts URLPathOptions) string {
+	levels := opts.Levels
+	if len(levels) == 0 {
+		levels = defaultURLPathLevels
+	}
+
+	var segments []string
+	for _, level := range levels {
+		var value *string
+		switch level {
+		case "country":
+			if !opts.OmitCountry {
+				value = firstSet(n.CountryShort, n.Country)
+			}
+		case "state":
+			if !opts.OmitState {
+				value = firstSet(n.StateShort, n.State)
+			}
+		case "county":
+			value = n.County
+		case "city":
+			value = n.City
+		case "zip":
+			value = n.Zip
+		case "query":
+			value = n.Query
+		}
+
+		if value != nil {
+			if slug := slugify(*value); slug != "" {
+				segments = append(segments, slug)
+			}
+		}
+	}
+
+	return "/" + strings.Join(segments, "/")
+}
+
+// URLPath is Nav.URLPath for the response's nav
+func (nr *NavResponse) URLPath(opts URLPathOptions) string {
+	if nr == nil {
+		return "/"
+	}
+	return nr.Nav.URLPath(opts)
+}
+
+// firstSet returns the first non-nil, non-empty value
+func firstSet(values ...*string) *string {
+	for _, v := range values {
+		if v != nil && *v != "" {
+			return v
+		}
+	}
+	return nil
+}
+
+// slugify lowercases s and collapses every run of characters other than
+// letters and digits into a single hyphen
+func slugify(s string) string {
+	var b strings.Builder
+	pendingHyphen := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if pendingHyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			pendingHyphen = false
+			b.WriteRune(r)
+		} else {
+			pendingHyphen = true
+		}
+	}
+	return b.String()
+}
+
+// Breadcrumb is one level of a nav's hierarchy, such as {"state", "California"}
+type Breadcrumb struct {
+	Level string `json:"level"`
+	Value string `json:"value"`
+}
+
+// Breadcrumbs lists the populated levels of the nav from broadest to
+// narrowest: country, state, county, city, zip, then the query searched there.
+// Country and state prefer their short and full names respectively.
+func (n Nav) Breadcrumbs() []Breadcrumb {
+	levels := []struct {
+		level string
+		value *string
+	}{
+		{"country", firstSet(n.CountryShort, n.Country)},
+		{"state", firstSet(n.State, n.StateShort)},
+		{"county", n.County},
+		{"city", n.City},
+		{"zip", n.Zip},
+		{"query", n.Query},
+	}
+
+	var crumbs []Breadcrumb
+	for _, l := range levels {
+		if l.value != nil && *l.value != "" {
+			crumbs = append(crumbs, Breadcrumb{Level: l.level, Value: *l.value})
+		}
+	}
+	return crumbs
+}
+
+// Breadcrumbs is Nav.Breadcrumbs for the response's nav
+func (nr *NavResponse) Breadcrumbs() []Breadcrumb {
+	if nr == nil {
+		return nil
+	}
+	return nr.Nav.Breadcrumbs()
+}
+
+// String summarizes the report, e.g. "US: ok" or "VA: no states, no cities, will be skipped"
+func (p CountryPreflight) String() string {
+	if len(p.Missing) == 0 {
+		return p.CountryShort + ": ok"
+	}
+
+	parts := make([]string, len(p.Missing))
+	for i, level := range p.Missing {
+		parts[i] = "no " + pluralLevel(level)
+	}
+	return fmt.Sprintf("%s: %s, will be skipped", p.CountryShort, strings.Join(parts, ", "))
+}
+
+// pluralLevel returns the plural name of a navigation level
+func pluralLevel(level string) string {
+	switch level {
+	case "city":
+		return "cities"
+	case "county":
+		return "counties"
+	case "query":
+		return "queries"
+	}
+	return level + "s"
+}
@@ -1,12 +1,17 @@
-// Package yuniq provides geographical navigation and state management functionality
+// Package navii provides geographical navigation and state management functionality
 package navii
 
 import (
 	"archive/zip"
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -25,6 +30,7 @@ type PostalCodeFormat struct {
 type PostalCode struct {
 	CountryCode string `json:"countryCode"`
 	PostalCode  string `json:"postalCode"`
+	StateCode   string `json:"stateCode,omitempty"`
 }
 
 // CountryData represents country information from the API
@@ -47,6 +53,15 @@ type CountryData struct {
 	Longitude    string `json:"longitude"`
 	Emoji        string `json:"emoji"`
 	EmojiU       string `json:"emojiU"`
+
+	Timezones []CountryTimezone `json:"timezones,omitempty"`
+}
+
+// CountryTimezone is one of the IANA timezones a country spans
+type CountryTimezone struct {
+	ZoneName     string `json:"zoneName"`
+	GMTOffset    int    `json:"gmtOffset"`
+	Abbreviation string `json:"abbreviation"`
 }
 
 // CityDataFromAPI represents city information from the API
@@ -68,7 +83,39 @@ type CityDataFromAPI struct {
 type DataDownloader struct {
 	httpClient       *http.Client
 	postalCodeRegexs map[string]*regexp.Regexp
+	standardizers    map[string]PostalStandardizer
 	targetCountries  []string
+	prefixLength     int
+	allPostalCodes   bool
+	bestEffort       bool
+	cacheDir         string
+	cacheMaxAge      time.Duration
+	forceRefresh     bool
+	zipStates        bool
+	mergeExisting    bool
+	baseURL          string
+	logger           *log.Logger
+}
+
+// DefaultLocationDataURL is where countries.json and cities.json are downloaded from
+const DefaultLocationDataURL = "https://raw.githubusercontent.com/dr5hn/countries-states-cities-database/refs/heads/master/json"
+
+// PostalStandardizer rewrites a postal code into its country's canonical form
+// before validation. It receives the code trimmed and with spaces removed.
+type PostalStandardizer func(postalCode string) string
+
+// CountryDownloadError records a postal code download failure for one country
+type CountryDownloadError struct {
+	CountryCode string
+	Err         error
+}
+
+func (e *CountryDownloadError) Error() string {
+	return fmt.Sprintf("failed to download postal codes for %s: %v", e.CountryCode, e.Err)
+}
+
+func (e *CountryDownloadError) Unwrap() error {
+	return e.Err
 }
 
 // NewDataDownloader creates a new data downloader
@@ -94,55 +141,225 @@ func NewDataDownloader() *DataDownloader {
 		httpClient:       &http.Client{Timeout: 240 * time.Second},
 		postalCodeRegexs: postalCodeRegexs,
 		targetCountries:  targetCountries,
+		baseURL:          DefaultLocationDataURL,
+	}
+}
+
+// RegisterPostalFormat sets the pattern postal codes of a country must match,
+// replacing a built-in one, and adds the country to the per-country download
+// list so its postal codes are fetched too
+func (dd *DataDownloader) RegisterPostalFormat(countryCode string, pattern *regexp.Regexp) {
+	countryCode = strings.ToUpper(strings.TrimSpace(countryCode))
+	if countryCode == "" || pattern == nil {
+		return
+	}
+
+	dd.postalCodeRegexs[countryCode] = pattern
+	if !contains(dd.targetCountries, countryCode) {
+		dd.targetCountries = append(dd.targetCountries, countryCode)
+	}
+}
+
+// RegisterPostalStandardizer sets the function that standardizes postal codes
+// of a country before they are validated, replacing the built-in rules for it.
+// Countries without one keep the built-in rules; a nil fn removes a custom one.
+func (dd *DataDownloader) RegisterPostalStandardizer(countryCode string, fn PostalStandardizer) {
+	countryCode = strings.ToUpper(strings.TrimSpace(countryCode))
+	if countryCode == "" {
+		return
+	}
+
+	if fn == nil {
+		delete(dd.standardizers, countryCode)
+		return
+	}
+	if dd.standardizers == nil {
+		dd.standardizers = make(map[string]PostalStandardizer)
+	}
+	dd.standardizers[countryCode] = fn
+}
+
+// SetPostalCodePrefixLength makes the downloader store distinct postal code
+// prefixes of the given length instead of full codes (e.g. 3 for US zip3).
+// Validation still applies to the full code. Zero or less disables truncation.
+func (dd *DataDownloader) SetPostalCodePrefixLength(length int) {
+	if length < 0 {
+		length = 0
+	}
+	dd.prefixLength = length
+}
+
+// SetDownloadAllPostalCodes switches DownloadAndProcessData to the combined
+// geonames archive instead of the per-country target list
+func (dd *DataDownloader) SetDownloadAllPostalCodes(enabled bool) {
+	dd.allPostalCodes = enabled
+}
+
+// SetBestEffort makes postal code failures non-fatal: failed countries are
+// skipped, the location file is still written with whatever succeeded, and
+// the failures are returned joined together
+func (dd *DataDownloader) SetBestEffort(enabled bool) {
+	dd.bestEffort = enabled
+}
+
+// SetCacheDir stores raw downloads (JSON feeds and postal archives) in dir and
+// reuses them on later runs while younger than maxAge, so an interrupted run
+// resumes without re-fetching what already succeeded. A zero maxAge never
+// expires cached files; an empty dir disables caching.
+func (dd *DataDownloader) SetCacheDir(dir string, maxAge time.Duration) {
+	dd.cacheDir = dir
+	dd.cacheMaxAge = maxAge
+}
+
+// SetForceRefresh makes the downloader ignore cached files and fetch everything again
+func (dd *DataDownloader) SetForceRefresh(enabled bool) {
+	dd.forceRefresh = enabled
+}
+
+// SetZipStateEnrichment records the first-level admin code (the state) of
+// each postal code from the geonames feed so zip navs can carry StateShort
+func (dd *DataDownloader) SetZipStateEnrichment(enabled bool) {
+	dd.zipStates = enabled
+}
+
+// SetMergeExisting makes DownloadAndProcessData merge into the data file at
+// the output path instead of replacing it, so a dataset can be built up over
+// several runs. Country city lists are unioned rather than replaced.
+func (dd *DataDownloader) SetMergeExisting(enabled bool) {
+	dd.mergeExisting = enabled
+}
+
+// ctxCheckInterval is how many parsed rows pass between cancellation checks
+const ctxCheckInterval = 4096
+
+// SetTargetCountries replaces the countries whose postal codes are downloaded
+// one by one. Codes are upper-cased; an empty list downloads none.
+func (dd *DataDownloader) SetTargetCountries(countryCodes []string) {
+	dd.targetCountries = make([]string, 0, len(countryCodes))
+	for _, code := range countryCodes {
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if code != "" && !contains(dd.targetCountries, code) {
+			dd.targetCountries = append(dd.targetCountries, code)
+		}
+	}
+}
+
+// SetBaseURL sets where countries.json and cities.json are downloaded from, for
+// mirrors of the default source. Postal codes still come from GeoNames.
+func (dd *DataDownloader) SetBaseURL(baseURL string) {
+	if baseURL == "" {
+		baseURL = DefaultLocationDataURL
+	}
+	dd.baseURL = baseURL
+}
+
+// SetHTTPClient sets the client used for every download; nil restores the default
+func (dd *DataDownloader) SetHTTPClient(client *http.Client) {
+	if client == nil {
+		client = &http.Client{Timeout: 240 * time.Second}
+	}
+	dd.httpClient = client
+}
+
+// SetLogger sends progress and warnings to logger instead of standard output
+func (dd *DataDownloader) SetLogger(logger *log.Logger) {
+	dd.logger = logger
+}
+
+// logf prints a progress message to the logger, or to standard output
+func (dd *DataDownloader) logf(format string, args ...interface{}) {
+	if dd.logger != nil {
+		dd.logger.Printf(format, args...)
+		return
 	}
+	fmt.Printf(format, args...)
 }
 
 // DownloadAndProcessData downloads and processes all geographical data
 func (dd *DataDownloader) DownloadAndProcessData(outputPath string) error {
-	fmt.Println("Starting geographical data download...")
+	return dd.DownloadAndProcessDataContext(context.Background(), outputPath)
+}
+
+// DownloadAndProcessDataContext is DownloadAndProcessData bounded by ctx. The
+// context is passed to every HTTP request and checked while parsing, so a
+// cancelled or expired context stops the run promptly with ctx.Err() wrapped
+// in the returned error. Nothing is written to outputPath in that case.
+func (dd *DataDownloader) DownloadAndProcessDataContext(ctx context.Context, outputPath string) error {
+	dd.logf("Starting geographical data download...\n")
 
 	// Download countries and cities
-	locationData, err := dd.downloadLocationData()
+	locationData, countries, err := dd.downloadLocationData(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to download location data: %w", err)
 	}
 
-	fmt.Println("Downloading postal codes...")
-	postalCodes, err := dd.downloadPostalCodes()
+	dd.logf("Downloading postal codes...\n")
+	var postalCodes []PostalCode
+	if dd.allPostalCodes {
+		postalCodes, err = dd.DownloadAllPostalCodesContext(ctx)
+	} else {
+		postalCodes, err = dd.downloadPostalCodes(ctx)
+	}
+	var postalErr error
 	if err != nil {
-		return fmt.Errorf("failed to download postal codes: %w", err)
+		if !dd.bestEffort || ctx.Err() != nil {
+			return fmt.Errorf("failed to download postal codes: %w", err)
+		}
+		postalErr = err
 	}
 
 	// Convert postal codes to zip data format
 	zipData := make(map[string][]string)
+	var zipStates map[string]map[string]string
 	for _, pc := range postalCodes {
 		zipData[pc.CountryCode] = append(zipData[pc.CountryCode], pc.PostalCode)
+
+		if pc.StateCode != "" {
+			if zipStates == nil {
+				zipStates = make(map[string]map[string]string)
+			}
+			if zipStates[pc.CountryCode] == nil {
+				zipStates[pc.CountryCode] = make(map[string]string)
+			}
+			zipStates[pc.CountryCode][pc.PostalCode] = pc.StateCode
+		}
 	}
 
 	// Create final data structure
 	finalData := LocationData{
-		CityData: locationData,
-		ZipData:  zipData,
+		SchemaHash: LocationSchemaHash,
+		CityData:   locationData,
+		ZipData:    zipData,
+		ZipStates:  zipStates,
+		Countries:  countries,
 	}
 
 	// Write to file
-	return dd.writeLocationFile(outputPath, finalData)
+	if err := dd.writeLocationFile(outputPath, finalData); err != nil {
+		return err
+	}
+
+	if postalErr != nil {
+		return fmt.Errorf("postal code download partially failed: %w", postalErr)
+	}
+	return nil
 }
 
-// downloadLocationData downloads countries and cities data
-func (dd *DataDownloader) downloadLocationData() (map[string]map[string][]string, error) {
-	baseURL := "https://raw.githubusercontent.com/dr5hn/countries-states-cities-database/refs/heads/master/json"
+// downloadLocationData downloads countries and cities data, returning the
+// country metadata alongside the nested city map
+func (dd *DataDownloader) downloadLocationData(ctx context.Context) (map[string]map[string][]string, []CountryData, error) {
+	baseURL := strings.TrimSuffix(dd.baseURL, "/")
 
 	// Download countries
-	fmt.Println("Downloading countries...")
-	countriesData, err := dd.downloadJSON(fmt.Sprintf("%s/countries.json", baseURL))
+	dd.logf("Downloading countries...\n")
+	countriesData, err := dd.downloadJSON(ctx, fmt.Sprintf("%s/countries.json", baseURL))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	var countries []CountryData
 	if err := json.Unmarshal(countriesData, &countries); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Initialize location data structure
@@ -153,27 +370,35 @@ func (dd *DataDownloader) downloadLocationData() (map[string]map[string][]string
 	}
 
 	// Download cities
-	fmt.Println("Downloading cities...")
-	citiesData, err := dd.downloadJSON(fmt.Sprintf("%s/cities.json", baseURL))
+	dd.logf("Downloading cities...\n")
+	citiesData, err := dd.downloadJSON(ctx, fmt.Sprintf("%s/cities.json", baseURL))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	var cities []CityDataFromAPI
 	if err := json.Unmarshal(citiesData, &cities); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Process cities data
-	dd.processCities(cities, locationData)
+	if err := dd.processCities(ctx, cities, locationData); err != nil {
+		return nil, nil, err
+	}
 
-	fmt.Println("Location data download completed")
-	return locationData, nil
+	dd.logf("Location data download completed\n")
+	return locationData, countries, nil
 }
 
 // processCities processes cities and adds them to location data
-func (dd *DataDownloader) processCities(cities []CityDataFromAPI, locationData map[string]map[string][]string) {
-	for _, city := range cities {
+func (dd *DataDownloader) processCities(ctx context.Context, cities []CityDataFromAPI, locationData map[string]map[string][]string) error {
+	for i, city := range cities {
+		if i%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+
 		countryCode := strings.ToUpper(strings.TrimSpace(city.CountryCode))
 		stateCode := strings.ToUpper(city.StateCode)
 
@@ -212,29 +437,158 @@ func (dd *DataDownloader) processCities(cities []CityDataFromAPI, locationData m
 		// Add city
 		locationData[countryKey][foundStateKey] = append(locationData[countryKey][foundStateKey], city.Name)
 	}
+	return nil
 }
 
-// downloadPostalCodes downloads postal codes for target countries
-func (dd *DataDownloader) downloadPostalCodes() ([]PostalCode, error) {
+// downloadPostalCodes downloads postal codes for target countries.
+// In best-effort mode it keeps going after a failure and returns the codes
+// that did download along with the joined per-country errors. Cancellation of
+// ctx always stops the loop.
+func (dd *DataDownloader) downloadPostalCodes(ctx context.Context) ([]PostalCode, error) {
 	var allPostalCodes []PostalCode
+	var errs []error
 
 	for _, countryCode := range dd.targetCountries {
-		fmt.Printf("Downloading postal codes for %s...\n", countryCode)
+		if err := ctx.Err(); err != nil {
+			return allPostalCodes, err
+		}
+
+		dd.logf("Downloading postal codes for %s...\n", countryCode)
 
-		postalCodes, err := dd.downloadCountryPostalCodes(countryCode)
+		postalCodes, err := dd.downloadCountryPostalCodes(ctx, countryCode)
 		if err != nil {
-			return nil, fmt.Errorf("failed to download postal codes for %s: %w", countryCode, err)
+			countryErr := &CountryDownloadError{CountryCode: countryCode, Err: err}
+			if !dd.bestEffort || ctx.Err() != nil {
+				return nil, countryErr
+			}
+			dd.logf("Warning: %v\n", countryErr)
+			errs = append(errs, countryErr)
+			continue
 		}
 
 		allPostalCodes = append(allPostalCodes, postalCodes...)
-		fmt.Printf("Downloaded %d postal codes for %s\n", len(postalCodes), countryCode)
+		dd.logf("Downloaded %d postal codes for %s\n", len(postalCodes), countryCode)
+	}
+
+	return allPostalCodes, errors.Join(errs...)
+}
+
+// DownloadAllPostalCodes downloads the combined geonames archive and parses
+// postal codes for every country that has a known format, skipping the rest.
+// The archive is spooled to a temporary file and read line by line so the
+// extracted data never has to fit in memory.
+func (dd *DataDownloader) DownloadAllPostalCodes() ([]PostalCode, error) {
+	return dd.DownloadAllPostalCodesContext(context.Background())
+}
+
+// DownloadAllPostalCodesContext is DownloadAllPostalCodes bounded by ctx
+func (dd *DataDownloader) DownloadAllPostalCodesContext(ctx context.Context) ([]PostalCode, error) {
+	dd.logf("Downloading postal codes for all countries...\n")
+
+	archive, cleanup, err := dd.downloadToFile(ctx, "https://download.geonames.org/export/zip/allCountries.zip")
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	info, err := archive.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := zip.NewReader(archive, info.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	var archiveFile *zip.File
+	for _, file := range reader.File {
+		if file.Name == "allCountries.txt" {
+			archiveFile = file
+			break
+		}
+	}
+	if archiveFile == nil {
+		return nil, fmt.Errorf("target file allCountries.txt not found in ZIP archive")
+	}
+
+	rc, err := archiveFile.Open()
+	if err != nil {
+		return nil, err
 	}
+	defer rc.Close()
 
-	return allPostalCodes, nil
+	return dd.parseAllPostalCodes(ctx, rc)
+}
+
+// parseAllPostalCodes parses the combined geonames format, where the first
+// column holds the country code, validating each row against its country
+func (dd *DataDownloader) parseAllPostalCodes(ctx context.Context, r io.Reader) ([]PostalCode, error) {
+	postalCodesSets := make(map[string]map[string]string)
+	skipped := make(map[string]bool)
+
+	scanner := bufio.NewScanner(r)
+	for lineNum := 0; scanner.Scan(); lineNum++ {
+		if lineNum%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) < 2 {
+			continue
+		}
+
+		countryCode := strings.ToUpper(strings.TrimSpace(fields[0]))
+		formatRegex := dd.postalCodeRegexs[countryCode]
+		if formatRegex == nil {
+			skipped[countryCode] = true
+			continue
+		}
+
+		postalCode, ok := dd.normalizePostalCode(fields[1], countryCode, formatRegex)
+		if !ok {
+			continue
+		}
+
+		if postalCodesSets[countryCode] == nil {
+			postalCodesSets[countryCode] = make(map[string]string)
+		}
+		if _, seen := postalCodesSets[countryCode][postalCode]; !seen {
+			postalCodesSets[countryCode][postalCode] = dd.postalStateCode(fields)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(skipped) > 0 {
+		dd.logf("Skipped %d countries without a postal code format\n", len(skipped))
+	}
+
+	var result []PostalCode
+	for countryCode, postalCodes := range postalCodesSets {
+		for postalCode, stateCode := range postalCodes {
+			result = append(result, PostalCode{
+				CountryCode: countryCode,
+				PostalCode:  postalCode,
+				StateCode:   stateCode,
+			})
+		}
+		dd.logf("Parsed %d postal codes for %s\n", len(postalCodes), countryCode)
+	}
+
+	return result, nil
 }
 
 // downloadCountryPostalCodes downloads postal codes for a specific country
-func (dd *DataDownloader) downloadCountryPostalCodes(countryCode string) ([]PostalCode, error) {
+func (dd *DataDownloader) downloadCountryPostalCodes(ctx context.Context, countryCode string) ([]PostalCode, error) {
 	isFullFormatCountry := contains([]string{"NL", "CA", "GB"}, countryCode)
 	suffix := ""
 	targetFileSuffix := ""
@@ -247,7 +601,7 @@ func (dd *DataDownloader) downloadCountryPostalCodes(countryCode string) ([]Post
 	targetFile := fmt.Sprintf("%s%s.txt", countryCode, targetFileSuffix)
 
 	// Download ZIP file
-	zipData, err := dd.downloadFile(url)
+	zipData, err := dd.downloadFile(ctx, url)
 	if err != nil {
 		return nil, err
 	}
@@ -259,12 +613,20 @@ func (dd *DataDownloader) downloadCountryPostalCodes(countryCode string) ([]Post
 	}
 
 	// Parse postal codes
-	return dd.parsePostalCodes(extractedData, countryCode), nil
+	return dd.parsePostalCodes(ctx, extractedData, countryCode)
 }
 
 // downloadFile downloads a file and returns its content
-func (dd *DataDownloader) downloadFile(url string) ([]byte, error) {
-	resp, err := dd.httpClient.Get(url)
+func (dd *DataDownloader) downloadFile(ctx context.Context, url string) ([]byte, error) {
+	if dd.cacheDir != "" {
+		path, err := dd.ensureCached(ctx, url)
+		if err != nil {
+			return nil, err
+		}
+		return os.ReadFile(path)
+	}
+
+	resp, err := dd.get(ctx, url)
 	if err != nil {
 		return nil, err
 	}
@@ -277,9 +639,115 @@ func (dd *DataDownloader) downloadFile(url string) ([]byte, error) {
 	return io.ReadAll(resp.Body)
 }
 
+// get issues a GET request for url that is cancelled along with ctx
+func (dd *DataDownloader) get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return dd.httpClient.Do(req)
+}
+
+// downloadToWriter streams a download into w without buffering it in memory
+func (dd *DataDownloader) downloadToWriter(ctx context.Context, url string, w io.Writer) error {
+	resp, err := dd.get(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP error: %d %s", resp.StatusCode, resp.Status)
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// downloadToFile downloads url into a file opened for reading. Without a cache
+// directory a temporary file is used and removed by the returned cleanup.
+func (dd *DataDownloader) downloadToFile(ctx context.Context, url string) (*os.File, func(), error) {
+	if dd.cacheDir != "" {
+		path, err := dd.ensureCached(ctx, url)
+		if err != nil {
+			return nil, nil, err
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return file, func() { file.Close() }, nil
+	}
+
+	file, err := os.CreateTemp("", "navii-download-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		file.Close()
+		os.Remove(file.Name())
+	}
+
+	if err := dd.downloadToWriter(ctx, url, file); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	return file, cleanup, nil
+}
+
+// cachePath returns the cache file used for url
+func (dd *DataDownloader) cachePath(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(dd.cacheDir, fmt.Sprintf("%x-%s", sum[:8], filepath.Base(url)))
+}
+
+// ensureCached returns the cached copy of url, downloading it first when it is
+// missing, stale, or a refresh is forced. Downloads land in a temporary file
+// and are renamed into place so a failed run never leaves a partial entry.
+func (dd *DataDownloader) ensureCached(ctx context.Context, url string) (string, error) {
+	path := dd.cachePath(url)
+
+	if !dd.forceRefresh {
+		if info, err := os.Stat(path); err == nil {
+			if dd.cacheMaxAge <= 0 || time.Since(info.ModTime()) < dd.cacheMaxAge {
+				dd.logf("Using cached %s\n", filepath.Base(url))
+				return path, nil
+			}
+		}
+	}
+
+	if err := os.MkdirAll(dd.cacheDir, 0755); err != nil {
+		return "", err
+	}
+
+	tmpFile, err := os.CreateTemp(dd.cacheDir, ".download-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if err := dd.downloadToWriter(ctx, url, tmpFile); err != nil {
+		tmpFile.Close()
+		return "", err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(tmpFile.Name(), path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
 // downloadJSON downloads and returns JSON data
-func (dd *DataDownloader) downloadJSON(url string) ([]byte, error) {
-	return dd.downloadFile(url)
+func (dd *DataDownloader) downloadJSON(ctx context.Context, url string) ([]byte, error) {
+	return dd.downloadFile(ctx, url)
 }
 
 // extractZipFile extracts a specific file from ZIP data
@@ -310,17 +778,23 @@ func (dd *DataDownloader) extractZipFile(zipData []byte, targetFile string) (str
 }
 
 // parsePostalCodes parses postal code data and validates formats
-func (dd *DataDownloader) parsePostalCodes(data, countryCode string) []PostalCode {
+func (dd *DataDownloader) parsePostalCodes(ctx context.Context, data, countryCode string) ([]PostalCode, error) {
 	formatRegex := dd.postalCodeRegexs[countryCode]
 	if formatRegex == nil {
-		fmt.Printf("Warning: No postal code format defined for %s\n", countryCode)
-		return []PostalCode{}
+		dd.logf("Warning: No postal code format defined for %s\n", countryCode)
+		return []PostalCode{}, nil
 	}
 
-	postalCodesSet := make(map[string]bool)
+	postalCodesSet := make(map[string]string)
 	lines := strings.Split(data, "\n")
 
-	for _, line := range lines {
+	for i, line := range lines {
+		if i%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+
 		line = strings.TrimSpace(line)
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
@@ -331,34 +805,63 @@ func (dd *DataDownloader) parsePostalCodes(data, countryCode string) []PostalCod
 			continue
 		}
 
-		postalCode := strings.TrimSpace(fields[1])
-		postalCode = strings.ReplaceAll(postalCode, " ", "")
-
-		// Standardize formats
-		postalCode = dd.standardizePostalCode(postalCode, countryCode)
-
-		// Validate format
-		if !formatRegex.MatchString(postalCode) {
+		postalCode, ok := dd.normalizePostalCode(fields[1], countryCode, formatRegex)
+		if !ok {
 			continue
 		}
 
-		postalCodesSet[postalCode] = true
+		if _, seen := postalCodesSet[postalCode]; !seen {
+			postalCodesSet[postalCode] = dd.postalStateCode(fields)
+		}
 	}
 
 	// Convert set to slice
 	var result []PostalCode
-	for postalCode := range postalCodesSet {
+	for postalCode, stateCode := range postalCodesSet {
 		result = append(result, PostalCode{
 			CountryCode: countryCode,
 			PostalCode:  postalCode,
+			StateCode:   stateCode,
 		})
 	}
 
-	return result
+	return result, nil
+}
+
+// postalStateCode returns the admin code 1 column of a geonames row when zip
+// state enrichment is enabled
+func (dd *DataDownloader) postalStateCode(fields []string) string {
+	if !dd.zipStates || len(fields) < 5 {
+		return ""
+	}
+	return strings.ToUpper(strings.TrimSpace(fields[4]))
+}
+
+// normalizePostalCode standardizes and validates a raw postal code, truncating
+// it to the configured prefix length once it has passed validation
+func (dd *DataDownloader) normalizePostalCode(raw, countryCode string, formatRegex *regexp.Regexp) (string, bool) {
+	postalCode := strings.TrimSpace(raw)
+	postalCode = strings.ReplaceAll(postalCode, " ", "")
+
+	// Standardize formats
+	postalCode = dd.standardizePostalCode(postalCode, countryCode)
+
+	// Validate format
+	if !formatRegex.MatchString(postalCode) {
+		return "", false
+	}
+
+	// Truncate to prefix after validation so the full code is checked
+	return PostalCodePrefix(postalCode, dd.prefixLength), true
 }
 
-// standardizePostalCode standardizes postal code format for specific countries
+// standardizePostalCode standardizes postal code format for specific countries,
+// preferring a standardizer registered for the country
 func (dd *DataDownloader) standardizePostalCode(postalCode, countryCode string) string {
+	if fn := dd.standardizers[countryCode]; fn != nil {
+		return fn(postalCode)
+	}
+
 	switch countryCode {
 	case "JP":
 		if len(postalCode) == 7 && !strings.Contains(postalCode, "-") {
@@ -380,6 +883,16 @@ func (dd *DataDownloader) standardizePostalCode(postalCode, countryCode string)
 	return postalCode
 }
 
+// PostalCodePrefix returns the first length characters of a postal code,
+// trimming any trailing whitespace left by the cut. A non-positive length
+// returns the code unchanged.
+func PostalCodePrefix(postalCode string, length int) string {
+	if length <= 0 || len(postalCode) <= length {
+		return postalCode
+	}
+	return strings.TrimSpace(postalCode[:length])
+}
+
 // writeLocationFile writes the location data to a JSON file
 func (dd *DataDownloader) writeLocationFile(outputPath string, data LocationData) error {
 	// Convert to absolute path
@@ -388,6 +901,16 @@ func (dd *DataDownloader) writeLocationFile(outputPath string, data LocationData
 		return fmt.Errorf("failed to get absolute path: %w", err)
 	}
 
+	if dd.mergeExisting {
+		existing, err := loadLocationDataFromPath(absPath)
+		switch {
+		case err == nil:
+			data = mergeLocationData(existing, data)
+		case !errors.Is(err, os.ErrNotExist):
+			return fmt.Errorf("failed to load existing data for merging: %w", err)
+		}
+	}
+
 	// Set the absolute path in location.go for consistency
 	SetDataFilePath(absPath)
 
@@ -399,6 +922,79 @@ func (dd *DataDownloader) writeLocationFile(outputPath string, data LocationData
 	return os.WriteFile(absPath, jsonData, 0644)
 }
 
+// mergeLocationData unions update into existing. City and postal code lists
+// are combined without duplicates, while postal code states and country
+// metadata from update take precedence. The result is written in update's
+// schema, so city details held only by existing are reduced to names.
+func mergeLocationData(existing *LocationData, update LocationData) LocationData {
+	merged := update
+	merged.CityData = make(map[string]map[string][]string, len(existing.CityData))
+	merged.ZipData = make(map[string][]string, len(existing.ZipData))
+	merged.CityDetails = nil
+
+	for _, source := range []map[string]map[string][]string{existing.CityData, update.CityData} {
+		for countryKey, states := range source {
+			if merged.CityData[countryKey] == nil {
+				merged.CityData[countryKey] = make(map[string][]string, len(states))
+			}
+			for stateKey, cities := range states {
+				merged.CityData[countryKey][stateKey] = unionStrings(merged.CityData[countryKey][stateKey], cities)
+			}
+		}
+	}
+
+	for _, source := range []map[string][]string{existing.ZipData, update.ZipData} {
+		for countryCode, zips := range source {
+			merged.ZipData[countryCode] = unionStrings(merged.ZipData[countryCode], zips)
+		}
+	}
+
+	if existing.ZipStates != nil || update.ZipStates != nil {
+		merged.ZipStates = make(map[string]map[string]string)
+		for _, source := range []map[string]map[string]string{existing.ZipStates, update.ZipStates} {
+			for countryCode, states := range source {
+				if merged.ZipStates[countryCode] == nil {
+					merged.ZipStates[countryCode] = make(map[string]string, len(states))
+				}
+				for zip, stateCode := range states {
+					merged.ZipStates[countryCode][zip] = stateCode
+				}
+			}
+		}
+	}
+
+	merged.Countries = append([]CountryData{}, update.Countries...)
+	for _, country := range existing.Countries {
+		found := false
+		for _, c := range update.Countries {
+			if c.ISO2 == country.ISO2 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged.Countries = append(merged.Countries, country)
+		}
+	}
+
+	return merged
+}
+
+// unionStrings appends the items of extra missing from base, keeping order
+func unionStrings(base, extra []string) []string {
+	seen := make(map[string]bool, len(base)+len(extra))
+	for _, item := range base {
+		seen[item] = true
+	}
+	for _, item := range extra {
+		if !seen[item] {
+			seen[item] = true
+			base = append(base, item)
+		}
+	}
+	return base
+}
+
 // contains checks if a slice contains a string
 func contains(slice []string, item string) bool {
 	for _, s := range slice {
@@ -415,23 +1011,28 @@ func contains(slice []string, item string) bool {
 
 // ShouldDownloadData determines if data should be downloaded based on database state and file conditions
 func ShouldDownloadData(dbPath, dataFilePath string) (bool, error) {
+	return NewDataDownloader().shouldDownload(dbPath, dataFilePath)
+}
+
+// shouldDownload is ShouldDownloadData reporting through the downloader's logger
+func (dd *DataDownloader) shouldDownload(dbPath, dataFilePath string) (bool, error) {
 	// Check if database exists and has data
 	if dbExists, hasData := checkDatabaseState(dbPath); dbExists && hasData {
-		fmt.Println("Database already populated, skipping download")
+		dd.logf("Database already populated, skipping download\n")
 		return false, nil
 	}
 
 	// Check if data file exists and is valid
 	if fileExists, isValid, isRecent := checkDataFileState(dataFilePath); fileExists {
 		if isValid && isRecent {
-			fmt.Println("Valid and recent data file found, skipping download")
+			dd.logf("Valid and recent data file found, skipping download\n")
 			return false, nil
 		}
 		if !isValid {
-			fmt.Println("Data file exists but is invalid, will re-download")
+			dd.logf("Data file exists but is invalid, will re-download\n")
 		}
 		if !isRecent {
-			fmt.Println("Data file exists but is older than 24 hours, will re-download")
+			dd.logf("Data file exists but is older than 24 hours, will re-download\n")
 		}
 	}
 
@@ -440,9 +1041,7 @@ func ShouldDownloadData(dbPath, dataFilePath string) (bool, error) {
 
 // checkDatabaseState checks if database exists and contains data
 func checkDatabaseState(dbPath string) (exists bool, hasData bool) {
-	if dbPath == "" {
-		dbPath = ".yuniq.db"
-	}
+	dbPath = resolveDBPath(dbPath)
 
 	// Check if database file exists
 	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
@@ -484,13 +1083,13 @@ func checkDataFileState(filePath string) (exists bool, isValid bool, isRecent bo
 
 // isValidDataFile checks if the data file contains expected structure
 func isValidDataFile(filePath string) bool {
-	data, err := os.ReadFile(filePath)
+	locationData, err := loadLocationDataFromPath(filePath)
 	if err != nil {
 		return false
 	}
 
-	var locationData LocationData
-	if err := json.Unmarshal(data, &locationData); err != nil {
+	// Files written for a different key layout parse fine but yield wrong keys
+	if !hasExpectedLayout(locationData) {
 		return false
 	}
 
@@ -500,27 +1099,100 @@ func isValidDataFile(filePath string) bool {
 
 // SmartDownloadData downloads data only if needed based on database and file state
 func SmartDownloadData(dbPath, dataFilePath string) error {
-	shouldDownload, err := ShouldDownloadData(dbPath, dataFilePath)
+	return NewDataDownloader().smartDownload(dbPath, dataFilePath)
+}
+
+// smartDownload is SmartDownloadData using the downloader's settings
+func (dd *DataDownloader) smartDownload(dbPath, dataFilePath string) error {
+	shouldDownload, err := dd.shouldDownload(dbPath, dataFilePath)
 	if err != nil {
 		return fmt.Errorf("failed to check download conditions: %w", err)
 	}
 
-	if !shouldDownload {
+	if shouldDownload {
+		dd.logf("Starting navii geographical data download...\n")
+
+		if err := dd.DownloadAndProcessData(dataFilePath); err != nil {
+			return fmt.Errorf("download failed: %w", err)
+		}
+
+		dd.logf("✓ Geographical data successfully downloaded and saved to %s\n", dataFilePath)
+	}
+
+	return dd.reseedIfStale(dbPath, dataFilePath)
+}
+
+// reseedIfStale reseeds a populated database from the data file when it was
+// seeded from a different one. Empty databases are left for Init to seed.
+func (dd *DataDownloader) reseedIfStale(dbPath, dataFilePath string) error {
+	if dbExists, hasData := checkDatabaseState(dbPath); !dbExists || !hasData {
+		return nil
+	}
+	if !isValidDataFile(dataFilePath) {
 		return nil
 	}
 
-	fmt.Println("Starting navii geographical data download...")
-	downloader := NewDataDownloader()
+	hash, err := hashFile(dataFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to hash data file: %w", err)
+	}
+
+	sm, err := NewStateManager(dbPath)
+	if err != nil {
+		return err
+	}
+	defer sm.Close()
 
-	if err := downloader.DownloadAndProcessData(dataFilePath); err != nil {
-		return fmt.Errorf("download failed: %w", err)
+	stale, err := sm.needsRepopulation(hash)
+	if err != nil || !stale {
+		return err
 	}
 
-	fmt.Printf("✓ Geographical data successfully downloaded and saved to %s\n", dataFilePath)
+	locationData, err := loadLocationDataFromPath(dataFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to load data file: %w", err)
+	}
+
+	dd.logf("Database was seeded from a different data file, reseeding from %s\n", dataFilePath)
+	if err := sm.populate(locationData, hash); err != nil {
+		return fmt.Errorf("failed to reseed database: %w", err)
+	}
 	return nil
 }
 
+// PostInstallOptions configures RunPostInstallWithOptions. Zero values keep
+// the defaults of RunPostInstall.
+type PostInstallOptions struct {
+	OutputPath      string       // Data file to write; defaults to location_data.json
+	DBPath          string       // Database checked for existing data; defaults as in NewDB
+	TargetCountries []string     // Countries whose postal codes are downloaded; nil keeps the default list
+	BaseURL         string       // Source of countries.json and cities.json; defaults to DefaultLocationDataURL
+	HTTPClient      *http.Client // Client for every download
+	Logger          *log.Logger  // Destination of progress messages; defaults to standard output
+}
+
+// RunPostInstallWithOptions runs the post-installation data download with a
+// custom output path, source, client and logger. Like RunPostInstall it does
+// nothing when the database or a recent data file already holds the data.
+func RunPostInstallWithOptions(opts PostInstallOptions) error {
+	if opts.OutputPath == "" {
+		opts.OutputPath = "location_data.json"
+	}
+
+	downloader := NewDataDownloader()
+	if opts.TargetCountries != nil {
+		downloader.SetTargetCountries(opts.TargetCountries)
+	}
+	downloader.SetBaseURL(opts.BaseURL)
+	if opts.HTTPClient != nil {
+		downloader.SetHTTPClient(opts.HTTPClient)
+	}
+	downloader.SetLogger(opts.Logger)
+
+	return downloader.smartDownload(opts.DBPath, opts.OutputPath)
+}
+
 // RunPostInstall runs the post-installation data download process
 func RunPostInstall() error {
-	return SmartDownloadData("", "location_data.json")
+	return RunPostInstallWithOptions(PostInstallOptions{})
 }
@@ -0,0 +1,61 @@
+package navii
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestReseedIfStaleReplacesRemovedLocations(t *testing.T) {
+	dataPath := writeTestLocationData(t, `{
+		"cityData": {"US#United States": {"CA##California": ["Los Angeles"], "TX##Texas": ["Austin"]}},
+		"zipData": {"US": ["90001", "73301"]}
+	}`)
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+
+	sm := openTestStateManager(t, dbPath)
+	mustNoError(t, sm.Init(InitOptions{Format: NavFormatCity, TargetCountry: "all"}))
+	mustNoError(t, sm.Close())
+
+	mustNoError(t, os.WriteFile(dataPath, []byte(`{
+		"cityData": {"US#United States": {"CA##California": ["Los Angeles", "San Diego"]}},
+		"zipData": {"US": ["90001"]}
+	}`), 0644))
+
+	dd := NewDataDownloader()
+	dd.SetLogger(log.New(io.Discard, "", 0))
+	mustNoError(t, dd.reseedIfStale(dbPath, dataPath))
+
+	reseeded := openTestStateManager(t, dbPath)
+	stale, err := reseeded.NeedsRepopulation()
+	mustNoError(t, err)
+	if stale {
+		t.Fatal("NeedsRepopulation() is true right after reseeding")
+	}
+
+	cities, err := reseeded.db.GetCities([]string{"US"}, nil)
+	mustNoError(t, err)
+	var names []string
+	for _, city := range cities {
+		names = append(names, city.City)
+	}
+	sort.Strings(names)
+	if want := []string{"Los Angeles", "San Diego"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("cities after reseeding = %v, want %v", names, want)
+	}
+
+	states, err := reseeded.db.GetStates([]string{"US"})
+	mustNoError(t, err)
+	if len(states) != 1 || states[0].StateShort != "CA" {
+		t.Fatalf("states after reseeding = %+v, want only CA", states)
+	}
+	zips, err := reseeded.db.GetZips([]string{"US"})
+	mustNoError(t, err)
+	if len(zips) != 1 || zips[0].Zip != "90001" {
+		t.Fatalf("zips after reseeding = %+v, want only 90001", zips)
+	}
+}
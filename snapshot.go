@@ -0,0 +1,204 @@
+package navii
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"math/bits"
+	"sort"
+)
+
+// snapshotVersion is bumped whenever stateSnapshot changes incompatibly
+const snapshotVersion = 1
+
+// stateSnapshot is the binary export of a navigation plan's progress
+type stateSnapshot struct {
+	Version       int
+	Format        NavFormat
+	TargetCountry string
+	Index         int
+	Total         int
+	Completed     indexSet
+}
+
+// arrayContainerMax is the size at which an array container switches to a
+// bitmap, the point where the bitmap's fixed 8KB becomes the smaller of the two
+const arrayContainerMax = 4096
+
+// indexSet is a roaring-style set of navigation indices. Indices are split by
+// their high 16 bits into containers that hold the low bits either as a sorted
+// array, while sparse, or as a 65536-bit bitmap once dense.
+type indexSet struct {
+	Containers map[uint32]*indexContainer
+}
+
+// indexContainer holds the low 16 bits of the indices sharing a high part.
+// Exactly one of Array and Bitmap is in use.
+type indexContainer struct {
+	Array  []uint16
+	Bitmap []uint64
+}
+
+// add inserts index into the set
+func (s *indexSet) add(index int) {
+	if s.Containers == nil {
+		s.Containers = make(map[uint32]*indexContainer)
+	}
+
+	high, low := uint32(index>>16), uint16(index)
+	c, ok := s.Containers[high]
+	if !ok {
+		c = &indexContainer{}
+		s.Containers[high] = c
+	}
+
+	if c.Bitmap != nil {
+		c.Bitmap[low/64] |= 1 << (low % 64)
+		return
+	}
+
+	i := sort.Search(len(c.Array), func(i int) bool { return c.Array[i] >= low })
+	if i < len(c.Array) && c.Array[i] == low {
+		return
+	}
+	c.Array = append(c.Array, 0)
+	copy(c.Array[i+1:], c.Array[i:])
+	c.Array[i] = low
+
+	if len(c.Array) > arrayContainerMax {
+		c.Bitmap = make([]uint64, 1<<16/64)
+		for _, v := range c.Array {
+			c.Bitmap[v/64] |= 1 << (v % 64)
+		}
+		c.Array = nil
+	}
+}
+
+// remove deletes index from the set
+func (s *indexSet) remove(index int) {
+	c, ok := s.Containers[uint32(index>>16)]
+	if !ok {
+		return
+	}
+
+	low := uint16(index)
+	if c.Bitmap != nil {
+		c.Bitmap[low/64] &^= 1 << (low % 64)
+		return
+	}
+	i := sort.Search(len(c.Array), func(i int) bool { return c.Array[i] >= low })
+	if i < len(c.Array) && c.Array[i] == low {
+		c.Array = append(c.Array[:i], c.Array[i+1:]...)
+	}
+}
+
+// contains reports whether index is in the set
+func (s *indexSet) contains(index int) bool {
+	c, ok := s.Containers[uint32(index>>16)]
+	if !ok {
+		return false
+	}
+
+	low := uint16(index)
+	if c.Bitmap != nil {
+		return c.Bitmap[low/64]&(1<<(low%64)) != 0
+	}
+	i := sort.Search(len(c.Array), func(i int) bool { return c.Array[i] >= low })
+	return i < len(c.Array) && c.Array[i] == low
+}
+
+// forEach calls fn for every index in the set
+func (s *indexSet) forEach(fn func(index int)) {
+	for high, c := range s.Containers {
+		base := int(high) << 16
+		if c.Bitmap == nil {
+			for _, low := range c.Array {
+				fn(base | int(low))
+			}
+			continue
+		}
+		for i, word := range c.Bitmap {
+			for word != 0 {
+				fn(base | (i*64 + bits.TrailingZeros64(word)))
+				word &= word - 1
+			}
+		}
+	}
+}
+
+// ExportStateBinary writes a compact gob snapshot of the navigation progress:
+// the format, target country, current index and the set of completed indices.
+// ImportStateBinary restores it without scanning the sessions table.
+func (sm *StateManager) ExportStateBinary(w io.Writer) error {
+	if sm.format == nil {
+		return fmt.Errorf("state manager not initialized")
+	}
+
+	snapshot := stateSnapshot{
+		Version:       snapshotVersion,
+		Format:        *sm.format,
+		TargetCountry: sm.planKey(),
+		Index:         sm.currentIndex,
+		Total:         sm.navTotal,
+	}
+
+	indices, err := sm.db.GetCompletedNavIndices(string(*sm.format), sm.planKey())
+	if err != nil {
+		return err
+	}
+	for _, index := range indices {
+		if index < sm.navTotal {
+			snapshot.Completed.add(index)
+		}
+	}
+	// Keep indices known only in memory, such as those from an imported snapshot
+	sm.completed.forEach(snapshot.Completed.add)
+
+	if err := gob.NewEncoder(w).Encode(snapshot); err != nil {
+		return fmt.Errorf("failed to encode state snapshot: %w", err)
+	}
+	return nil
+}
+
+// ImportStateBinary restores a snapshot written by ExportStateBinary, moving
+// navigation to the saved index. The snapshot must come from a state manager
+// initialized with the same format and target country over the same data.
+func (sm *StateManager) ImportStateBinary(r io.Reader) error {
+	if sm.format == nil {
+		return fmt.Errorf("state manager not initialized")
+	}
+
+	var snapshot stateSnapshot
+	if err := gob.NewDecoder(r).Decode(&snapshot); err != nil {
+		return fmt.Errorf("failed to decode state snapshot: %w", err)
+	}
+
+	if snapshot.Version != snapshotVersion {
+		return fmt.Errorf("unsupported state snapshot version %d", snapshot.Version)
+	}
+	if snapshot.Format != *sm.format || snapshot.TargetCountry != sm.planKey() {
+		return fmt.Errorf("state snapshot is for format %s and target %s, not %s and %s",
+			snapshot.Format, snapshot.TargetCountry, *sm.format, sm.planKey())
+	}
+	if snapshot.Total != sm.navTotal {
+		return fmt.Errorf("state snapshot has %d navigation items but the current order has %d", snapshot.Total, sm.navTotal)
+	}
+	if snapshot.Index < 0 || snapshot.Index >= sm.navTotal {
+		return fmt.Errorf("state snapshot index %d is out of range", snapshot.Index)
+	}
+
+	sm.completed = snapshot.Completed
+	sm.currentIndex = snapshot.Index
+	currentNav, err := sm.buildCurrentNav(sm.currentIndex)
+	if err != nil {
+		return err
+	}
+	sm.currentNav = currentNav
+	return sm.saveCurrentSession()
+}
+
+// IsIndexCompleted reports whether the item at a navigation order index is
+// known to be completed, from this run, an earlier session or an imported snapshot
+func (sm *StateManager) IsIndexCompleted(index int) bool {
+	return sm.completed.contains(index)
+}
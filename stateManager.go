@@ -1,11 +1,20 @@
-// Package yuniq provides geographical navigation and state management functionality
+// Package navii provides geographical navigation and state management functionality
 package navii
 
 import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -15,9 +24,12 @@ const (
 	NavFormatZipCountry            NavFormat = "zip-country"
 	NavFormatQueryZip              NavFormat = "query-zip"
 	NavFormatQueryZipCountry       NavFormat = "query-zip-country"
+	NavFormatZipState              NavFormat = "zip-state"
+	NavFormatQueryZipState         NavFormat = "query-zip-state"
 	NavFormatCity                  NavFormat = "city"
 	NavFormatCityState             NavFormat = "city-state"
 	NavFormatCityStateCountry      NavFormat = "city-state-country"
+	NavFormatStateCity             NavFormat = "state-city"
 	NavFormatQueryCity             NavFormat = "query-city"
 	NavFormatQueryCityState        NavFormat = "query-city-state"
 	NavFormatQueryCityStateCountry NavFormat = "query-city-state-country"
@@ -30,6 +42,96 @@ const (
 	NavFormatCounty                NavFormat = "county"
 )
 
+// NavFormatDescription describes a navigation format for display purposes
+type NavFormatDescription struct {
+	Format      NavFormat `json:"format"`
+	Description string    `json:"description"`
+	Levels      []string  `json:"levels"`
+}
+
+// navFormatDescriptions is the canonical list of supported formats
+var navFormatDescriptions = []NavFormatDescription{
+	{NavFormatZip, "Postal code", []string{"zip"}},
+	{NavFormatZipCountry, "Postal code within Country", []string{"zip", "country"}},
+	{NavFormatQueryZip, "Query in Postal code", []string{"query", "zip"}},
+	{NavFormatQueryZipCountry, "Query in Postal code within Country", []string{"query", "zip", "country"}},
+	{NavFormatZipState, "Postal code within State", []string{"zip", "state"}},
+	{NavFormatQueryZipState, "Query in Postal code within State", []string{"query", "zip", "state"}},
+	{NavFormatCity, "City", []string{"city"}},
+	{NavFormatCityState, "City within State", []string{"city", "state"}},
+	{NavFormatCityStateCountry, "City within State within Country", []string{"city", "state", "country"}},
+	{NavFormatStateCity, "State, then each City within it", []string{"state", "city"}},
+	{NavFormatQueryCity, "Query in City", []string{"query", "city"}},
+	{NavFormatQueryCityState, "Query in City within State", []string{"query", "city", "state"}},
+	{NavFormatQueryCityStateCountry, "Query in City within State within Country", []string{"query", "city", "state", "country"}},
+	{NavFormatState, "State", []string{"state"}},
+	{NavFormatStateCountry, "State within Country", []string{"state", "country"}},
+	{NavFormatQueryState, "Query in State", []string{"query", "state"}},
+	{NavFormatQueryStateCountry, "Query in State within Country", []string{"query", "state", "country"}},
+	{NavFormatQueryCounty, "Query in County", []string{"query", "county"}},
+	{NavFormatQuery, "Query", []string{"query"}},
+	{NavFormatCounty, "County", []string{"county"}},
+}
+
+// NavFormatInfo returns every supported format with a human description and
+// the levels it navigates, in declaration order
+func NavFormatInfo() []NavFormatDescription {
+	info := make([]NavFormatDescription, len(navFormatDescriptions))
+	for i, d := range navFormatDescriptions {
+		info[i] = NavFormatDescription{
+			Format:      d.Format,
+			Description: d.Description,
+			Levels:      append([]string{}, d.Levels...),
+		}
+	}
+	return info
+}
+
+// isKnownFormat reports whether format is one of the declared formats
+func isKnownFormat(format NavFormat) bool {
+	for _, d := range navFormatDescriptions {
+		if d.Format == format {
+			return true
+		}
+	}
+	return false
+}
+
+// RequiredLevels returns the levels a format navigates, such as
+// ["query", "city", "state"] for NavFormatQueryCityState, or nil for an
+// unknown format
+func RequiredLevels(format NavFormat) []string {
+	for _, d := range navFormatDescriptions {
+		if d.Format == format {
+			return append([]string{}, d.Levels...)
+		}
+	}
+	return nil
+}
+
+// formatUsesLevel reports whether a format navigates the given level. Unknown
+// formats are assumed to use every level.
+func formatUsesLevel(format NavFormat, level string) bool {
+	if !isKnownFormat(format) {
+		return true
+	}
+	for _, l := range RequiredLevels(format) {
+		if l == level {
+			return true
+		}
+	}
+	return false
+}
+
+// formatLoads reports which entity tables a format needs in memory. Counties
+// come from cities, and zip formats use states to attach enriched zip states.
+func formatLoads(format NavFormat) (states, cities, zips bool) {
+	cities = formatUsesLevel(format, "city") || formatUsesLevel(format, "county")
+	zips = formatUsesLevel(format, "zip")
+	states = cities || zips || formatUsesLevel(format, "state")
+	return states, cities, zips
+}
+
 // ============================================================================
 // STATE MANAGER (equivalent to stateManager.ts)
 // ============================================================================
@@ -47,13 +149,76 @@ type StateManager struct {
 	queries       []Query
 	currentIndex  int
 	navOrder      []Nav
+	navSegments   []NavSegment
+
+	// navTotal is the length of the full navigation order. In lazy mode navOrder
+	// only holds the loaded country's items, starting at global index navBase.
+	navTotal   int
+	navBase    int
+	lazyCities bool
+	lazyZips   bool
+
+	// lazySizes sizes country segments from row counts instead of generating
+	// each country's items, so InitLazy never reads cities or zips up front
+	lazySizes bool
+
+	// navIndex maps Nav.Key to the global indices of each loaded nav in
+	// ascending order; weighted queries repeat a nav once per pass
+	navIndex map[string][]int
+
+	// sessionID is the nav_sessions row for currentNav, 0 when none is active
+	sessionID int
+
+	// countryCursors holds the last index served per country by GetNextNavForCountry
+	countryCursors map[string]int
+
+	// customOrder is the caller's list from InitWithNavOrder, served instead
+	// of a generated order; customKey identifies it in saved positions
+	customOrder []Nav
+	customKey   string
+
+	// completed holds the indices of finished items, loaded from earlier
+	// sessions at Init or from ImportStateBinary, which GetNextNav skips
+	completed indexSet
+
+	requireNonEmptyStates bool
+	queryOrder            QueryOrder
+	excludeCountries      map[string]bool
+	priorityCountries     []string
+	excludeStates         map[string]map[string]bool // Country code to excluded state codes
+	autoCompleteNonPaged  bool
+
+	// limit caps how many items GetNextNav serves after Init; served counts them
+	limit  int
+	served int
+
+	// advanceTimes is a rolling window of when recent items were served, oldest first
+	advanceTimes []time.Time
+
+	// recentNavs is a ring buffer of the last items served, written at
+	// recentNext; recentCount is how many of its slots are filled
+	recentNavs  []*NavResponse
+	recentNext  int
+	recentCount int
+
+	// sharedKey is the registry key of a manager from GetSharedStateManager,
+	// and refs its holder count, guarded by sharedManagersMu
+	sharedKey string
+	refs      int
+
+	// populateProgress is called as setDefault inserts each chunk of rows
+	populateProgress func(table string, done, total int)
+
+	// recoveryBackup is where NewStateManagerWithRecovery moved a corrupt database
+	recoveryBackup string
+
+	// logger receives warnings about the data and saved sessions; nil discards them
+	logger *log.Logger
 }
 
 // NewStateManager creates a new state manager
 func NewStateManager(dbPath string) (*StateManager, error) {
-	if dbPath == "" {
-		dbPath = ".yuniq.db"
-	}
+	dbPath = resolveDBPath(dbPath)
 
 	db, err := NewDB(dbPath)
 	if err != nil {
@@ -67,48 +232,392 @@ func NewStateManager(dbPath string) (*StateManager, error) {
 	}, nil
 }
 
+// NewStateManagerWithRecovery is NewStateManager for a database file that may
+// be corrupt. When it is, the file is moved aside with BackupCorruptDatabase,
+// a fresh database is created and populated from the location data file, and
+// RecoveryBackup names the backup. Other errors are returned as from NewStateManager.
+func NewStateManagerWithRecovery(dbPath string) (*StateManager, error) {
+	dbPath = resolveDBPath(dbPath)
+
+	sm, err := NewStateManager(dbPath)
+	if !errors.Is(err, ErrCorruptDatabase) {
+		return sm, err
+	}
+
+	backupPath, err := BackupCorruptDatabase(dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	sm, err = NewStateManager(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	sm.recoveryBackup = backupPath
+	if err := sm.setDefault(); err != nil {
+		sm.Close()
+		return nil, fmt.Errorf("failed to repopulate database: %w", err)
+	}
+	return sm, nil
+}
+
+// RecoveryBackup returns where NewStateManagerWithRecovery moved a corrupt
+// database file, or "" when the file it opened was not corrupt
+func (sm *StateManager) RecoveryBackup() string {
+	return sm.recoveryBackup
+}
+
+// NewStateManagerWithPragmas is NewStateManager with extra SQLite pragmas
+// applied to every connection; see NewDBWithPragmas
+func NewStateManagerWithPragmas(dbPath string, pragmas map[string]string) (*StateManager, error) {
+	db, err := NewDBWithPragmas(dbPath, pragmas)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StateManager{
+		db:            db,
+		targetCountry: "all",
+		navOrder:      []Nav{},
+	}, nil
+}
+
+// NewStateManagerWithDB creates a state manager on top of an existing database
+// handle. Close on the returned manager does not close the shared handle.
+func NewStateManagerWithDB(database *sql.DB) (*StateManager, error) {
+	db, err := NewDBFromSQL(database)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StateManager{
+		db:            db,
+		targetCountry: "all",
+		navOrder:      []Nav{},
+	}, nil
+}
+
+// sharedManagers holds the state managers handed out by GetSharedStateManager,
+// keyed by absolute database path
+var (
+	sharedManagersMu sync.Mutex
+	sharedManagers   = make(map[string]*StateManager)
+)
+
+// GetSharedStateManager returns the process-wide state manager for a database
+// file, creating it on first use, so every part of an application shares one
+// cursor and one connection pool. Each call must be paired with Release; the
+// manager is closed when the last holder releases it.
+func GetSharedStateManager(dbPath string) (*StateManager, error) {
+	key, err := filepath.Abs(resolveDBPath(dbPath))
+	if err != nil {
+		return nil, err
+	}
+
+	sharedManagersMu.Lock()
+	defer sharedManagersMu.Unlock()
+
+	if sm, ok := sharedManagers[key]; ok {
+		sm.refs++
+		return sm, nil
+	}
+
+	sm, err := NewStateManager(key)
+	if err != nil {
+		return nil, err
+	}
+	sm.sharedKey = key
+	sm.refs = 1
+	sharedManagers[key] = sm
+	return sm, nil
+}
+
+// Release gives up a reference obtained from GetSharedStateManager, closing
+// the manager once no holders remain. On a manager that is not shared it is
+// the same as Close.
+func (sm *StateManager) Release() error {
+	if sm.sharedKey == "" {
+		return sm.Close()
+	}
+
+	sharedManagersMu.Lock()
+	defer sharedManagersMu.Unlock()
+
+	if sm.refs == 0 {
+		return nil
+	}
+	sm.refs--
+	if sm.refs > 0 {
+		return nil
+	}
+
+	if sharedManagers[sm.sharedKey] == sm {
+		delete(sharedManagers, sm.sharedKey)
+	}
+	return sm.Close()
+}
+
+// GetActiveSessionFormat returns the format of the incomplete session left by
+// a previous run, so it can be passed to Init to resume. It may be called
+// before Init.
+func (sm *StateManager) GetActiveSessionFormat() (NavFormat, bool, error) {
+	return sm.db.GetActiveSessionFormat()
+}
+
 // Init initializes the state manager with given options
 func (sm *StateManager) Init(options InitOptions) error {
+	return sm.initialize(options, false)
+}
+
+// InitContext is Init with its queries bounded by ctx
+func (sm *StateManager) InitContext(ctx context.Context, options InitOptions) error {
+	defer sm.bindContext(ctx)()
+	return sm.Init(options)
+}
+
+// InitLazyContext is InitLazy with its queries bounded by ctx
+func (sm *StateManager) InitLazyContext(ctx context.Context, options InitOptions) error {
+	defer sm.bindContext(ctx)()
+	return sm.InitLazy(options)
+}
+
+// bindContext runs the manager's queries under ctx until the returned
+// function restores the previous context
+func (sm *StateManager) bindContext(ctx context.Context) (restore func()) {
+	db := sm.db
+	sm.db = db.WithContext(ctx)
+	return func() { sm.db = db }
+}
+
+// InitLazy is Init for large datasets: only countries, states and queries are
+// read up front. Cities and zips are counted per country to size the order and
+// loaded one country at a time as navigation reaches it, as with LazyCities.
+func (sm *StateManager) InitLazy(options InitOptions) error {
+	return sm.initialize(options, true)
+}
+
+// initialize runs Init, deferring cities and zips to their country when lazy
+func (sm *StateManager) initialize(options InitOptions, lazy bool) error {
+	if !isKnownFormat(options.Format) {
+		return fmt.Errorf("%w: %q", ErrUnknownFormat, options.Format)
+	}
+	switch options.QueryOrder {
+	case "", QueryOrderQueryMajor, QueryOrderLocationMajor:
+	default:
+		return fmt.Errorf("unknown query order %q", options.QueryOrder)
+	}
+	switch options.SourceFilter {
+	case "", SourceFilterAll, SourceFilterExternal, SourceFilterBuiltin:
+	default:
+		return fmt.Errorf("unknown source filter %q", options.SourceFilter)
+	}
+
 	sm.format = &options.Format
 	sm.targetCountry = options.TargetCountry
-
+	sm.requireNonEmptyStates = options.RequireNonEmptyStates
+	sm.autoCompleteNonPaged = options.AutoCompleteNonPaged
+	sm.queryOrder = options.QueryOrder
+	sm.lazyCities = false
+	sm.lazyZips = false
+	sm.lazySizes = false
+	sm.customOrder = nil
+
+	if options.EnsureData {
+		if err := sm.ensureData(); err != nil {
+			return err
+		}
+	}
 	if err := sm.setDefault(); err != nil {
 		return err
 	}
+	// Bundled data is trusted; strict checks apply to cities added afterwards
+	sm.db.SetStrictReferences(options.StrictReferences)
+	sm.db.SetCaseSensitiveQueries(options.CaseSensitiveQueries)
+	sm.db.SetSourceFilter(options.SourceFilter)
+
+	targetCountry, err := sm.ResolveCountryCode(options.TargetCountry)
+	if err != nil {
+		return err
+	}
+	sm.targetCountry = targetCountry
+
+	excluded, err := sm.resolveExcludedCountries(options.ExcludeCountries)
+	if err != nil {
+		return err
+	}
+	sm.excludeCountries = excluded
+
+	priority, err := sm.resolvePriorityCountries(options.PriorityCountries)
+	if err != nil {
+		return err
+	}
+	sm.priorityCountries = priority
+
+	excludedStates, err := sm.resolveExcludedStates(options.ExcludeStates)
+	if err != nil {
+		return err
+	}
+	sm.excludeStates = excludedStates
 
 	countries, err := sm.db.GetCountries(sm.targetCountry)
 	if err != nil {
 		return err
 	}
-	sm.countries = countries
+	if len(countries) == 0 {
+		if sm.targetCountry == "all" {
+			return fmt.Errorf("%w: no countries in the database", ErrNoData)
+		}
+		return fmt.Errorf("%w: %s", ErrCountryNotFound, sm.targetCountry)
+	}
+	sm.countries = sm.withPriority(sm.withoutExcluded(countries))
 
 	countryShorts := make([]string, len(sm.countries))
 	for i, c := range sm.countries {
 		countryShorts[i] = c.CountryShort
 	}
 
-	states, err := sm.db.GetStates(countryShorts)
+	// Skip tables the format never navigates; zips in particular can be huge
+	needStates, needCities, needZips := formatLoads(options.Format)
+
+	sm.states = nil
+	if needStates {
+		states, err := sm.loadStates(countryShorts)
+		if err != nil {
+			return err
+		}
+		sm.states = states
+	}
+
+	// Lazy mode loads cities one country at a time as navigation reaches it
+	sm.lazyCities = (options.LazyCities || lazy) && needCities
+	sm.lazyZips = lazy && needZips
+	sm.lazySizes = lazy && sm.isLazy()
+
+	sm.cities = nil
+	if needCities && !sm.lazyCities {
+		cities, err := sm.db.GetCities(countryShorts, sm.stateShorts())
+		if err != nil {
+			return err
+		}
+		sm.cities = sm.citiesWithoutExcluded(cities)
+	}
+
+	sm.zips = nil
+	if needZips && !sm.lazyZips {
+		zips, err := sm.db.GetZips(countryShorts)
+		if err != nil {
+			return err
+		}
+		sm.zips = sm.zipsWithoutExcluded(zips)
+	}
+
+	queries, err := sm.db.GetQueries()
 	if err != nil {
 		return err
 	}
-	sm.states = states
+	sm.queries = queries
 
-	stateShorts := make([]string, len(sm.states))
-	for i, s := range sm.states {
-		stateShorts[i] = s.StateShort
+	sm.currentIndex = 0
+	if err := sm.generateNavOrder(); err != nil {
+		return err
+	}
+	if err := sm.loadCompleted(); err != nil {
+		return err
+	}
+	if err := sm.restoreOrStartSession(); err != nil {
+		return err
 	}
 
-	cities, err := sm.db.GetCities(countryShorts, stateShorts)
-	if err != nil {
+	sm.limit = options.Limit
+	sm.startServing()
+	return nil
+}
+
+// InitWithNavOrder initializes the state manager to serve order exactly as
+// given instead of generating a navigation order. Each nav must name a loaded
+// country and may name a state, city, zip or query, which must exist; missing
+// names, such as a city's state, are filled in as the generator would. Sessions
+// are persisted by index as usual, so an interrupted run over the same list
+// resumes where it stopped. A country split across separate runs of the list
+// is navigated by GetNextNavForCountry only within its first run.
+func (sm *StateManager) InitWithNavOrder(order []Nav, format NavFormat) error {
+	if !isKnownFormat(format) {
+		return fmt.Errorf("%w: %q", ErrUnknownFormat, format)
+	}
+	if len(order) == 0 {
+		return fmt.Errorf("navigation order is empty")
+	}
+
+	sm.format = &format
+	sm.targetCountry = "all"
+	sm.requireNonEmptyStates = false
+	sm.autoCompleteNonPaged = false
+	sm.queryOrder = ""
+	sm.excludeCountries = nil
+	sm.priorityCountries = nil
+	sm.excludeStates = nil
+	sm.lazyCities = false
+	sm.lazyZips = false
+	sm.lazySizes = false
+	sm.customOrder = nil
+
+	if err := sm.setDefault(); err != nil {
 		return err
 	}
-	sm.cities = cities
+	sm.db.SetSourceFilter(SourceFilterAll)
+
+	var countryShorts []string
+	wanted := make(map[string]bool)
+	for i, nav := range order {
+		if nav.CountryShort == nil {
+			return fmt.Errorf("nav %d has no country", i)
+		}
+		countryShort := normalizeCode(*nav.CountryShort)
+		if !wanted[countryShort] {
+			wanted[countryShort] = true
+			countryShorts = append(countryShorts, countryShort)
+		}
+	}
 
-	zips, err := sm.db.GetZips(countryShorts)
+	countries, err := sm.db.GetCountries("all")
 	if err != nil {
 		return err
 	}
-	sm.zips = zips
+	sm.countries = nil
+	for _, country := range countries {
+		if wanted[country.CountryShort] {
+			sm.countries = append(sm.countries, country)
+		}
+	}
+
+	needStates, needCities, needZips := formatLoads(format)
+
+	sm.states = nil
+	if needStates {
+		states, err := sm.db.GetStates(countryShorts)
+		if err != nil {
+			return err
+		}
+		sm.states = states
+	}
+
+	sm.cities = nil
+	if needCities {
+		cities, err := sm.db.GetCities(countryShorts, sm.stateShorts())
+		if err != nil {
+			return err
+		}
+		sm.cities = cities
+	}
+
+	sm.zips = nil
+	if needZips {
+		zips, err := sm.db.GetZips(countryShorts)
+		if err != nil {
+			return err
+		}
+		sm.zips = zips
+	}
 
 	queries, err := sm.db.GetQueries()
 	if err != nil {
@@ -116,126 +625,1018 @@ func (sm *StateManager) Init(options InitOptions) error {
 	}
 	sm.queries = queries
 
+	resolved := make([]Nav, len(order))
+	hash := sha256.New()
+	for i, nav := range order {
+		resolved[i], err = sm.resolveOrderNav(nav)
+		if err != nil {
+			return fmt.Errorf("nav %d: %w", i, err)
+		}
+		hash.Write([]byte(resolved[i].Key()))
+		hash.Write([]byte{0x1e})
+	}
+	sm.customOrder = resolved
+	sm.customKey = fmt.Sprintf("custom:%x", hash.Sum(nil)[:8])
+
 	sm.currentIndex = 0
-	sm.generateNavOrder()
-	return sm.restoreOrStartSession()
+	if err := sm.generateNavOrder(); err != nil {
+		return err
+	}
+	if err := sm.loadCompleted(); err != nil {
+		return err
+	}
+	if err := sm.restoreOrStartSession(); err != nil {
+		return err
+	}
+
+	sm.limit = 0
+	sm.startServing()
+	return nil
 }
 
-// setDefault populates default data if database is empty
-func (sm *StateManager) setDefault() error {
-	total, err := sm.db.CountTotal()
-	if err != nil {
-		return err
+// resolveOrderNav checks that the entities a caller-supplied nav names are
+// loaded and fills in the fields a generated nav would carry
+func (sm *StateManager) resolveOrderNav(nav Nav) (Nav, error) {
+	countryShort := normalizeCode(*nav.CountryShort)
+	country := sm.findCountry(countryShort)
+	if country == nil {
+		return nav, fmt.Errorf("%w: %s", ErrCountryNotFound, countryShort)
 	}
+	nav.Country = &country.Country
+	nav.CountryShort = &country.CountryShort
 
-	if total > 0 {
-		return nil // Already populated
+	states := sm.getStatesByCountry(countryShort)
+	var state *State
+	if nav.StateShort != nil {
+		stateShort := normalizeCode(*nav.StateShort)
+		if state = sm.findStateByShort(stateShort, states); state == nil {
+			return nav, fmt.Errorf("state %s not found in %s", stateShort, countryShort)
+		}
+	} else if nav.State != nil {
+		for i := range states {
+			if states[i].State == *nav.State {
+				state = &states[i]
+				break
+			}
+		}
+		if state == nil {
+			return nav, fmt.Errorf("state %q not found in %s", *nav.State, countryShort)
+		}
 	}
 
-	// Load location data - this would be populated by the postinstall process
-	locationData := GetLocationData()
+	if nav.City != nil {
+		var city *City
+		for i := range sm.cities {
+			c := &sm.cities[i]
+			if c.City == *nav.City && c.CountryShort == countryShort && (state == nil || c.StateShort == state.StateShort) {
+				city = c
+				break
+			}
+		}
+		if city == nil {
+			return nav, fmt.Errorf("city %q not found in %s", *nav.City, countryShort)
+		}
+		if state == nil {
+			state = sm.findStateByShort(city.StateShort, states)
+		}
+		cityName := city.City
+		nav.City = &cityName
+		if nav.County == nil {
+			nav.County = city.County
+		}
+	}
 
-	var allCountries []Country
-	var allStates []State
-	var allCities []City
-	var allZips []Zip
+	if state != nil {
+		nav.State = &state.State
+		nav.StateShort = &state.StateShort
+	}
 
-	// Process city data
-	for key, value := range locationData.CityData {
-		parts := strings.Split(key, "#")
-		if len(parts) != 2 {
-			continue
+	if nav.Zip != nil {
+		found := false
+		for _, zip := range sm.zips {
+			if zip.Zip == *nav.Zip && zip.CountryShort == countryShort {
+				found = true
+				break
+			}
 		}
-		countryShort, countryName := parts[0], parts[1]
+		if !found {
+			return nav, fmt.Errorf("zip %s not found in %s", *nav.Zip, countryShort)
+		}
+	}
 
-		allCountries = append(allCountries, Country{
-			Country:      countryName,
-			CountryShort: countryShort,
-			External:     false,
-			Used:         false,
-		})
+	if nav.Query != nil && sm.findQueryByText(*nav.Query) == nil {
+		return nav, fmt.Errorf("query %q not found", *nav.Query)
+	}
 
-		for k, cities := range value {
-			stateParts := strings.Split(k, "##")
-			if len(stateParts) != 2 {
-				continue
-			}
-			stateShort, stateName := stateParts[0], stateParts[1]
+	return nav, nil
+}
 
-			allStates = append(allStates, State{
-				State:        stateName,
-				StateShort:   stateShort,
-				CountryShort: countryShort,
-				Used:         false,
-				External:     false,
-			})
+// startServing restarts the served count for Limit at the current nav
+func (sm *StateManager) startServing() {
+	sm.served = 0
+	if sm.currentNav != nil {
+		sm.served = 1
+	}
+	sm.applyLimit()
+}
+
+// limitReached reports whether Limit items have been served
+func (sm *StateManager) limitReached() bool {
+	return sm.limit > 0 && sm.served >= sm.limit
+}
+
+// applyLimit clears HasNext on the current nav once the limit is reached
+func (sm *StateManager) applyLimit() {
+	if sm.currentNav != nil && sm.limitReached() {
+		sm.currentNav.HasNext = false
+	}
+}
+
+// resolveExcludedCountries validates ExcludeCountries, accepting ISO2 or ISO3
+func (sm *StateManager) resolveExcludedCountries(codes []string) (map[string]bool, error) {
+	excluded := make(map[string]bool, len(codes))
+	for _, code := range codes {
+		countryShort, err := sm.ResolveCountryCode(code)
+		if err != nil {
+			return nil, err
+		}
+		if !contains(ValidCountryCodes, countryShort) {
+			return nil, fmt.Errorf("invalid country code in ExcludeCountries: %s", code)
+		}
+		excluded[countryShort] = true
+	}
+	return excluded, nil
+}
+
+// withoutExcluded drops excluded countries. Exclusions only apply when
+// targeting "all"; a specific target country is always kept.
+func (sm *StateManager) withoutExcluded(countries []Country) []Country {
+	if sm.targetCountry != "all" || len(sm.excludeCountries) == 0 {
+		return countries
+	}
+
+	kept := countries[:0]
+	for _, country := range countries {
+		if !sm.excludeCountries[country.CountryShort] {
+			kept = append(kept, country)
+		}
+	}
+	return kept
+}
+
+// resolvePriorityCountries validates PriorityCountries, accepting ISO2 or
+// ISO3, and drops repeats. Priorities only apply when targeting "all".
+func (sm *StateManager) resolvePriorityCountries(codes []string) ([]string, error) {
+	if sm.targetCountry != "all" {
+		return nil, nil
+	}
+
+	var priority []string
+	seen := make(map[string]bool, len(codes))
+	for _, code := range codes {
+		countryShort, err := sm.ResolveCountryCode(code)
+		if err != nil {
+			return nil, err
+		}
+		if !contains(ValidCountryCodes, countryShort) {
+			return nil, fmt.Errorf("invalid country code in PriorityCountries: %s", code)
+		}
+		if !seen[countryShort] {
+			seen[countryShort] = true
+			priority = append(priority, countryShort)
+		}
+	}
+	return priority, nil
+}
+
+// withPriority moves the priority countries to the front, in priority order,
+// leaving the rest in their default order
+func (sm *StateManager) withPriority(countries []Country) []Country {
+	if len(sm.priorityCountries) == 0 {
+		return countries
+	}
+
+	rank := make(map[string]int, len(sm.priorityCountries))
+	for i, countryShort := range sm.priorityCountries {
+		rank[countryShort] = i
+	}
+
+	ordered := make([]Country, 0, len(countries))
+	front := make([]*Country, len(sm.priorityCountries))
+	for i := range countries {
+		if r, ok := rank[countries[i].CountryShort]; ok {
+			front[r] = &countries[i]
+		}
+	}
+	for _, country := range front {
+		if country != nil {
+			ordered = append(ordered, *country)
+		}
+	}
+	for _, country := range countries {
+		if _, ok := rank[country.CountryShort]; !ok {
+			ordered = append(ordered, country)
+		}
+	}
+	return ordered
+}
+
+// loadStates loads states for the given countries, honouring RequireNonEmptyStates
+func (sm *StateManager) loadStates(countryShorts []string) ([]State, error) {
+	var states []State
+	var err error
+	if sm.requireNonEmptyStates {
+		states, err = sm.db.GetStatesWithContent(countryShorts)
+	} else {
+		states, err = sm.db.GetStates(countryShorts)
+	}
+	if err != nil || len(sm.excludeStates) == 0 {
+		return states, err
+	}
+
+	kept := states[:0]
+	for _, state := range states {
+		if !sm.stateExcluded(state.CountryShort, state.StateShort) {
+			kept = append(kept, state)
+		}
+	}
+	return kept, nil
+}
+
+// resolveExcludedStates validates ExcludeStates, accepting ISO2 or ISO3
+// country codes. Every state code must exist in its country.
+func (sm *StateManager) resolveExcludedStates(codes map[string][]string) (map[string]map[string]bool, error) {
+	excluded := make(map[string]map[string]bool, len(codes))
+	for code, stateShorts := range codes {
+		countryShort, err := sm.ResolveCountryCode(code)
+		if err != nil {
+			return nil, err
+		}
+		if !contains(ValidCountryCodes, countryShort) {
+			return nil, fmt.Errorf("invalid country code in ExcludeStates: %s", code)
+		}
+
+		if excluded[countryShort] == nil {
+			excluded[countryShort] = make(map[string]bool, len(stateShorts))
+		}
+		for _, stateShort := range stateShorts {
+			state, err := sm.db.GetState(stateShort, countryShort)
+			if err != nil {
+				return nil, err
+			}
+			if state == nil {
+				return nil, fmt.Errorf("unknown state in ExcludeStates: %s/%s", stateShort, countryShort)
+			}
+			excluded[countryShort][state.StateShort] = true
+		}
+	}
+	return excluded, nil
+}
+
+// stateExcluded reports whether ExcludeStates lists a state
+func (sm *StateManager) stateExcluded(countryShort, stateShort string) bool {
+	return sm.excludeStates[countryShort][stateShort]
+}
+
+// citiesWithoutExcluded drops the cities of excluded states. Cities are loaded
+// for every pairing of the loaded countries and state codes, so a code excluded
+// in one country can still match a kept state of the same code elsewhere.
+func (sm *StateManager) citiesWithoutExcluded(cities []City) []City {
+	if len(sm.excludeStates) == 0 {
+		return cities
+	}
+
+	kept := cities[:0]
+	for _, city := range cities {
+		if !sm.stateExcluded(city.CountryShort, city.StateShort) {
+			kept = append(kept, city)
+		}
+	}
+	return kept
+}
+
+// zipsWithoutExcluded drops zips enriched with an excluded state
+func (sm *StateManager) zipsWithoutExcluded(zips []Zip) []Zip {
+	if len(sm.excludeStates) == 0 {
+		return zips
+	}
+
+	kept := zips[:0]
+	for _, zip := range zips {
+		if zip.StateShort == nil || !sm.stateExcluded(zip.CountryShort, *zip.StateShort) {
+			kept = append(kept, zip)
+		}
+	}
+	return kept
+}
+
+// setDefault populates default data if database is empty
+func (sm *StateManager) setDefault() error {
+	total, err := sm.db.CountTotal()
+	if err != nil {
+		return err
+	}
+
+	if total > 0 {
+		return nil // Already populated
+	}
+
+	hash, err := LocationDataHash()
+	if err != nil {
+		return err
+	}
+	// Load location data - this would be populated by the postinstall process
+	return sm.populate(GetLocationData(), hash)
+}
+
+// NeedsRepopulation reports whether the database was seeded from a different
+// data file than the current one, such as after location_data.json has been
+// replaced. An empty database or a missing data file never needs it, while a
+// database seeded before the data file hash was recorded always does.
+func (sm *StateManager) NeedsRepopulation() (bool, error) {
+	hash, err := LocationDataHash()
+	if err != nil {
+		return false, err
+	}
+	return sm.needsRepopulation(hash)
+}
+
+// needsRepopulation is NeedsRepopulation against the hash of a data file
+func (sm *StateManager) needsRepopulation(hash string) (bool, error) {
+	if hash == "" {
+		return false, nil
+	}
+
+	total, err := sm.db.CountTotal()
+	if err != nil || total == 0 {
+		return false, err
+	}
+
+	stored, ok, err := sm.db.GetMetadata(dataHashKey)
+	if err != nil {
+		return false, err
+	}
+	return !ok || stored != hash, nil
+}
+
+// Repopulate reseeds the database from the current data file in one
+// transaction. Locations the file adds are inserted and used flags of existing
+// ones are kept; builtin locations it no longer lists are removed, except
+// states and countries that added data or saved sessions still refer to. Call
+// Init again to navigate the new data.
+func (sm *StateManager) Repopulate() error {
+	reloadLocationData()
+
+	hash, err := LocationDataHash()
+	if err != nil {
+		return err
+	}
+	return sm.populate(GetLocationData(), hash)
+}
+
+// populate inserts the builtin locations of a data file, removes builtin ones
+// it does not list and records the file's hash, when known, for NeedsRepopulation
+func (sm *StateManager) populate(locationData *LocationData, hash string) error {
+	var allCountries []Country
+	var allStates []State
+	var allCities []City
+	var allZips []Zip
+
+	// Visit countries in key order so that, when the feed lists an ISO2 code
+	// under more than one name, the name kept is the same on every run
+	countryKeys := make([]string, 0, len(locationData.CityData))
+	for key := range locationData.CityData {
+		countryKeys = append(countryKeys, key)
+	}
+	sort.Strings(countryKeys)
+	countryNames := make(map[string]string, len(countryKeys))
+
+	// Process city data
+	for _, key := range countryKeys {
+		value := locationData.CityData[key]
+		parts := strings.Split(key, "#")
+		if len(parts) != 2 {
+			continue
+		}
+		countryShort, countryName := parts[0], parts[1]
+
+		// States and cities of a duplicate are still added under the kept country
+		if kept, ok := countryNames[countryShort]; ok {
+			sm.logf("Warning: country %s is listed as both %q and %q; keeping %q", countryShort, kept, countryName, kept)
+		} else {
+			countryNames[countryShort] = countryName
+			allCountries = append(allCountries, Country{
+				Country:      countryName,
+				CountryShort: countryShort,
+				External:     false,
+				Used:         false,
+			})
+		}
+
+		for k, cities := range value {
+			stateParts := strings.Split(k, "##")
+			if len(stateParts) != 2 {
+				continue
+			}
+			stateShort, stateName := stateParts[0], stateParts[1]
+
+			allStates = append(allStates, State{
+				State:        stateName,
+				StateShort:   stateShort,
+				CountryShort: countryShort,
+				Used:         false,
+				External:     false,
+			})
+
+			// Extended data files carry county and coordinates per city
+			if details, ok := locationData.CityDetails[key][k]; ok {
+				for _, detail := range details {
+					allCities = append(allCities, City{
+						City:         detail.Name,
+						StateShort:   stateShort,
+						CountryShort: countryShort,
+						County:       detail.County,
+						Latitude:     detail.Latitude,
+						Longitude:    detail.Longitude,
+						Timezone:     detail.Timezone,
+						Used:         false,
+						External:     false,
+					})
+				}
+				continue
+			}
+
+			for _, city := range cities {
+				allCities = append(allCities, City{
+					City:         city,
+					StateShort:   stateShort,
+					CountryShort: countryShort,
+					Used:         false,
+					External:     false,
+				})
+			}
+		}
+	}
+
+	// Process zip data
+	for countryShort, zips := range locationData.ZipData {
+		zipStates := locationData.ZipStates[countryShort]
+		for _, zip := range zips {
+			var stateShort *string
+			if state, ok := zipStates[zip]; ok {
+				stateShort = &state
+			}
+
+			allZips = append(allZips, Zip{
+				CountryShort: countryShort,
+				Zip:          zip,
+				StateShort:   stateShort,
+				Used:         false,
+				External:     false,
+			})
+		}
+	}
+
+	// Insert data in one transaction, so a failure leaves the database as it was
+	err := sm.executeTransaction(func() error {
+		if err := sm.db.AddCountryMetadata(locationData.Countries); err != nil {
+			return err
+		}
+
+		// Large tables go in chunks so progress can be reported as they fill
+		err := sm.insertInChunks("countries", len(allCountries), func(start, end int) error {
+			return sm.db.AddCountries(allCountries[start:end], false)
+		})
+		if err != nil {
+			return err
+		}
+		err = sm.insertInChunks("states", len(allStates), func(start, end int) error {
+			return sm.db.AddStates(allStates[start:end], false)
+		})
+		if err != nil {
+			return err
+		}
+		err = sm.insertInChunks("cities", len(allCities), func(start, end int) error {
+			return sm.db.AddCities(allCities[start:end], false)
+		})
+		if err != nil {
+			return err
+		}
+		err = sm.insertInChunks("zips", len(allZips), func(start, end int) error {
+			return sm.db.AddZips(allZips[start:end], false)
+		})
+		if err != nil {
+			return err
+		}
+
+		// A reseed drops what the new file no longer lists, so the recorded hash holds
+		if _, err := sm.db.PruneBuiltinLocations(allCountries, allStates, allCities, allZips); err != nil || hash == "" {
+			return err
+		}
+		return sm.db.SetMetadata(dataHashKey, hash)
+	})
+	if err != nil {
+		return err
+	}
+	return sm.db.Checkpoint()
+}
+
+// insertChunkSize is the number of rows setDefault inserts per call
+const insertChunkSize = 5000
+
+// ensureData downloads the location data when neither the database nor a
+// location file holds any. The file goes to the path set with SetDataFilePath,
+// or location_data.json in the working directory.
+func (sm *StateManager) ensureData() error {
+	total, err := sm.db.CountTotal()
+	if err != nil {
+		return err
+	}
+	if total > 0 || IsDataPopulated() {
+		return nil
+	}
+
+	locationDataMu.Lock()
+	path := dataFilePath
+	fromFS := dataFS != nil
+	locationDataMu.Unlock()
+	if fromFS {
+		return fmt.Errorf("%w: the data file system has no location data", ErrNoData)
+	}
+	if path == "" {
+		path = "location_data.json"
+	}
+
+	if err := NewDataDownloader().DownloadAndProcessDataContext(sm.db.queryCtx(), path); err != nil {
+		return fmt.Errorf("failed to download location data: %w", err)
+	}
+	return nil
+}
+
+// SetPopulateProgress registers a callback that reports how many rows of each
+// table ("countries", "states", "cities", "zips") have been inserted while the
+// database is first populated during Init
+func (sm *StateManager) SetPopulateProgress(fn func(table string, done, total int)) {
+	sm.populateProgress = fn
+}
+
+// SetLogger sends warnings, such as duplicate countries in the data file, to
+// logger instead of standard output. Pass log.New(io.Discard, "", 0) to
+// silence them.
+func (sm *StateManager) SetLogger(logger *log.Logger) {
+	sm.logger = logger
+}
+
+// logf writes a warning to the logger, or to standard output
+func (sm *StateManager) logf(format string, args ...interface{}) {
+	if sm.logger != nil {
+		sm.logger.Printf(format, args...)
+		return
+	}
+	fmt.Printf(format+"\n", args...)
+}
+
+// insertInChunks calls insert for consecutive ranges of at most insertChunkSize rows
+func (sm *StateManager) insertInChunks(table string, total int, insert func(start, end int) error) error {
+	for start := 0; start < total; start += insertChunkSize {
+		end := start + insertChunkSize
+		if end > total {
+			end = total
+		}
+
+		if err := insert(start, end); err != nil {
+			return fmt.Errorf("failed to insert %s: %w", table, err)
+		}
+		// Uncommitted rows cannot be checkpointed; the transaction's owner does it
+		if sm.db.tx == nil {
+			if err := sm.db.Checkpoint(); err != nil {
+				return err
+			}
+		}
+
+		if sm.populateProgress != nil {
+			sm.populateProgress(table, end, total)
+		}
+	}
+	return nil
+}
+
+// executeTransaction executes a function within a database transaction. The
+// DB methods fn calls through sm.db join it instead of beginning their own, so
+// everything fn writes is committed together or, if fn fails, not at all.
+func (sm *StateManager) executeTransaction(fn func() error) error {
+	if sm.db.tx != nil {
+		return fn() // Already inside a transaction
+	}
+
+	db := sm.db
+	txDB, err := db.beginTx()
+	if err != nil {
+		return err
+	}
+
+	// Restore the handle and roll back even if fn panics; rollback is a no-op after commit
+	defer func() {
+		sm.db = db
+		txDB.rollback()
+	}()
+
+	sm.db = txDB
+	if err := fn(); err != nil {
+		return err
+	}
+	return txDB.commit()
+}
+
+// generateNavOrder generates the navigation order based on format
+func (sm *StateManager) generateNavOrder() error {
+	sm.navOrder = []Nav{}
+	sm.navSegments = []NavSegment{}
+	sm.countryCursors = make(map[string]int)
+	sm.navBase = 0
+
+	if sm.customOrder != nil {
+		sm.useCustomOrder()
+		return nil
+	}
+
+	if sm.isLazy() {
+		return sm.generateLazyNavOrder()
+	}
+
+	for _, country := range sm.countries {
+		start := len(sm.navOrder)
+		sm.appendCountryNavs(country, sm.getCitiesByCountry(country.CountryShort))
+
+		sm.navSegments = append(sm.navSegments, NavSegment{
+			CountryShort: country.CountryShort,
+			Start:        start,
+			End:          len(sm.navOrder),
+		})
+	}
+
+	sm.navTotal = len(sm.navOrder)
+	sm.indexNavOrder()
+	return nil
+}
+
+// useCustomOrder installs the order given to InitWithNavOrder, with a segment
+// for each run of consecutive items in the same country
+func (sm *StateManager) useCustomOrder() {
+	sm.navOrder = append([]Nav{}, sm.customOrder...)
+	for i, nav := range sm.navOrder {
+		countryShort := *nav.CountryShort
+		if n := len(sm.navSegments); n > 0 && sm.navSegments[n-1].CountryShort == countryShort {
+			sm.navSegments[n-1].End = i + 1
+			continue
+		}
+		sm.navSegments = append(sm.navSegments, NavSegment{CountryShort: countryShort, Start: i, End: i + 1})
+	}
+
+	sm.navTotal = len(sm.navOrder)
+	sm.indexNavOrder()
+}
+
+// isLazy reports whether cities or zips are loaded one country at a time
+func (sm *StateManager) isLazy() bool {
+	return sm.lazyCities || sm.lazyZips
+}
+
+// generateLazyNavOrder sizes each country's segment, by generating it from that
+// country's cities alone or, for InitLazy, from row counts, then discards the
+// items so that only one country is ever held in memory
+func (sm *StateManager) generateLazyNavOrder() error {
+	var counts *segmentCounts
+	if sm.lazySizes {
+		var err error
+		if counts, err = sm.loadSegmentCounts(); err != nil {
+			return err
+		}
+	}
+
+	total := 0
+	for _, country := range sm.countries {
+		var size int
+		if counts != nil {
+			size = sm.countCountryNavs(country.CountryShort, counts)
+		} else {
+			cities, err := sm.loadCountryCities(country.CountryShort)
+			if err != nil {
+				return err
+			}
+
+			sm.navOrder = []Nav{}
+			sm.appendCountryNavs(country, cities)
+			size = len(sm.navOrder)
+		}
+
+		sm.navSegments = append(sm.navSegments, NavSegment{
+			CountryShort: country.CountryShort,
+			Start:        total,
+			End:          total + size,
+		})
+		total += size
+	}
+
+	sm.navOrder = []Nav{}
+	sm.navIndex = nil
+	if sm.lazyCities {
+		sm.cities = nil
+	}
+	if sm.lazyZips {
+		sm.zips = nil
+	}
+	sm.navTotal = total
+
+	// Keep the country at the current position loaded
+	_, err := sm.navAt(sm.currentIndex)
+	return err
+}
+
+// segmentCounts holds the row counts InitLazy sizes segments from, keyed by
+// country then state code. Zips without a state are counted under "".
+type segmentCounts struct {
+	cities   map[string]map[string]int
+	counties map[string]map[string]int
+	zips     map[string]map[string]int
+}
+
+// loadSegmentCounts counts the cities and zips of every state in one query each
+func (sm *StateManager) loadSegmentCounts() (*segmentCounts, error) {
+	counts := &segmentCounts{}
+	if sm.lazyCities {
+		cities, counties, err := sm.db.countCitiesByState()
+		if err != nil {
+			return nil, err
+		}
+		counts.cities, counts.counties = cities, counties
+	}
+	if sm.lazyZips {
+		zips, err := sm.db.countZipsByState()
+		if err != nil {
+			return nil, err
+		}
+		counts.zips = zips
+	}
+	return counts, nil
+}
+
+// countCountryNavs returns how many items appendCountryNavs generates for a
+// country, computed from its loaded states and the row counts
+func (sm *StateManager) countCountryNavs(countryShort string, counts *segmentCounts) int {
+	format := *sm.format
+	states := sm.getStatesByCountry(countryShort)
+
+	// Items per query pass
+	var locations int
+	switch {
+	case formatUsesLevel(format, "zip"):
+		if formatUsesLevel(format, "state") {
+			for _, state := range states {
+				locations += counts.zips[countryShort][state.StateShort]
+			}
+			break
+		}
+		for stateShort, n := range counts.zips[countryShort] {
+			if stateShort == "" || !sm.stateExcluded(countryShort, stateShort) {
+				locations += n
+			}
+		}
+	case formatUsesLevel(format, "city"):
+		for _, state := range states {
+			locations += counts.cities[countryShort][state.StateShort]
+		}
+	case formatUsesLevel(format, "county"):
+		for _, state := range states {
+			locations += counts.counties[countryShort][state.StateShort]
+		}
+	case formatUsesLevel(format, "state"):
+		locations = len(states)
+	default:
+		locations = 1
+	}
+
+	if !strings.HasPrefix(string(format), "query-") {
+		if formatUsesLevel(format, "query") {
+			return 0 // Query formats without a location get no query passes
+		}
+		return locations
+	}
+
+	// appendCountryNavs runs each query once per unit of weight
+	passes := 0
+	for _, query := range sm.queries {
+		if query.Weight > 1 {
+			passes += query.Weight
+		} else {
+			passes++
+		}
+	}
+	return locations * passes
+}
+
+// appendCountryNavs appends the nav items for one country to navOrder
+func (sm *StateManager) appendCountryNavs(country Country, countryCities []City) {
+	countryStates := sm.getStatesByCountry(country.CountryShort)
+	countryZips := sm.getZipsByCountry(country.CountryShort)
+
+	if strings.HasPrefix(string(*sm.format), "query-") {
+		// Weighted round-robin: round r emits every query whose weight exceeds
+		// r, so all queries appear in the first round and a query of weight n
+		// is run n times over the country's locations
+		rounds := 1
+		for _, query := range sm.queries {
+			if query.Weight > rounds {
+				rounds = query.Weight
+			}
+		}
+		start := len(sm.navOrder)
+		var passes [][]Nav
+		for round := 0; round < rounds; round++ {
+			for _, query := range sm.queries {
+				if round > 0 && query.Weight <= round {
+					continue
+				}
+				query := query
+				passStart := len(sm.navOrder)
+				sm.addNavForQuery(&query, country, countryStates, countryCities, countryZips)
+				passes = append(passes, sm.navOrder[passStart:])
+			}
+		}
+
+		if sm.queryOrder == QueryOrderLocationMajor {
+			sm.interleavePasses(start, passes)
+		}
+	} else {
+		sm.addNavForQuery(nil, country, countryStates, countryCities, countryZips)
+	}
+}
+
+// interleavePasses rewrites navOrder from start so that, instead of one query
+// pass over every location after another, each location gets all of its
+// queries before the next location. Every pass covers the same locations in
+// the same order, so the result is as deterministic as the query-major order.
+func (sm *StateManager) interleavePasses(start int, passes [][]Nav) {
+	if len(passes) < 2 {
+		return
+	}
+
+	interleaved := make([]Nav, 0, len(sm.navOrder)-start)
+	for i := range passes[0] {
+		for _, pass := range passes {
+			if i < len(pass) {
+				interleaved = append(interleaved, pass[i])
+			}
+		}
+	}
+	sm.navOrder = append(sm.navOrder[:start], interleaved...)
+}
+
+// planKey identifies the navigation order that saved indices refer to. It is
+// the target country, qualified by the query order when that is not the
+// default and by any priority countries, or a digest of the list given to
+// InitWithNavOrder.
+func (sm *StateManager) planKey() string {
+	if sm.customOrder != nil {
+		return sm.customKey
+	}
+	key := sm.targetCountry
+	if sm.queryOrder == QueryOrderLocationMajor {
+		key += "|" + string(sm.queryOrder)
+	}
+	if len(sm.priorityCountries) > 0 {
+		key += "|priority:" + strings.Join(sm.priorityCountries, ",")
+	}
+	return key
+}
+
+// loadCountryCities loads the cities of one country within its loaded states
+func (sm *StateManager) loadCountryCities(countryShort string) ([]City, error) {
+	states := sm.getStatesByCountry(countryShort)
+	if len(states) == 0 {
+		return []City{}, nil
+	}
 
-			for _, city := range cities {
-				allCities = append(allCities, City{
-					City:         city,
-					StateShort:   stateShort,
-					CountryShort: countryShort,
-					Used:         false,
-					External:     false,
-				})
-			}
-		}
+	stateShorts := make([]string, len(states))
+	for i, s := range states {
+		stateShorts[i] = s.StateShort
 	}
+	return sm.db.GetCities([]string{countryShort}, stateShorts)
+}
 
-	// Process zip data
-	for countryShort, zips := range locationData.ZipData {
-		for _, zip := range zips {
-			allZips = append(allZips, Zip{
-				CountryShort: countryShort,
-				Zip:          zip,
-				Used:         false,
-				External:     false,
-			})
-		}
+// loadSegment replaces the loaded country in lazy mode, evicting the cities
+// and nav items of the previous one
+func (sm *StateManager) loadSegment(segment NavSegment) error {
+	if segment.Start == sm.navBase && len(sm.navOrder) > 0 {
+		return nil
 	}
 
-	// Insert data in transaction
-	return sm.executeTransaction(func() error {
-		if err := sm.db.AddCountries(allCountries, false); err != nil {
-			return err
-		}
-		if err := sm.db.AddStates(allStates, false); err != nil {
+	country := sm.findCountry(segment.CountryShort)
+	if country == nil {
+		return fmt.Errorf("country %s is not loaded", segment.CountryShort)
+	}
+
+	if sm.lazyCities {
+		cities, err := sm.loadCountryCities(country.CountryShort)
+		if err != nil {
 			return err
 		}
-		if err := sm.db.AddCities(allCities, false); err != nil {
+		sm.cities = cities
+	}
+	if sm.lazyZips {
+		zips, err := sm.db.GetZips([]string{country.CountryShort})
+		if err != nil {
 			return err
 		}
-		return sm.db.AddZips(allZips, false)
-	})
+		sm.zips = sm.zipsWithoutExcluded(zips)
+	}
+
+	sm.navOrder = []Nav{}
+	sm.appendCountryNavs(*country, sm.getCitiesByCountry(country.CountryShort))
+	sm.navBase = segment.Start
+	sm.indexNavOrder()
+
+	if len(sm.navOrder) != segment.End-segment.Start {
+		return fmt.Errorf("navigation items for country %s changed since the order was generated", segment.CountryShort)
+	}
+	return nil
 }
 
-// executeTransaction executes a function within a database transaction
-func (sm *StateManager) executeTransaction(fn func() error) error {
-	return fn() // Simplified - individual methods handle transactions
+// indexNavOrder rebuilds navIndex for the loaded part of navOrder
+func (sm *StateManager) indexNavOrder() {
+	sm.navIndex = make(map[string][]int, len(sm.navOrder))
+	for i, nav := range sm.navOrder {
+		key := nav.Key()
+		sm.navIndex[key] = append(sm.navIndex[key], sm.navBase+i)
+	}
 }
 
-// generateNavOrder generates the navigation order based on format
-func (sm *StateManager) generateNavOrder() {
-	sm.navOrder = []Nav{}
+// lookupNavIndex returns the global index of the loaded occurrence of key
+// closest to near, preferring the later one on a tie since items added ahead
+// of a position push it forward. A negative near selects the first occurrence.
+func (sm *StateManager) lookupNavIndex(key string, near int) (int, bool) {
+	indices := sm.navIndex[key]
+	if len(indices) == 0 {
+		return 0, false
+	}
+	if near < 0 {
+		return indices[0], true
+	}
 
-	for _, country := range sm.countries {
-		countryStates := sm.getStatesByCountry(country.CountryShort)
-		stateShorts := make([]string, len(countryStates))
-		for i, s := range countryStates {
-			stateShorts[i] = s.StateShort
-		}
+	i := sort.SearchInts(indices, near)
+	if i == len(indices) {
+		return indices[i-1], true
+	}
+	if i > 0 && near-indices[i-1] < indices[i]-near {
+		return indices[i-1], true
+	}
+	return indices[i], true
+}
 
-		countryCities := sm.getCitiesByCountry(country.CountryShort)
-		countryZips := sm.getZipsByCountry(country.CountryShort)
+// navAt returns the nav item at a global index, loading its country in lazy
+// mode. It returns nil when the index is out of range.
+func (sm *StateManager) navAt(index int) (*Nav, error) {
+	if index < 0 || index >= sm.navTotal {
+		return nil, nil
+	}
 
-		if strings.HasPrefix(string(*sm.format), "query-") {
-			for _, query := range sm.queries {
-				sm.addNavForQuery(&query, country, countryStates, countryCities, countryZips)
+	if sm.isLazy() && (index < sm.navBase || index >= sm.navBase+len(sm.navOrder)) {
+		for _, segment := range sm.navSegments {
+			if index >= segment.Start && index < segment.End {
+				if err := sm.loadSegment(segment); err != nil {
+					return nil, err
+				}
+				break
 			}
-		} else {
-			sm.addNavForQuery(nil, country, countryStates, countryCities, countryZips)
 		}
 	}
+
+	return &sm.navOrder[index-sm.navBase], nil
+}
+
+// NavSegments returns the range of navOrder indices belonging to each country
+func (sm *StateManager) NavSegments() []NavSegment {
+	return sm.navSegments
+}
+
+// NavCountsByCountry returns how many nav items each country contributes to
+// the navigation order under the current format
+func (sm *StateManager) NavCountsByCountry() map[string]int {
+	counts := make(map[string]int, len(sm.navSegments))
+	for _, segment := range sm.navSegments {
+		counts[segment.CountryShort] += segment.End - segment.Start
+	}
+	return counts
+}
+
+// findSegment returns the nav segment for a country
+func (sm *StateManager) findSegment(countryShort string) *NavSegment {
+	for i := range sm.navSegments {
+		if sm.navSegments[i].CountryShort == countryShort {
+			return &sm.navSegments[i]
+		}
+	}
+	return nil
 }
 
 // Helper methods for filtering data
@@ -278,77 +1679,155 @@ func (sm *StateManager) findStateByShort(stateShort string, states []State) *Sta
 	return nil
 }
 
+// appendZipNav appends a zip nav, attaching the zip's state when it was
+// enriched with one that is part of the loaded states
+func (sm *StateManager) appendZipNav(nav Nav, zip Zip, states []State) {
+	if zip.StateShort != nil {
+		if state := sm.findStateByShort(*zip.StateShort, states); state != nil {
+			nav.State = &state.State
+			nav.StateShort = &state.StateShort
+		}
+	}
+	sm.navOrder = append(sm.navOrder, nav)
+}
+
+// appendZipStateNavs appends a nav for every zip whose state is among the
+// loaded states. Zips without a state cannot be placed in one and are skipped.
+func (sm *StateManager) appendZipStateNavs(query *Query, country Country, states []State, zips []Zip) {
+	for _, zip := range zips {
+		zip := zip
+		if zip.StateShort == nil {
+			continue
+		}
+		state := sm.findStateByShort(*zip.StateShort, states)
+		if state == nil {
+			continue
+		}
+
+		nav := Nav{
+			Zip:          &zip.Zip,
+			State:        &state.State,
+			StateShort:   &state.StateShort,
+			Country:      &country.Country,
+			CountryShort: &country.CountryShort,
+		}
+		if query != nil {
+			nav.Query = &query.Query
+		}
+		sm.navOrder = append(sm.navOrder, nav)
+	}
+}
+
 // addNavForQuery adds navigation entries for a specific query
 func (sm *StateManager) addNavForQuery(query *Query, country Country, states []State, cities []City, zips []Zip) {
 	switch *sm.format {
 	case NavFormatZip:
 		for _, zip := range zips {
-			sm.navOrder = append(sm.navOrder, Nav{
-				Zip:     &zip.Zip,
-				Country: &country.CountryShort,
-			})
+			zip := zip
+			sm.appendZipNav(Nav{
+				Zip:          &zip.Zip,
+				Country:      &country.Country,
+				CountryShort: &country.CountryShort,
+			}, zip, states)
 		}
 
 	case NavFormatZipCountry:
 		for _, zip := range zips {
-			sm.navOrder = append(sm.navOrder, Nav{
+			zip := zip
+			sm.appendZipNav(Nav{
 				Zip:          &zip.Zip,
-				Country:      &country.CountryShort,
+				Country:      &country.Country,
 				CountryShort: &country.CountryShort,
-			})
+			}, zip, states)
 		}
 
 	case NavFormatQueryZip:
 		if query != nil {
 			for _, zip := range zips {
-				sm.navOrder = append(sm.navOrder, Nav{
-					Query:   &query.Query,
-					Zip:     &zip.Zip,
-					Country: &country.CountryShort,
-				})
+				zip := zip
+				sm.appendZipNav(Nav{
+					Query:        &query.Query,
+					Zip:          &zip.Zip,
+					Country:      &country.Country,
+					CountryShort: &country.CountryShort,
+				}, zip, states)
 			}
 		}
 
 	case NavFormatQueryZipCountry:
 		if query != nil {
 			for _, zip := range zips {
-				sm.navOrder = append(sm.navOrder, Nav{
+				zip := zip
+				sm.appendZipNav(Nav{
 					Query:        &query.Query,
 					Zip:          &zip.Zip,
-					Country:      &country.CountryShort,
+					Country:      &country.Country,
 					CountryShort: &country.CountryShort,
-				})
+				}, zip, states)
 			}
 		}
 
+	case NavFormatZipState:
+		sm.appendZipStateNavs(nil, country, states, zips)
+
+	case NavFormatQueryZipState:
+		if query != nil {
+			sm.appendZipStateNavs(query, country, states, zips)
+		}
+
 	case NavFormatCity:
 		for _, city := range cities {
+			city := city
 			sm.navOrder = append(sm.navOrder, Nav{
-				City:    &city.City,
-				Country: &country.CountryShort,
+				City:         &city.City,
+				Country:      &country.Country,
+				CountryShort: &country.CountryShort,
 			})
 		}
 
 	case NavFormatCityState:
 		for _, city := range cities {
+			city := city
 			if state := sm.findStateByShort(city.StateShort, states); state != nil {
 				sm.navOrder = append(sm.navOrder, Nav{
-					City:       &city.City,
-					State:      &state.State,
-					StateShort: &state.StateShort,
-					Country:    &country.CountryShort,
+					City:         &city.City,
+					State:        &state.State,
+					StateShort:   &state.StateShort,
+					Country:      &country.Country,
+					CountryShort: &country.CountryShort,
 				})
 			}
 		}
 
 	case NavFormatCityStateCountry:
 		for _, city := range cities {
+			city := city
 			if state := sm.findStateByShort(city.StateShort, states); state != nil {
 				sm.navOrder = append(sm.navOrder, Nav{
 					City:         &city.City,
 					State:        &state.State,
 					StateShort:   &state.StateShort,
-					Country:      &country.CountryShort,
+					Country:      &country.Country,
+					CountryShort: &country.CountryShort,
+				})
+			}
+		}
+
+	case NavFormatStateCity:
+		// State-major: every city of a state before moving to the next state
+		citiesByState := make(map[string][]City)
+		for _, city := range cities {
+			citiesByState[city.StateShort] = append(citiesByState[city.StateShort], city)
+		}
+		for _, state := range states {
+			state := state
+			for _, city := range citiesByState[state.StateShort] {
+				city := city
+				sm.navOrder = append(sm.navOrder, Nav{
+					City:         &city.City,
+					State:        &state.State,
+					StateShort:   &state.StateShort,
+					Country:      &country.Country,
 					CountryShort: &country.CountryShort,
 				})
 			}
@@ -357,10 +1836,12 @@ func (sm *StateManager) addNavForQuery(query *Query, country Country, states []S
 	case NavFormatQueryCity:
 		if query != nil {
 			for _, city := range cities {
+				city := city
 				sm.navOrder = append(sm.navOrder, Nav{
-					Query:   &query.Query,
-					City:    &city.City,
-					Country: &country.CountryShort,
+					Query:        &query.Query,
+					City:         &city.City,
+					Country:      &country.Country,
+					CountryShort: &country.CountryShort,
 				})
 			}
 		}
@@ -368,13 +1849,15 @@ func (sm *StateManager) addNavForQuery(query *Query, country Country, states []S
 	case NavFormatQueryCityState:
 		if query != nil {
 			for _, city := range cities {
+				city := city
 				if state := sm.findStateByShort(city.StateShort, states); state != nil {
 					sm.navOrder = append(sm.navOrder, Nav{
-						Query:      &query.Query,
-						City:       &city.City,
-						State:      &state.State,
-						StateShort: &state.StateShort,
-						Country:    &country.CountryShort,
+						Query:        &query.Query,
+						City:         &city.City,
+						State:        &state.State,
+						StateShort:   &state.StateShort,
+						Country:      &country.Country,
+						CountryShort: &country.CountryShort,
 					})
 				}
 			}
@@ -383,13 +1866,14 @@ func (sm *StateManager) addNavForQuery(query *Query, country Country, states []S
 	case NavFormatQueryCityStateCountry:
 		if query != nil {
 			for _, city := range cities {
+				city := city
 				if state := sm.findStateByShort(city.StateShort, states); state != nil {
 					sm.navOrder = append(sm.navOrder, Nav{
 						Query:        &query.Query,
 						City:         &city.City,
 						State:        &state.State,
 						StateShort:   &state.StateShort,
-						Country:      &country.CountryShort,
+						Country:      &country.Country,
 						CountryShort: &country.CountryShort,
 					})
 				}
@@ -398,19 +1882,22 @@ func (sm *StateManager) addNavForQuery(query *Query, country Country, states []S
 
 	case NavFormatState:
 		for _, state := range states {
+			state := state
 			sm.navOrder = append(sm.navOrder, Nav{
-				State:      &state.State,
-				StateShort: &state.StateShort,
-				Country:    &country.CountryShort,
+				State:        &state.State,
+				StateShort:   &state.StateShort,
+				Country:      &country.Country,
+				CountryShort: &country.CountryShort,
 			})
 		}
 
 	case NavFormatStateCountry:
 		for _, state := range states {
+			state := state
 			sm.navOrder = append(sm.navOrder, Nav{
 				State:        &state.State,
 				StateShort:   &state.StateShort,
-				Country:      &country.CountryShort,
+				Country:      &country.Country,
 				CountryShort: &country.CountryShort,
 			})
 		}
@@ -418,11 +1905,13 @@ func (sm *StateManager) addNavForQuery(query *Query, country Country, states []S
 	case NavFormatQueryState:
 		if query != nil {
 			for _, state := range states {
+				state := state
 				sm.navOrder = append(sm.navOrder, Nav{
-					Query:      &query.Query,
-					State:      &state.State,
-					StateShort: &state.StateShort,
-					Country:    &country.CountryShort,
+					Query:        &query.Query,
+					State:        &state.State,
+					StateShort:   &state.StateShort,
+					Country:      &country.Country,
+					CountryShort: &country.CountryShort,
 				})
 			}
 		}
@@ -430,11 +1919,12 @@ func (sm *StateManager) addNavForQuery(query *Query, country Country, states []S
 	case NavFormatQueryStateCountry:
 		if query != nil {
 			for _, state := range states {
+				state := state
 				sm.navOrder = append(sm.navOrder, Nav{
 					Query:        &query.Query,
 					State:        &state.State,
 					StateShort:   &state.StateShort,
-					Country:      &country.CountryShort,
+					Country:      &country.Country,
 					CountryShort: &country.CountryShort,
 				})
 			}
@@ -443,11 +1933,13 @@ func (sm *StateManager) addNavForQuery(query *Query, country Country, states []S
 	case NavFormatQueryCounty:
 		if query != nil {
 			for _, city := range cities {
+				city := city
 				if city.County != nil {
 					sm.navOrder = append(sm.navOrder, Nav{
-						Query:   &query.Query,
-						County:  city.County,
-						Country: &country.CountryShort,
+						Query:        &query.Query,
+						County:       city.County,
+						Country:      &country.Country,
+						CountryShort: &country.CountryShort,
 					})
 				}
 			}
@@ -456,17 +1948,20 @@ func (sm *StateManager) addNavForQuery(query *Query, country Country, states []S
 	case NavFormatQuery:
 		if query != nil {
 			sm.navOrder = append(sm.navOrder, Nav{
-				Query:   &query.Query,
-				Country: &country.CountryShort,
+				Query:        &query.Query,
+				Country:      &country.Country,
+				CountryShort: &country.CountryShort,
 			})
 		}
 
 	case NavFormatCounty:
 		for _, city := range cities {
+			city := city
 			if city.County != nil {
 				sm.navOrder = append(sm.navOrder, Nav{
-					County:  city.County,
-					Country: &country.CountryShort,
+					County:       city.County,
+					Country:      &country.Country,
+					CountryShort: &country.CountryShort,
 				})
 			}
 		}
@@ -475,13 +1970,23 @@ func (sm *StateManager) addNavForQuery(query *Query, country Country, states []S
 
 // restoreOrStartSession restores existing session or starts new one
 func (sm *StateManager) restoreOrStartSession() error {
-	session, err := sm.db.GetCurrentNavSession()
+	session, err := sm.db.GetResumableNavSession(string(*sm.format), sm.planKey())
 	if err != nil {
 		return err
 	}
 
+	sm.sessionID = 0
 	if session != nil {
 		// Restore existing session
+		sm.sessionID = session.ID
+		if sm.isLazy() {
+			if segment := sm.findSegment(session.CountryShort); segment != nil && segment.End > segment.Start {
+				if err := sm.loadSegment(*segment); err != nil {
+					return err
+				}
+			}
+		}
+
 		country := sm.findCountry(session.CountryShort)
 		var query *Query
 		var zip *Zip
@@ -501,11 +2006,33 @@ func (sm *StateManager) restoreOrStartSession() error {
 			state = sm.findState(*session.StateShort)
 		}
 
-		sm.currentIndex = sm.findNavIndex(*session, country, query, zip, city, state)
+		index, found, err := sm.restoreNavIndex(session.NavIndex, country, query, zip, city, state)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return sm.relocateSession(*session)
+		}
+		if session.NavIndex == nil || *session.NavIndex != index {
+			// Keep the recorded position current in case the nav is removed later
+			if err := sm.db.UpdateNavSession(session.ID, map[string]interface{}{"navIndex": index}); err != nil {
+				return err
+			}
+			if err := sm.db.SaveNavCursor(string(*sm.format), sm.planKey(), index); err != nil {
+				return err
+			}
+		}
+		sm.currentIndex = index
 		sm.currentNav = sm.buildNavResponse(*session, country, query, zip, city, state)
+		sm.currentNav.Used = sm.usedLevels(sm.currentNav.Nav)
 	} else {
-		// Start new session
-		sm.currentNav = sm.buildNavResponseFromIndex(0)
+		// Start new session at the first item not finished earlier
+		sm.currentIndex = sm.nextOpenIndex(0, sm.navTotal)
+		currentNav, err := sm.buildCurrentNav(sm.currentIndex)
+		if err != nil {
+			return err
+		}
+		sm.currentNav = currentNav
 		if sm.currentNav != nil {
 			return sm.saveCurrentSession()
 		}
@@ -560,14 +2087,107 @@ func (sm *StateManager) findState(stateShort string) *State {
 	return nil
 }
 
-// findNavIndex finds the index of a navigation item
-func (sm *StateManager) findNavIndex(session NavSession, country *Country, query *Query, zip *Zip, city *City, state *State) int {
-	for i, nav := range sm.navOrder {
-		if sm.navMatches(nav, country, query, zip, city, state) {
-			return i
+// restoreNavIndex locates the restored session's nav. The index recorded on
+// the session and then the persisted cursor are trusted when they still point
+// at a matching nav; otherwise the session's entities are looked up, taking
+// the occurrence closest to the recorded position so a nav repeated by a
+// weighted query resumes in the right pass. found is false when none locates it.
+func (sm *StateManager) restoreNavIndex(recorded *int, country *Country, query *Query, zip *Zip, city *City, state *State) (index int, found bool, err error) {
+	// Only the loaded window is checked, which in lazy mode is the session's country
+	matches := func(index int) bool {
+		loaded := index - sm.navBase
+		return loaded >= 0 && loaded < len(sm.navOrder) && sm.navMatches(sm.navOrder[loaded], country, query, zip, city, state)
+	}
+
+	near := -1
+	if recorded != nil {
+		if matches(*recorded) {
+			return *recorded, true, nil
+		}
+		near = *recorded
+	}
+
+	cursor, ok, err := sm.db.GetNavCursor(string(*sm.format), sm.planKey())
+	if err != nil {
+		return 0, false, err
+	}
+	if ok {
+		if matches(cursor) {
+			return cursor, true, nil
+		}
+		if near < 0 {
+			near = cursor
+		}
+	}
+
+	index, found = sm.findNavIndex(near, country, query, zip, city, state)
+	return index, found, nil
+}
+
+// relocateSession resumes near a session whose nav is no longer in the
+// navigation order, for example after its entities were removed. Navigation
+// continues from the position the session was served at, or the saved cursor,
+// in a fresh session; the stale one is dropped. Without either position it
+// fails with ErrSessionMismatch rather than restarting from the beginning.
+func (sm *StateManager) relocateSession(session NavSession) error {
+	index := -1
+	if session.NavIndex != nil {
+		index = *session.NavIndex
+	} else {
+		cursor, ok, err := sm.db.GetNavCursor(string(*sm.format), sm.planKey())
+		if err != nil {
+			return err
+		}
+		if ok {
+			index = cursor
 		}
 	}
-	return 0
+	if index < 0 {
+		return fmt.Errorf("%w: session %d is at an unknown position; call ResetNav to start over", ErrSessionMismatch, session.ID)
+	}
+	if index >= sm.navTotal {
+		index = sm.navTotal - 1
+	}
+	if index < 0 {
+		index = 0
+	}
+
+	sm.logf("Warning: session %d no longer matches the navigation order; resuming at index %d", session.ID, index)
+	if err := sm.db.DeleteNavSession(session.ID); err != nil {
+		return err
+	}
+
+	sm.sessionID = 0
+	sm.currentIndex = sm.nextOpenIndex(index, sm.navTotal)
+	currentNav, err := sm.buildCurrentNav(sm.currentIndex)
+	if err != nil {
+		return err
+	}
+	sm.currentNav = currentNav
+	return sm.saveCurrentSession()
+}
+
+// findNavIndex finds the index of a navigation item closest to near,
+// reporting whether it is in the loaded part of navOrder
+func (sm *StateManager) findNavIndex(near int, country *Country, query *Query, zip *Zip, city *City, state *State) (int, bool) {
+	nav := Nav{}
+	if query != nil {
+		nav.Query = &query.Query
+	}
+	if zip != nil {
+		nav.Zip = &zip.Zip
+	}
+	if city != nil {
+		nav.City = &city.City
+	}
+	if state != nil {
+		nav.State = &state.State
+	}
+	if country != nil {
+		nav.CountryShort = &country.CountryShort
+	}
+
+	return sm.lookupNavIndex(nav.Key(), near)
 }
 
 // navMatches checks if a nav item matches the given entities
@@ -576,7 +2196,7 @@ func (sm *StateManager) navMatches(nav Nav, country *Country, query *Query, zip
 	zipMatch := (nav.Zip == nil && zip == nil) || (nav.Zip != nil && zip != nil && *nav.Zip == zip.Zip)
 	cityMatch := (nav.City == nil && city == nil) || (nav.City != nil && city != nil && *nav.City == city.City)
 	stateMatch := (nav.State == nil && state == nil) || (nav.State != nil && state != nil && *nav.State == state.State)
-	countryMatch := (nav.Country == nil && country == nil) || (nav.Country != nil && country != nil && *nav.Country == country.CountryShort)
+	countryMatch := (nav.CountryShort == nil && country == nil) || (nav.CountryShort != nil && country != nil && *nav.CountryShort == country.CountryShort)
 
 	return queryMatch && zipMatch && cityMatch && stateMatch && countryMatch
 }
@@ -623,18 +2243,21 @@ func (sm *StateManager) buildNavResponse(session NavSession, country *Country, q
 		Country:     countryShort,
 		Placeholder: sm.generatePlaceholder(nav),
 		Page:        page,
-		HasNext:     sm.currentIndex < len(sm.navOrder)-1,
+		HasNext:     sm.currentIndex < sm.navTotal-1,
+		Index:       sm.currentIndex,
+		Total:       sm.navTotal,
 	}
 }
 
 // buildNavResponseFromIndex builds a navigation response from an index
-func (sm *StateManager) buildNavResponseFromIndex(index int) *NavResponse {
-	if index >= len(sm.navOrder) {
-		return nil
+func (sm *StateManager) buildNavResponseFromIndex(index int) (*NavResponse, error) {
+	navItem, err := sm.navAt(index)
+	if err != nil || navItem == nil {
+		return nil, err
 	}
 
-	nav := sm.navOrder[index]
-	country := sm.findCountry(*nav.Country)
+	nav := *navItem
+	country := sm.findCountry(*nav.CountryShort)
 
 	countryName := ""
 	if country != nil {
@@ -647,8 +2270,113 @@ func (sm *StateManager) buildNavResponseFromIndex(index int) *NavResponse {
 		Country:     countryName,
 		Placeholder: sm.generatePlaceholder(nav),
 		Page:        nil,
-		HasNext:     index < len(sm.navOrder)-1,
+		HasNext:     index < sm.navTotal-1,
+		Index:       index,
+		Total:       sm.navTotal,
+	}, nil
+}
+
+// buildCurrentNav builds the response for the nav that is about to become
+// current, including the used status of its entities
+func (sm *StateManager) buildCurrentNav(index int) (*NavResponse, error) {
+	resp, err := sm.buildNavResponseFromIndex(index)
+	if err != nil || resp == nil {
+		return resp, err
+	}
+
+	resp.Used = sm.usedLevels(resp.Nav)
+	return resp, nil
+}
+
+// ResolveNav builds the response the crawler would produce for a hand-made
+// nav: the country code is normalized, the country and state names are filled
+// in from the loaded data, and the placeholder is generated for the active
+// format. Navigation state, including currentIndex, is left untouched.
+func (sm *StateManager) ResolveNav(nav Nav) (*NavResponse, error) {
+	if sm.format == nil {
+		return nil, fmt.Errorf("state manager not initialized")
+	}
+	if nav.CountryShort == nil {
+		return nil, fmt.Errorf("nav has no country")
+	}
+
+	countryShort := strings.ToUpper(strings.TrimSpace(*nav.CountryShort))
+	country := sm.findCountry(countryShort)
+	if country == nil {
+		return nil, fmt.Errorf("country %s is not loaded", countryShort)
+	}
+	nav.Country = &country.Country
+	nav.CountryShort = &country.CountryShort
+
+	if nav.StateShort != nil && nav.State == nil {
+		if state := sm.findStateByShort(*nav.StateShort, sm.getStatesByCountry(countryShort)); state != nil {
+			nav.State = &state.State
+		}
+	} else if nav.State != nil && nav.StateShort == nil {
+		for _, state := range sm.getStatesByCountry(countryShort) {
+			if state.State == *nav.State {
+				stateShort := state.StateShort
+				nav.StateShort = &stateShort
+				break
+			}
+		}
+	}
+
+	index, ok := sm.lookupNavIndex(nav.Key(), -1)
+	if !ok {
+		index = -1
+	}
+
+	return &NavResponse{
+		Format:      *sm.format,
+		Nav:         nav,
+		Country:     country.CountryShort,
+		Placeholder: sm.generatePlaceholder(nav),
+		Page:        nil,
+		HasNext:     index >= 0 && index < sm.navTotal-1,
+		Index:       index,
+		Total:       sm.navTotal,
+		Used:        sm.usedLevels(nav),
+	}, nil
+}
+
+// usedLevels looks up the used flag of each entity in a nav as loaded from
+// the database, so it reflects visits made before the entities were loaded
+func (sm *StateManager) usedLevels(nav Nav) map[string]bool {
+	used := make(map[string]bool)
+
+	if nav.Query != nil {
+		if query := sm.findQueryByText(*nav.Query); query != nil {
+			used["query"] = query.Used
+		}
+	}
+	if nav.Zip != nil {
+		if zip := sm.findZipByText(*nav.Zip); zip != nil {
+			used["zip"] = zip.Used
+		}
+	}
+	if nav.City != nil {
+		for _, city := range sm.cities {
+			if city.City == *nav.City &&
+				(nav.StateShort == nil || city.StateShort == *nav.StateShort) &&
+				(nav.CountryShort == nil || city.CountryShort == *nav.CountryShort) {
+				used["city"] = city.Used
+				break
+			}
+		}
 	}
+	if nav.StateShort != nil && nav.CountryShort != nil {
+		if state := sm.findStateByShort(*nav.StateShort, sm.getStatesByCountry(*nav.CountryShort)); state != nil {
+			used["state"] = state.Used
+		}
+	}
+	if nav.CountryShort != nil {
+		if country := sm.findCountry(*nav.CountryShort); country != nil {
+			used["country"] = country.Used
+		}
+	}
+
+	return used
 }
 
 // generatePlaceholder generates a placeholder string from navigation data
@@ -662,6 +2390,10 @@ func (sm *StateManager) generatePlaceholder(nav Nav) string {
 		parts = append(parts, *nav.City)
 	} else if nav.Zip != nil {
 		parts = append(parts, *nav.Zip)
+		// Zip-state formats qualify the zip, which may repeat across states
+		if nav.State != nil && sm.format != nil && (*sm.format == NavFormatZipState || *sm.format == NavFormatQueryZipState) {
+			parts = append(parts, *nav.State)
+		}
 	} else if nav.State != nil {
 		parts = append(parts, *nav.State)
 	} else if nav.County != nil {
@@ -675,43 +2407,58 @@ func (sm *StateManager) generatePlaceholder(nav Nav) string {
 	return strings.Join(parts, "##")
 }
 
-// saveCurrentSession saves the current navigation session
-func (sm *StateManager) saveCurrentSession() error {
-	if sm.currentNav == nil {
-		return nil
+// CompletedPlaceholders returns the placeholders of every completed session,
+// for skipping work already done when merging results across runs
+func (sm *StateManager) CompletedPlaceholders() ([]string, error) {
+	navs, err := sm.db.GetCompletedNavs()
+	if err != nil {
+		return nil, err
 	}
 
-	country := sm.findCountry(sm.currentNav.Country)
-	var query *Query
-	var zip *Zip
-	var city *City
-	var state *State
-
-	if sm.currentNav.Nav.Query != nil {
-		query = sm.findQueryByText(*sm.currentNav.Nav.Query)
+	placeholders := make([]string, len(navs))
+	for i, nav := range navs {
+		placeholders[i] = sm.generatePlaceholder(nav)
 	}
-	if sm.currentNav.Nav.Zip != nil {
-		zip = sm.findZipByText(*sm.currentNav.Nav.Zip)
+	return placeholders, nil
+}
+
+// CompletedPlaceholderSet is CompletedPlaceholders as a set for membership checks
+func (sm *StateManager) CompletedPlaceholderSet() (map[string]bool, error) {
+	placeholders, err := sm.CompletedPlaceholders()
+	if err != nil {
+		return nil, err
 	}
-	if sm.currentNav.Nav.City != nil {
-		city = sm.findCityByText(*sm.currentNav.Nav.City)
+
+	set := make(map[string]bool, len(placeholders))
+	for _, p := range placeholders {
+		set[p] = true
 	}
-	if sm.currentNav.Nav.StateShort != nil {
-		state = sm.findState(*sm.currentNav.Nav.StateShort)
+	return set, nil
+}
+
+// saveCurrentSession saves the current navigation session
+func (sm *StateManager) saveCurrentSession() error {
+	if sm.currentNav == nil {
+		return nil
 	}
 
+	country, query, zip, city, state := sm.navEntities(sm.currentNav.Country, sm.currentNav.Nav)
+
 	pageJSON := ""
 	if sm.currentNav.Page != nil {
 		pageBytes, _ := json.Marshal(sm.currentNav.Page)
 		pageJSON = string(pageBytes)
 	}
 
+	targetCountry, navIndex := sm.planKey(), sm.currentIndex
 	session := NavSession{
-		Format:       string(sm.currentNav.Format),
-		CountryShort: country.CountryShort,
-		Page:         pageJSON,
-		Completed:    false,
-		External:     true,
+		Format:        string(sm.currentNav.Format),
+		CountryShort:  country.CountryShort,
+		Page:          pageJSON,
+		Completed:     false,
+		External:      true,
+		TargetCountry: &targetCountry,
+		NavIndex:      &navIndex,
 	}
 
 	if query != nil && query.ID != nil {
@@ -727,7 +2474,13 @@ func (sm *StateManager) saveCurrentSession() error {
 		session.StateShort = &state.StateShort
 	}
 
-	if err := sm.db.SaveNavSession(session); err != nil {
+	sessionID, err := sm.db.upsertNavSession(session)
+	if err != nil {
+		return err
+	}
+	sm.sessionID = sessionID
+
+	if err := sm.db.SaveNavCursor(string(sm.currentNav.Format), sm.planKey(), sm.currentIndex); err != nil {
 		return err
 	}
 
@@ -735,6 +2488,33 @@ func (sm *StateManager) saveCurrentSession() error {
 	return sm.markEntitiesAsUsed(country, query, zip, city, state)
 }
 
+// navEntities resolves the loaded entities a nav item refers to, as recorded
+// in its session row
+func (sm *StateManager) navEntities(countryShort string, nav Nav) (country *Country, query *Query, zip *Zip, city *City, state *State) {
+	country = sm.findCountry(countryShort)
+	if nav.Query != nil {
+		query = sm.findQueryByText(*nav.Query)
+	}
+	if nav.Zip != nil {
+		zip = sm.findZipByText(*nav.Zip)
+	}
+	if nav.City != nil {
+		city = sm.findCityByText(*nav.City)
+	}
+	if nav.StateShort != nil {
+		state = sm.findState(*nav.StateShort)
+	}
+	return country, query, zip, city, state
+}
+
+// currentSession returns the session row backing currentNav, if any
+func (sm *StateManager) currentSession() (*NavSession, error) {
+	if sm.sessionID == 0 {
+		return nil, nil
+	}
+	return sm.db.GetNavSession(sm.sessionID)
+}
+
 // Helper methods for finding entities by text
 func (sm *StateManager) findQueryByText(queryText string) *Query {
 	for _, q := range sm.queries {
@@ -766,36 +2546,31 @@ func (sm *StateManager) findCityByText(cityText string) *City {
 // markEntitiesAsUsed marks entities as used in the database
 func (sm *StateManager) markEntitiesAsUsed(country *Country, query *Query, zip *Zip, city *City, state *State) error {
 	if country != nil {
-		_, err := sm.db.db.Exec(`UPDATE countries SET used = 1 WHERE countryShort = ?`, country.CountryShort)
-		if err != nil {
+		if err := sm.db.MarkCountriesUsed([]string{country.CountryShort}); err != nil {
 			return err
 		}
 	}
 
 	if query != nil && query.ID != nil {
-		_, err := sm.db.db.Exec(`UPDATE queries SET used = 1 WHERE id = ?`, *query.ID)
-		if err != nil {
+		if err := sm.db.MarkQueriesUsed([]int{*query.ID}); err != nil {
 			return err
 		}
 	}
 
 	if zip != nil && zip.ID != nil {
-		_, err := sm.db.db.Exec(`UPDATE zips SET used = 1 WHERE id = ?`, *zip.ID)
-		if err != nil {
+		if err := sm.db.MarkZipsUsed([]int{*zip.ID}); err != nil {
 			return err
 		}
 	}
 
 	if city != nil && city.ID != nil {
-		_, err := sm.db.db.Exec(`UPDATE cities SET used = 1 WHERE id = ?`, *city.ID)
-		if err != nil {
+		if err := sm.db.MarkCitiesUsed([]int{*city.ID}); err != nil {
 			return err
 		}
 	}
 
 	if state != nil {
-		_, err := sm.db.db.Exec(`UPDATE states SET used = 1 WHERE stateShort = ? AND countryShort = ?`, state.StateShort, state.CountryShort)
-		if err != nil {
+		if err := sm.db.MarkStatesUsed([]State{*state}); err != nil {
 			return err
 		}
 	}
@@ -808,19 +2583,350 @@ func (sm *StateManager) GetNav() *NavResponse {
 	return sm.currentNav
 }
 
+// GetNextNavContext is GetNextNav with its queries bounded by ctx
+func (sm *StateManager) GetNextNavContext(ctx context.Context) (*NavResponse, error) {
+	defer sm.bindContext(ctx)()
+	return sm.GetNextNav()
+}
+
 // GetNextNav gets the next navigation item
 func (sm *StateManager) GetNextNav() (*NavResponse, error) {
-	session, err := sm.db.GetCurrentNavSession()
+	session, err := sm.currentSession()
+	if err != nil {
+		return nil, err
+	}
+	if err := sm.autoComplete(session); err != nil {
+		return nil, err
+	}
+
+	if session != nil && !session.Completed {
+		return sm.currentNav, nil
+	}
+	if sm.limitReached() {
+		return nil, nil
+	}
+
+	sm.currentIndex = sm.nextOpenIndex(sm.currentIndex+1, sm.navTotal)
+	currentNav, err := sm.buildCurrentNav(sm.currentIndex)
+	if err != nil {
+		return nil, err
+	}
+	sm.currentNav = currentNav
+
+	if sm.currentNav != nil {
+		sm.served++
+		sm.recordAdvance()
+		sm.applyLimit()
+		return sm.currentNav, sm.saveCurrentSession()
+	}
+
+	return sm.currentNav, nil
+}
+
+// GetNextNavSafe is GetNextNav with an explicit end signal: done is true,
+// and nav nil, once there are no more items to serve
+func (sm *StateManager) GetNextNavSafe() (nav *NavResponse, done bool, err error) {
+	nav, err = sm.GetNextNav()
+	if err != nil {
+		return nil, false, err
+	}
+	return nav, nav == nil, nil
+}
+
+// GetNextNavWhere advances to the first item after the current one for which
+// pred returns true, skipping the items in between. It returns nil, leaving the
+// position unchanged, when no later item matches.
+func (sm *StateManager) GetNextNavWhere(pred func(Nav) bool) (*NavResponse, error) {
+	session, err := sm.currentSession()
 	if err != nil {
 		return nil, err
 	}
+	if err := sm.autoComplete(session); err != nil {
+		return nil, err
+	}
 
 	if session != nil && !session.Completed {
 		return sm.currentNav, nil
 	}
+	if sm.limitReached() {
+		return nil, nil
+	}
+
+	for index := sm.currentIndex + 1; index < sm.navTotal; index++ {
+		nav, err := sm.navAt(index)
+		if err != nil {
+			return nil, err
+		}
+		if nav == nil || sm.completed.contains(index) || !pred(*nav) {
+			continue
+		}
+
+		sm.currentIndex = index
+		currentNav, err := sm.buildCurrentNav(sm.currentIndex)
+		if err != nil {
+			return nil, err
+		}
+		sm.currentNav = currentNav
+		sm.served++
+		sm.recordAdvance()
+		sm.applyLimit()
+		return sm.currentNav, sm.saveCurrentSession()
+	}
+
+	return nil, nil
+}
+
+// GetNextNavInLocalHours advances like GetNextNavWhere to the next city whose
+// local time is within [startHour, endHour), so locations can be crawled during
+// their daytime. The window may wrap past midnight, e.g. 22 to 6. Items without
+// a city timezone never match; when nothing matches it returns nil and the
+// caller can fall back to GetNextNav.
+func (sm *StateManager) GetNextNavInLocalHours(startHour, endHour int) (*NavResponse, error) {
+	if startHour < 0 || startHour > 23 || endHour < 0 || endHour > 24 {
+		return nil, fmt.Errorf("invalid local hour window %d-%d", startHour, endHour)
+	}
+
+	now := time.Now()
+	locations := make(map[string]*time.Location)
+	return sm.GetNextNavWhere(func(nav Nav) bool {
+		tz := sm.navTimezone(nav)
+		if tz == "" {
+			return false
+		}
+		loc, ok := locations[tz]
+		if !ok {
+			loc, _ = time.LoadLocation(tz)
+			locations[tz] = loc
+		}
+		if loc == nil {
+			return false
+		}
+
+		hour := now.In(loc).Hour()
+		if startHour <= endHour {
+			return hour >= startHour && hour < endHour
+		}
+		return hour >= startHour || hour < endHour
+	})
+}
+
+// navTimezone returns the timezone of the city a nav refers to, or "" when
+// the nav has no city or its timezone is unknown
+func (sm *StateManager) navTimezone(nav Nav) string {
+	if nav.City == nil {
+		return ""
+	}
+	for _, city := range sm.cities {
+		if city.City == *nav.City &&
+			(nav.StateShort == nil || city.StateShort == *nav.StateShort) &&
+			(nav.CountryShort == nil || city.CountryShort == *nav.CountryShort) {
+			if city.Timezone != nil {
+				return *city.Timezone
+			}
+			return ""
+		}
+	}
+	return ""
+}
+
+// nextOpenIndex returns the first index from start, below end, that has not
+// been completed, or end when every remaining item is done
+func (sm *StateManager) nextOpenIndex(start, end int) int {
+	index := start
+	for index < end && sm.completed.contains(index) {
+		index++
+	}
+	return index
+}
+
+// loadCompleted loads the indices completed under the current format and
+// target country, so navigation resumed after a restart skips finished items
+func (sm *StateManager) loadCompleted() error {
+	indices, err := sm.db.GetCompletedNavIndices(string(*sm.format), sm.planKey())
+	if err != nil {
+		return err
+	}
+
+	sm.completed = indexSet{}
+	for _, index := range indices {
+		if index < sm.navTotal {
+			sm.completed.add(index)
+		}
+	}
+	return nil
+}
+
+// autoComplete marks a session complete when AutoCompleteNonPaged is set and
+// the item never had pages, so advancing needs no explicit MarkComplete
+func (sm *StateManager) autoComplete(session *NavSession) error {
+	if !sm.autoCompleteNonPaged || session == nil || session.Completed || session.Page != "" {
+		return nil
+	}
+
+	if err := sm.db.UpdateNavSession(session.ID, map[string]interface{}{"completed": true, "completedAt": time.Now().UTC()}); err != nil {
+		return err
+	}
+	session.Completed = true
+	if session.NavIndex != nil {
+		sm.completed.add(*session.NavIndex)
+	}
+	return nil
+}
+
+// GetNextNavForCountry advances to the next item within a single country's
+// segment of navOrder, so callers can round-robin across countries instead of
+// finishing one before starting the next. An unfinished current item is
+// returned again only when it belongs to the country; otherwise it is served
+// again the next time its own country is asked for. It returns nil once the
+// country's segment is exhausted.
+func (sm *StateManager) GetNextNavForCountry(countryShort string) (*NavResponse, error) {
+	segment := sm.findSegment(countryShort)
+	if segment == nil {
+		return nil, fmt.Errorf("country %s is not part of the navigation order", countryShort)
+	}
+
+	session, err := sm.currentSession()
+	if err != nil {
+		return nil, err
+	}
+	if err := sm.autoComplete(session); err != nil {
+		return nil, err
+	}
+
+	if session != nil && !session.Completed {
+		if session.CountryShort == segment.CountryShort {
+			return sm.currentNav, nil
+		}
+		// Step its country's cursor back so the unfinished item is not passed over
+		sm.countryCursors[session.CountryShort] = sm.currentIndex - 1
+	}
+
+	cursor, ok := sm.countryCursors[countryShort]
+	if !ok {
+		cursor = segment.Start - 1
+		if sm.currentIndex >= segment.Start && sm.currentIndex < segment.End {
+			cursor = sm.currentIndex
+		}
+	}
+
+	next := sm.nextOpenIndex(cursor+1, segment.End)
+	if next >= segment.End || sm.limitReached() {
+		return nil, nil
+	}
+
+	sm.countryCursors[countryShort] = next
+	sm.currentIndex = next
+	currentNav, err := sm.buildCurrentNav(sm.currentIndex)
+	if err != nil {
+		return nil, err
+	}
+	sm.currentNav = currentNav
+
+	if sm.currentNav != nil {
+		sm.served++
+		sm.recordAdvance()
+		sm.applyLimit()
+		return sm.currentNav, sm.saveCurrentSession()
+	}
+
+	return sm.currentNav, nil
+}
+
+// SkipCountry abandons the remaining items of a country and moves navigation to
+// the first unfinished item after it. The skipped items are left unfinished,
+// and the session of the abandoned item is dropped so a restarted run does not
+// resume inside the skipped country. It returns nil once nothing is left after
+// the skipped country or the Limit has been reached.
+func (sm *StateManager) SkipCountry(countryShort string) (*NavResponse, error) {
+	segment := sm.findSegment(countryShort)
+	if segment == nil {
+		return nil, fmt.Errorf("country %s is not part of the navigation order", countryShort)
+	}
+	if sm.currentIndex < segment.Start || sm.currentIndex >= segment.End {
+		return nil, fmt.Errorf("navigation is not currently within country %s", countryShort)
+	}
+
+	session, err := sm.currentSession()
+	if err != nil {
+		return nil, err
+	}
+	if session != nil && !session.Completed {
+		if err := sm.db.DeleteNavSession(session.ID); err != nil {
+			return nil, err
+		}
+	}
+	sm.sessionID = 0
+	sm.currentNav = nil
+	sm.currentIndex = segment.End - 1
+
+	next := sm.nextOpenIndex(segment.End, sm.navTotal)
+	if next >= sm.navTotal || sm.limitReached() {
+		return nil, nil
+	}
+
+	sm.currentIndex = next
+	currentNav, err := sm.buildCurrentNav(sm.currentIndex)
+	if err != nil {
+		return nil, err
+	}
+	sm.currentNav = currentNav
+
+	if sm.currentNav != nil {
+		sm.served++
+		sm.recordAdvance()
+		sm.applyLimit()
+		return sm.currentNav, sm.saveCurrentSession()
+	}
+
+	return sm.currentNav, nil
+}
+
+// SaveBookmark stores the current navigation position under a name so it can
+// be returned to with GotoBookmark. Saving an existing name overwrites it.
+func (sm *StateManager) SaveBookmark(name string) error {
+	if name == "" {
+		return fmt.Errorf("bookmark name must not be empty")
+	}
+	if sm.format == nil {
+		return fmt.Errorf("state manager is not initialized")
+	}
+
+	return sm.db.SaveBookmark(Bookmark{
+		Name:          name,
+		Format:        string(*sm.format),
+		TargetCountry: sm.planKey(),
+		Index:         sm.currentIndex,
+	})
+}
+
+// GotoBookmark moves navigation to a named position saved with SaveBookmark.
+// The bookmark must have been saved with the active format and target country.
+func (sm *StateManager) GotoBookmark(name string) (*NavResponse, error) {
+	if sm.format == nil {
+		return nil, fmt.Errorf("state manager is not initialized")
+	}
+
+	bookmark, err := sm.db.GetBookmark(name)
+	if err != nil {
+		return nil, err
+	}
+	if bookmark == nil {
+		return nil, fmt.Errorf("bookmark %q not found", name)
+	}
+
+	if bookmark.Format != string(*sm.format) || bookmark.TargetCountry != sm.planKey() {
+		return nil, fmt.Errorf("bookmark %q was saved for format %s and country %s", name, bookmark.Format, bookmark.TargetCountry)
+	}
+	if bookmark.Index < 0 || bookmark.Index >= sm.navTotal {
+		return nil, fmt.Errorf("bookmark %q points past the end of the navigation order", name)
+	}
 
-	sm.currentIndex++
-	sm.currentNav = sm.buildNavResponseFromIndex(sm.currentIndex)
+	sm.currentIndex = bookmark.Index
+	currentNav, err := sm.buildCurrentNav(sm.currentIndex)
+	if err != nil {
+		return nil, err
+	}
+	sm.currentNav = currentNav
 
 	if sm.currentNav != nil {
 		return sm.currentNav, sm.saveCurrentSession()
@@ -829,25 +2935,262 @@ func (sm *StateManager) GetNextNav() (*NavResponse, error) {
 	return sm.currentNav, nil
 }
 
+// IsComplete reports whether the whole navigation plan has been worked
+// through. It has no side effects, unlike probing with GetNextNav.
+func (sm *StateManager) IsComplete() (bool, error) {
+	if sm.format == nil || sm.navTotal == 0 {
+		return true, nil
+	}
+
+	completed, err := sm.db.CountCompletedNavSessions(string(*sm.format), sm.planKey())
+	if err != nil {
+		return false, err
+	}
+	if completed >= sm.navTotal {
+		return true, nil
+	}
+
+	if !sm.limitReached() {
+		return sm.nextOpenIndex(0, sm.navTotal) == sm.navTotal, nil
+	}
+
+	// At the Limit, the plan is done once the last item served is finished
+	session, err := sm.currentSession()
+	if err != nil {
+		return false, err
+	}
+	return session == nil || session.Completed, nil
+}
+
+// Done is a convenience wrapper around IsComplete that treats errors as not done
+func (sm *StateManager) Done() bool {
+	done, err := sm.IsComplete()
+	return err == nil && done
+}
+
+// etaWindow is how many recent advances EstimateCompletion measures the rate over
+const etaWindow = 50
+
+// recordAdvance notes that an item was just served, keeping the last etaWindow
+// times and adding the item to the recent navs
+func (sm *StateManager) recordAdvance() {
+	sm.advanceTimes = append(sm.advanceTimes, time.Now())
+	if len(sm.advanceTimes) > etaWindow {
+		sm.advanceTimes = sm.advanceTimes[len(sm.advanceTimes)-etaWindow:]
+	}
+
+	if sm.currentNav == nil {
+		return
+	}
+	if sm.recentNavs == nil {
+		sm.recentNavs = make([]*NavResponse, defaultRecentNavs)
+	}
+	if len(sm.recentNavs) == 0 {
+		return
+	}
+	served := *sm.currentNav
+	sm.recentNavs[sm.recentNext] = &served
+	sm.recentNext = (sm.recentNext + 1) % len(sm.recentNavs)
+	if sm.recentCount < len(sm.recentNavs) {
+		sm.recentCount++
+	}
+}
+
+// defaultRecentNavs is how many served items RecentNavs keeps unless
+// SetRecentNavsSize says otherwise
+const defaultRecentNavs = 20
+
+// SetRecentNavsSize sets how many served items RecentNavs keeps, keeping the
+// most recent ones that still fit. A size of 0 stops recording them.
+func (sm *StateManager) SetRecentNavsSize(size int) {
+	if size < 0 {
+		size = 0
+	}
+	kept := sm.RecentNavs(size)
+
+	sm.recentNavs = make([]*NavResponse, size)
+	sm.recentNext, sm.recentCount = 0, 0
+	for i := len(kept) - 1; i >= 0; i-- {
+		sm.recentNavs[sm.recentNext] = kept[i]
+		sm.recentNext = (sm.recentNext + 1) % size
+		sm.recentCount++
+	}
+}
+
+// RecentNavs returns up to k of the items most recently served by this
+// manager, newest first. They are kept in memory only, as they were when
+// served, and survive Init but not the process.
+func (sm *StateManager) RecentNavs(k int) []*NavResponse {
+	if k > sm.recentCount {
+		k = sm.recentCount
+	}
+	if k <= 0 {
+		return []*NavResponse{}
+	}
+
+	navs := make([]*NavResponse, k)
+	for i := range navs {
+		slot := (sm.recentNext - 1 - i + len(sm.recentNavs)) % len(sm.recentNavs)
+		navs[i] = sm.recentNavs[slot]
+	}
+	return navs
+}
+
+// EstimateCompletion returns the number of remaining items and how long they
+// should take at the rate measured over the most recent advances. ok is false
+// until at least two items have been served.
+func (sm *StateManager) EstimateCompletion() (remaining int, eta time.Duration, ok bool) {
+	remaining = sm.CountRemaining()
+	if len(sm.advanceTimes) < 2 {
+		return remaining, 0, false
+	}
+
+	elapsed := sm.advanceTimes[len(sm.advanceTimes)-1].Sub(sm.advanceTimes[0])
+	perItem := elapsed / time.Duration(len(sm.advanceTimes)-1)
+	return remaining, perItem * time.Duration(remaining), true
+}
+
+// EstimateCompletionAt returns the number of remaining items and how long they
+// take at the given rate, for callers that track throughput themselves
+func (sm *StateManager) EstimateCompletionAt(itemsPerSecond float64) (int, time.Duration) {
+	remaining := sm.CountRemaining()
+	if itemsPerSecond <= 0 {
+		return remaining, 0
+	}
+	return remaining, time.Duration(float64(remaining) / itemsPerSecond * float64(time.Second))
+}
+
+// CountRemaining returns the number of unfinished nav items from the current
+// one to the end, capped by what the Limit still lets GetNextNav serve
+func (sm *StateManager) CountRemaining() int {
+	remaining := 0
+	for index := sm.currentIndex; index < sm.navTotal; index++ {
+		if !sm.completed.contains(index) {
+			remaining++
+		}
+	}
+
+	if sm.limit > 0 {
+		// The current item was already counted as served
+		allowed := sm.limit - sm.served
+		if allowed < 0 {
+			allowed = 0
+		}
+		if sm.currentNav != nil && sm.currentIndex < sm.navTotal && !sm.completed.contains(sm.currentIndex) {
+			allowed++
+		}
+		if remaining > allowed {
+			remaining = allowed
+		}
+	}
+	return remaining
+}
+
+// WalkDryRun calls fn for every nav item from the current one to the end
+// without saving sessions or marking anything as used
+func (sm *StateManager) WalkDryRun(fn func(*NavResponse)) error {
+	for i := sm.currentIndex; i < sm.navTotal; i++ {
+		nav, err := sm.buildNavResponseFromIndex(i)
+		if err != nil {
+			return err
+		}
+		if nav != nil {
+			fn(nav)
+		}
+	}
+
+	// Walking may have moved the loaded country in lazy mode
+	_, err := sm.navAt(sm.currentIndex)
+	return err
+}
+
+// ForEachNav calls fn with the index and response of every nav item from the
+// start, building each one on demand, until fn returns false. Like WalkDryRun
+// it neither advances navigation nor saves sessions.
+func (sm *StateManager) ForEachNav(fn func(int, *NavResponse) bool) error {
+	for i := 0; i < sm.navTotal; i++ {
+		nav, err := sm.buildNavResponseFromIndex(i)
+		if err != nil {
+			return err
+		}
+		if nav != nil && !fn(i, nav) {
+			break
+		}
+	}
+
+	// Iterating may have moved the loaded country in lazy mode
+	_, err := sm.navAt(sm.currentIndex)
+	return err
+}
+
+// GetNavWindow returns the nav items in the half-open range [start, end)
+// without advancing navigation. The range is clamped to the navigation order.
+func (sm *StateManager) GetNavWindow(start, end int) ([]*NavResponse, error) {
+	if start > end {
+		return nil, fmt.Errorf("invalid window: start %d is after end %d", start, end)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end > sm.navTotal {
+		end = sm.navTotal
+	}
+	if start > end {
+		start = end
+	}
+
+	window := make([]*NavResponse, 0, end-start)
+	for i := start; i < end; i++ {
+		nav, err := sm.buildNavResponseFromIndex(i)
+		if err != nil {
+			return nil, err
+		}
+		window = append(window, nav)
+	}
+
+	// Building the window may have moved the loaded country in lazy mode
+	if _, err := sm.navAt(sm.currentIndex); err != nil {
+		return nil, err
+	}
+	return window, nil
+}
+
 // GetCurrentNav returns the current navigation response
 func (sm *StateManager) GetCurrentNav() *NavResponse {
 	return sm.currentNav
 }
 
-// SetPageNav sets pagination information
+// SetPageNav sets pagination information. Pages already marked done are kept
+// unless they fall beyond the new total, so the total can be revised mid-crawl.
 func (sm *StateManager) SetPageNav(totalPages int, pages []int) error {
 	if sm.currentNav == nil {
 		return nil
 	}
 
+	merged := make(map[int]bool)
+	if existing, completed, ok := sm.currentNav.PageInfo(); ok && !completed {
+		for _, p := range existing.Pages {
+			merged[p] = true
+		}
+	}
+	for _, p := range pages {
+		merged[p] = true
+	}
+
 	pageNav := PageNav{
-		Pages: pages,
+		Pages: []int{},
 		Total: totalPages,
 	}
+	for p := range merged {
+		if p <= totalPages {
+			pageNav.Pages = append(pageNav.Pages, p)
+		}
+	}
+	sort.Ints(pageNav.Pages)
 
 	sm.currentNav.Page = pageNav
 
-	session, err := sm.db.GetCurrentNavSession()
+	session, err := sm.currentSession()
 	if err != nil {
 		return err
 	}
@@ -862,30 +3205,28 @@ func (sm *StateManager) SetPageNav(totalPages int, pages []int) error {
 	return nil
 }
 
-// MarkPageAsDone marks a page as completed
-func (sm *StateManager) MarkPageAsDone(page int) error {
-	if sm.currentNav == nil || sm.currentNav.Page == "completed" {
-		return nil
-	}
-
-	pageNav, ok := sm.currentNav.Page.(PageNav)
-	if !ok {
-		return nil
+// MarkPageAsDone marks a page as completed. Once every page is done the item
+// is completed as by MarkComplete, and done reports whether it was the final item.
+func (sm *StateManager) MarkPageAsDone(page int) (done bool, err error) {
+	pageNav, completed, ok := sm.currentNav.PageInfo()
+	if !ok || completed {
+		return false, nil
 	}
 
 	// Check if page is already marked
 	for _, p := range pageNav.Pages {
 		if p == page {
-			return nil
+			return false, nil
 		}
 	}
 
-	pageNav.Pages = append(pageNav.Pages, page)
+	pageNav.Pages = append(append([]int{}, pageNav.Pages...), page)
 	sort.Ints(pageNav.Pages)
+	sm.currentNav.Page = pageNav
 
-	session, err := sm.db.GetCurrentNavSession()
+	session, err := sm.currentSession()
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	if session != nil {
@@ -894,7 +3235,7 @@ func (sm *StateManager) MarkPageAsDone(page int) error {
 			"page": string(pageJSON),
 		})
 		if err != nil {
-			return err
+			return false, err
 		}
 
 		if len(pageNav.Pages) == pageNav.Total {
@@ -902,28 +3243,251 @@ func (sm *StateManager) MarkPageAsDone(page int) error {
 		}
 	}
 
-	return nil
+	return false, nil
+}
+
+// MarkCompleteContext is MarkComplete with its queries bounded by ctx
+func (sm *StateManager) MarkCompleteContext(ctx context.Context) (done bool, err error) {
+	defer sm.bindContext(ctx)()
+	return sm.MarkComplete()
+}
+
+// MarkComplete marks the current navigation as complete. done reports whether
+// that finished the plan, leaving no item in the navigation order unfinished,
+// or reached the Limit, so a worker loop can stop without calling IsComplete.
+func (sm *StateManager) MarkComplete() (done bool, err error) {
+	session, err := sm.currentSession()
+	if err != nil {
+		return false, err
+	}
+	if session == nil {
+		return false, nil
+	}
+
+	err = sm.db.UpdateNavSession(session.ID, map[string]interface{}{
+		"completed":   true,
+		"completedAt": time.Now().UTC(),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if sm.currentNav != nil {
+		sm.currentNav.Page = "completed"
+		sm.completed.add(sm.currentIndex)
+	}
+
+	return sm.nextOpenIndex(0, sm.navTotal) == sm.navTotal || sm.limitReached(), nil
 }
 
-// MarkComplete marks the current navigation as complete
-func (sm *StateManager) MarkComplete() error {
-	session, err := sm.db.GetCurrentNavSession()
+// ResetCompletedBefore reopens items completed before t, so they are crawled
+// again, and moves navigation back to the earliest reopened item of the current
+// plan. Items completed before completion times were tracked count as stale.
+func (sm *StateManager) ResetCompletedBefore(t time.Time) error {
+	if sm.format == nil {
+		return fmt.Errorf("state manager not initialized")
+	}
+
+	indices, err := sm.db.ResetCompletedBefore(t, string(*sm.format), sm.planKey())
 	if err != nil {
 		return err
 	}
+	if len(indices) == 0 {
+		return nil
+	}
+	for _, index := range indices {
+		sm.completed.remove(index)
+	}
 
-	if session != nil {
-		err = sm.db.UpdateNavSession(session.ID, map[string]interface{}{
-			"completed": true,
-		})
-		if err != nil {
+	earliest := indices[0]
+	for _, index := range indices[1:] {
+		if index < earliest {
+			earliest = index
+		}
+	}
+	if earliest >= sm.navTotal || earliest > sm.currentIndex {
+		return nil
+	}
+
+	// The in-progress item is reached again as navigation advances from earliest
+	if sm.sessionID != 0 {
+		if err := sm.db.DeleteNavSession(sm.sessionID); err != nil {
 			return err
 		}
+		sm.sessionID = 0
+	}
 
-		sm.currentNav.Page = "completed"
+	sm.currentIndex = earliest
+	currentNav, err := sm.buildCurrentNav(sm.currentIndex)
+	if err != nil {
+		return err
+	}
+	sm.currentNav = currentNav
+	return sm.saveCurrentSession()
+}
+
+// RemapCompletion marks items of the active format done when a completed
+// session of the from format covered the same entities, so switching formats
+// does not redo finished work. It returns how many items were marked.
+//
+// Items are matched on the query, zip, city and state IDs the two formats
+// share. from may only drop a level of to when that level is implied by the
+// others: the country always is, and the state is implied by a city. So city
+// maps to city-state and back, but city-state does not map to state, since one
+// finished city does not finish its state. County formats carry no entity IDs
+// and cannot be remapped.
+func (sm *StateManager) RemapCompletion(from, to NavFormat) (int, error) {
+	if sm.format == nil {
+		return 0, fmt.Errorf("state manager not initialized")
+	}
+	if to != *sm.format {
+		return 0, fmt.Errorf("can only remap completion onto the active format %s, not %s", *sm.format, to)
+	}
+	if !isKnownFormat(from) {
+		return 0, fmt.Errorf("%w: %q", ErrUnknownFormat, from)
 	}
 
-	return nil
+	shared, err := sharedRemapLevels(from, to)
+	if err != nil {
+		return 0, err
+	}
+
+	sessions, err := sm.db.GetAllNavSessions()
+	if err != nil {
+		return 0, err
+	}
+	done := make(map[string]bool)
+	for _, session := range sessions {
+		if session.Completed && session.Format == string(from) {
+			done[remapKey(shared, session.CountryShort, session.QueryID, session.ZipID, session.CityID, session.StateShort)] = true
+		}
+	}
+	if len(done) == 0 {
+		return 0, nil
+	}
+
+	targetCountry := sm.planKey()
+	remapped := 0
+	for index := 0; index < sm.navTotal; index++ {
+		if sm.completed.contains(index) {
+			continue
+		}
+
+		nav, err := sm.navAt(index)
+		if err != nil {
+			return remapped, err
+		}
+		if nav == nil || nav.CountryShort == nil {
+			continue
+		}
+
+		country, query, zip, city, state := sm.navEntities(*nav.CountryShort, *nav)
+		if country == nil {
+			continue
+		}
+
+		session := NavSession{
+			Format:        string(to),
+			CountryShort:  country.CountryShort,
+			Completed:     true,
+			External:      true,
+			TargetCountry: &targetCountry,
+		}
+		if query != nil {
+			session.QueryID = query.ID
+		}
+		if zip != nil {
+			session.ZipID = zip.ID
+		}
+		if city != nil {
+			session.CityID = city.ID
+		}
+		if state != nil {
+			session.StateShort = &state.StateShort
+		}
+
+		if !done[remapKey(shared, session.CountryShort, session.QueryID, session.ZipID, session.CityID, session.StateShort)] {
+			continue
+		}
+
+		navIndex := index
+		session.NavIndex = &navIndex
+		id, err := sm.db.upsertNavSession(session)
+		if err != nil {
+			return remapped, err
+		}
+		if err := sm.db.UpdateNavSession(id, map[string]interface{}{"completedAt": time.Now().UTC()}); err != nil {
+			return remapped, err
+		}
+
+		sm.completed.add(index)
+		if index == sm.currentIndex && sm.currentNav != nil {
+			sm.currentNav.Page = "completed"
+		}
+		remapped++
+	}
+
+	// Keep the loaded window on the current item in lazy mode
+	if _, err := sm.navAt(sm.currentIndex); err != nil {
+		return remapped, err
+	}
+	return remapped, nil
+}
+
+// sharedRemapLevels returns the entity levels two formats are matched on by
+// RemapCompletion, or an error when completion cannot be carried over
+func sharedRemapLevels(from, to NavFormat) ([]string, error) {
+	toLevels := make(map[string]bool)
+	for _, level := range RequiredLevels(to) {
+		toLevels[level] = true
+	}
+
+	var shared []string
+	for _, level := range RequiredLevels(from) {
+		switch {
+		case level == "county" || toLevels["county"]:
+			return nil, fmt.Errorf("county formats cannot be remapped")
+		case level == "country":
+		case toLevels[level]:
+			shared = append(shared, level)
+		case level == "state" && toLevels["city"]:
+		default:
+			return nil, fmt.Errorf("cannot remap %s onto %s: %s is not implied by %s", from, to, level, to)
+		}
+	}
+
+	if len(shared) == 0 {
+		return nil, fmt.Errorf("formats %s and %s share no levels", from, to)
+	}
+	return shared, nil
+}
+
+// remapKey identifies a session by its country and the IDs of the given levels
+func remapKey(levels []string, countryShort string, queryID, zipID, cityID *int, stateShort *string) string {
+	key := countryShort
+	for _, level := range levels {
+		var value string
+		switch level {
+		case "query":
+			if queryID != nil {
+				value = strconv.Itoa(*queryID)
+			}
+		case "zip":
+			if zipID != nil {
+				value = strconv.Itoa(*zipID)
+			}
+		case "city":
+			if cityID != nil {
+				value = strconv.Itoa(*cityID)
+			}
+		case "state":
+			if stateShort != nil {
+				value = *stateShort
+			}
+		}
+		key += "\x1f" + level + "=" + value
+	}
+	return key
 }
 
 // AddSearchQueries adds search queries
@@ -941,8 +3505,28 @@ func (sm *StateManager) AddSearchQueries(queries []string) error {
 		return err
 	}
 	sm.queries = updatedQueries
-	sm.generateNavOrder()
-	return nil
+	return sm.generateNavOrder()
+}
+
+// AddSearchQueriesWeighted adds search queries with weights. In query formats
+// each country gets one round over all queries, then further rounds over the
+// queries whose weight is still higher, so a query of weight 3 is run three
+// times over every location while a query of weight 1 is run once.
+func (sm *StateManager) AddSearchQueriesWeighted(weights map[string]int) error {
+	if len(weights) == 0 {
+		return nil
+	}
+
+	if err := sm.db.AddWeightedQueries(weights, true); err != nil {
+		return err
+	}
+
+	updatedQueries, err := sm.db.GetQueries()
+	if err != nil {
+		return err
+	}
+	sm.queries = updatedQueries
+	return sm.generateNavOrder()
 }
 
 // ClearSearchQueries clears all search queries
@@ -952,8 +3536,7 @@ func (sm *StateManager) ClearSearchQueries() error {
 	}
 
 	sm.queries = []Query{}
-	sm.generateNavOrder()
-	return nil
+	return sm.generateNavOrder()
 }
 
 // ResetNav resets navigation sessions
@@ -964,7 +3547,14 @@ func (sm *StateManager) ResetNav() error {
 
 	sm.currentIndex = 0
 	sm.currentNav = nil
-	return sm.restoreOrStartSession()
+	sm.sessionID = 0
+	sm.completed = indexSet{}
+	if err := sm.restoreOrStartSession(); err != nil {
+		return err
+	}
+
+	sm.startServing()
+	return nil
 }
 
 // AddSearchQuery adds a single search query
@@ -1034,6 +3624,7 @@ func (sm *StateManager) AddStates(states []struct {
 			State:        state.State,
 			StateShort:   state.StateShort,
 			CountryShort: state.CountryShort,
+			County:       state.County,
 			Used:         false,
 			External:     true,
 		})
@@ -1063,9 +3654,14 @@ func (sm *StateManager) AddCountries(countries []struct {
 
 	var dbCountries []Country
 	for _, country := range countries {
+		countryShort, err := sm.ResolveCountryCode(country.CountryShort)
+		if err != nil {
+			return err
+		}
+
 		dbCountries = append(dbCountries, Country{
 			Country:      country.Country,
-			CountryShort: country.CountryShort,
+			CountryShort: countryShort,
 			Used:         false,
 			External:     true,
 		})
@@ -1078,38 +3674,146 @@ func (sm *StateManager) AddCountries(countries []struct {
 	return sm.refreshData()
 }
 
+// AddCountryByCode adds a country by its ISO2 code, taking the name from the
+// country metadata persisted with the downloaded data
+func (sm *StateManager) AddCountryByCode(code string) error {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code == "" {
+		return fmt.Errorf("country code must not be empty")
+	}
+
+	code, err := sm.ResolveCountryCode(code)
+	if err != nil {
+		return err
+	}
+
+	metadata, err := sm.lookupCountryMetadata(code)
+	if err != nil {
+		return err
+	}
+	if metadata == nil {
+		return fmt.Errorf("unknown country code %s", code)
+	}
+
+	if err := sm.db.AddCountries([]Country{{
+		Country:      metadata.Name,
+		CountryShort: code,
+		Used:         false,
+		External:     true,
+	}}, true); err != nil {
+		return err
+	}
+
+	return sm.refreshData()
+}
+
+// ResolveCountryCode normalizes a country code, in any case, to the
+// uppercase ISO2 form used internally. ISO2 codes must be in ValidCountryCodes
+// or the country metadata, and ISO3 codes are looked up in the metadata;
+// anything else returns ErrCountryNotFound. "all" is returned as is.
+func (sm *StateManager) ResolveCountryCode(code string) (string, error) {
+	normalized := normalizeCode(code)
+	if normalized == "ALL" {
+		return "all", nil
+	}
+
+	switch len(normalized) {
+	case 2:
+		if contains(ValidCountryCodes, normalized) {
+			return normalized, nil
+		}
+		metadata, err := sm.lookupCountryMetadata(normalized)
+		if err != nil {
+			return "", err
+		}
+		if metadata != nil {
+			return normalized, nil
+		}
+
+	case 3:
+		metadata, err := sm.db.GetCountryMetadataByISO3(normalized)
+		if err != nil {
+			return "", err
+		}
+		if metadata != nil {
+			return metadata.ISO2, nil
+		}
+
+		for _, country := range GetLocationData().Countries {
+			if strings.EqualFold(country.ISO3, normalized) {
+				return strings.ToUpper(country.ISO2), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrCountryNotFound, code)
+}
+
+// lookupCountryMetadata finds country metadata in the database, falling back
+// to the location data file for databases seeded before metadata was stored
+func (sm *StateManager) lookupCountryMetadata(code string) (*CountryData, error) {
+	metadata, err := sm.db.GetCountryMetadata(code)
+	if err != nil || metadata != nil {
+		return metadata, err
+	}
+
+	for _, country := range GetLocationData().Countries {
+		if strings.EqualFold(country.ISO2, code) {
+			c := country
+			return &c, nil
+		}
+	}
+	return nil, nil
+}
+
 // refreshData refreshes all data from database
 func (sm *StateManager) refreshData() error {
 	countries, err := sm.db.GetCountries(sm.targetCountry)
 	if err != nil {
 		return err
 	}
-	sm.countries = countries
+	sm.countries = sm.withPriority(sm.withoutExcluded(countries))
 
 	countryShorts := make([]string, len(sm.countries))
 	for i, c := range sm.countries {
 		countryShorts[i] = c.CountryShort
 	}
 
-	states, err := sm.db.GetStates(countryShorts)
-	if err != nil {
-		return err
+	needStates, needCities, _ := formatLoads(sm.activeFormat())
+
+	if needStates {
+		states, err := sm.loadStates(countryShorts)
+		if err != nil {
+			return err
+		}
+		sm.states = states
 	}
-	sm.states = states
 
-	stateShorts := make([]string, len(sm.states))
-	for i, s := range sm.states {
-		stateShorts[i] = s.StateShort
+	if needCities && !sm.lazyCities {
+		cities, err := sm.db.GetCities(countryShorts, sm.stateShorts())
+		if err != nil {
+			return err
+		}
+		sm.cities = sm.citiesWithoutExcluded(cities)
 	}
 
-	cities, err := sm.db.GetCities(countryShorts, stateShorts)
-	if err != nil {
-		return err
+	return sm.generateNavOrder()
+}
+
+// activeFormat returns the initialized format, or "" before Init
+func (sm *StateManager) activeFormat() NavFormat {
+	if sm.format == nil {
+		return ""
 	}
-	sm.cities = cities
+	return *sm.format
+}
 
-	sm.generateNavOrder()
-	return nil
+// stateShorts returns the short codes of the loaded states
+func (sm *StateManager) stateShorts() []string {
+	stateShorts := make([]string, len(sm.states))
+	for i, s := range sm.states {
+		stateShorts[i] = s.StateShort
+	}
+	return stateShorts
 }
 
 // Debug prints debug information
@@ -1118,7 +3822,7 @@ func (sm *StateManager) Debug() {
 	fmt.Printf("Format: %v\n", sm.format)
 	fmt.Printf("TargetCountry: %s\n", sm.targetCountry)
 	fmt.Printf("CurrentNav: %+v\n", sm.currentNav)
-	fmt.Printf("NavOrderLength: %d\n", len(sm.navOrder))
+	fmt.Printf("NavOrderLength: %d\n", sm.navTotal)
 	fmt.Printf("CurrentIndex: %d\n", sm.currentIndex)
 	fmt.Printf("Queries: %d\n", len(sm.queries))
 	fmt.Printf("Countries: %d\n", len(sm.countries))
@@ -1127,6 +3831,153 @@ func (sm *StateManager) Debug() {
 	fmt.Printf("Zips: %d\n", len(sm.zips))
 }
 
+// Stats returns the structured counterpart of Debug, suitable for metrics export
+func (sm *StateManager) Stats() (NavStats, error) {
+	stats := NavStats{
+		NavOrderLength: sm.navTotal,
+		CurrentIndex:   sm.currentIndex,
+		QueriesCount:   len(sm.queries),
+		CountriesCount: len(sm.countries),
+		StatesCount:    len(sm.states),
+		CitiesCount:    len(sm.cities),
+		ZipsCount:      len(sm.zips),
+	}
+
+	if sm.format != nil {
+		completed, err := sm.db.CountCompletedNavSessions(string(*sm.format), sm.planKey())
+		if err != nil {
+			return stats, err
+		}
+		stats.Completed = completed
+	}
+
+	return stats, nil
+}
+
+// GetCityRecordsForCountryState returns the stored cities of a state with
+// county and coordinates, unlike the name-only GetCitiesForCountryState which
+// reads the data file. Codes match in any case, as they are stored uppercased.
+func (sm *StateManager) GetCityRecordsForCountryState(countryCode, stateCode string) ([]City, error) {
+	return sm.db.GetCities([]string{normalizeCode(countryCode)}, []string{normalizeCode(stateCode)})
+}
+
+// ZipCoverage returns the number of zips for each loaded country. Countries
+// without postal code data are included with a count of zero.
+func (sm *StateManager) ZipCoverage() (map[string]int, error) {
+	counts, err := sm.db.CountZipsByCountry()
+	if err != nil {
+		return nil, err
+	}
+
+	coverage := make(map[string]int, len(sm.countries))
+	for _, country := range sm.countries {
+		coverage[country.CountryShort] = counts[country.CountryShort]
+	}
+	return coverage, nil
+}
+
+// PreflightCounty counts the cities of the loaded countries with and without
+// a county. County formats skip cities without one, so a zero withCounty means
+// county navigation would produce an empty plan.
+func (sm *StateManager) PreflightCounty() (withCounty, withoutCounty int, err error) {
+	with, without, err := sm.db.CountCitiesByCounty()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, country := range sm.countries {
+		withCounty += with[country.CountryShort]
+		withoutCounty += without[country.CountryShort]
+	}
+	return withCounty, withoutCounty, nil
+}
+
+// Preflight reports, for each target country, whether it has the states,
+// cities, counties and zips the levels of format need, so countries that would
+// be silently skipped show up before a crawl starts. Before Init it checks
+// every country in the database.
+func (sm *StateManager) Preflight(format NavFormat) ([]CountryPreflight, error) {
+	if !isKnownFormat(format) {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownFormat, format)
+	}
+
+	countries := sm.countries
+	if sm.format == nil {
+		var err error
+		if countries, err = sm.db.GetCountries("all"); err != nil {
+			return nil, err
+		}
+	}
+
+	states, err := sm.db.CountStatesByCountry()
+	if err != nil {
+		return nil, err
+	}
+	withCounty, withoutCounty, err := sm.db.CountCitiesByCounty()
+	if err != nil {
+		return nil, err
+	}
+	zips, err := sm.db.CountZipsByCountry()
+	if err != nil {
+		return nil, err
+	}
+	queries, err := sm.db.GetQueries()
+	if err != nil {
+		return nil, err
+	}
+
+	report := make([]CountryPreflight, 0, len(countries))
+	for _, country := range countries {
+		cs := country.CountryShort
+		p := CountryPreflight{
+			CountryShort:     cs,
+			States:           states[cs],
+			Cities:           withCounty[cs] + withoutCounty[cs],
+			CitiesWithCounty: withCounty[cs],
+			Zips:             zips[cs],
+		}
+
+		for _, level := range RequiredLevels(format) {
+			var missing bool
+			switch level {
+			case "state":
+				missing = p.States == 0
+			case "city":
+				missing = p.Cities == 0
+			case "county":
+				missing = p.CitiesWithCounty == 0
+			case "zip":
+				missing = p.Zips == 0
+			case "query":
+				missing = len(queries) == 0
+			}
+			if missing {
+				p.Missing = append(p.Missing, level)
+			}
+		}
+		report = append(report, p)
+	}
+
+	return report, nil
+}
+
+// CountriesWithoutZips returns the loaded countries that have no zips, for
+// which the zip formats produce no navigation items
+func (sm *StateManager) CountriesWithoutZips() ([]string, error) {
+	counts, err := sm.db.CountZipsByCountry()
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for _, country := range sm.countries {
+		if counts[country.CountryShort] == 0 {
+			missing = append(missing, country.CountryShort)
+		}
+	}
+	return missing, nil
+}
+
 // Populate populates the database with sample data
 func (sm *StateManager) Populate() error {
 	countries := []Country{
@@ -1173,16 +4024,17 @@ func (sm *StateManager) Populate() error {
 			return err
 		}
 
-		sm.generateNavOrder()
-		return nil
+		return sm.generateNavOrder()
 	})
 }
 
-// ResetDatabase resets the database
-func (sm *StateManager) ResetDatabase() error {
-	if err := sm.db.ResetDatabase(); err != nil {
+// ResetDatabase resets the database as described by DB.ResetDatabase and
+// reloads the navigation data
+func (sm *StateManager) ResetDatabase(opts ...ResetOptions) error {
+	if err := sm.db.ResetDatabase(opts...); err != nil {
 		return err
 	}
+	sm.completed = indexSet{}
 
 	return sm.refreshData()
 }
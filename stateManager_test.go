@@ -0,0 +1,695 @@
+package navii
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestStateManager returns a state manager on a fresh database seeded by
+// seedTestDatabase
+func newTestStateManager(t *testing.T) *StateManager {
+	return openTestStateManager(t, seedTestDatabase(t))
+}
+
+// seedTestDatabase creates a database holding a small fixed data set and
+// returns its path: two US states with a city each, one Canadian province with
+// a city, one California zip and the query "plumber". Only Los Angeles has a
+// county. The location data file is pointed at a missing file so none is read.
+func seedTestDatabase(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	SetDataFilePath(filepath.Join(dir, "missing.json"))
+	path := filepath.Join(dir, "test.db")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mustNoError(t, db.AddCountries([]Country{
+		{Country: "United States", CountryShort: "US"},
+		{Country: "Canada", CountryShort: "CA"},
+	}, false))
+	mustNoError(t, db.AddStates([]State{
+		{State: "California", StateShort: "CA", CountryShort: "US"},
+		{State: "Texas", StateShort: "TX", CountryShort: "US"},
+		{State: "Ontario", StateShort: "ON", CountryShort: "CA"},
+	}, false))
+	county, zipState := "Los Angeles County", "CA"
+	mustNoError(t, db.AddCities([]City{
+		{City: "Los Angeles", StateShort: "CA", CountryShort: "US", County: &county},
+		{City: "Austin", StateShort: "TX", CountryShort: "US"},
+		{City: "Toronto", StateShort: "ON", CountryShort: "CA"},
+	}, false))
+	mustNoError(t, db.AddZips([]Zip{{Zip: "90001", CountryShort: "US", StateShort: &zipState}}, false))
+	mustNoError(t, db.AddQueries([]string{"plumber"}, false))
+	return path
+}
+
+// openTestStateManager opens a state manager on path, closed when the test ends
+func openTestStateManager(t *testing.T, path string) *StateManager {
+	t.Helper()
+
+	sm, err := NewStateManager(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sm.Close() })
+	return sm
+}
+
+func mustNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetPageNavKeepsDonePages(t *testing.T) {
+	sm := newTestStateManager(t)
+	mustNoError(t, sm.Init(InitOptions{Format: NavFormatCity, TargetCountry: "all"}))
+	if _, err := sm.GetNextNav(); err != nil {
+		t.Fatal(err)
+	}
+
+	mustNoError(t, sm.SetPageNav(5, nil))
+	for page := 1; page <= 3; page++ {
+		if _, err := sm.MarkPageAsDone(page); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mustNoError(t, sm.SetPageNav(8, nil))
+	pageNav, completed, ok := sm.GetCurrentNav().PageInfo()
+	if !ok || completed {
+		t.Fatalf("PageInfo() ok = %v, completed = %v", ok, completed)
+	}
+	if pageNav.Total != 8 || !reflect.DeepEqual(pageNav.Pages, []int{1, 2, 3}) {
+		t.Fatalf("after raising the total got %+v, want pages [1 2 3] of 8", pageNav)
+	}
+
+	mustNoError(t, sm.SetPageNav(2, nil))
+	pageNav, _, _ = sm.GetCurrentNav().PageInfo()
+	if pageNav.Total != 2 || !reflect.DeepEqual(pageNav.Pages, []int{1, 2}) {
+		t.Fatalf("after lowering the total got %+v, want pages [1 2] of 2", pageNav)
+	}
+}
+
+func TestNavCountryNamesInEveryFormat(t *testing.T) {
+	sm := newTestStateManager(t)
+	names := map[string]string{"US": "United States", "CA": "Canada"}
+
+	for _, info := range NavFormatInfo() {
+		t.Run(string(info.Format), func(t *testing.T) {
+			mustNoError(t, sm.Init(InitOptions{Format: info.Format, TargetCountry: "all"}))
+			// The bare query format has no location to pair a query with
+			if len(sm.navOrder) == 0 && info.Format != NavFormatQuery {
+				t.Fatal("navigation order is empty")
+			}
+
+			for _, nav := range sm.navOrder {
+				if nav.Country == nil || nav.CountryShort == nil {
+					t.Fatalf("nav %s is missing Country or CountryShort", nav.Key())
+				}
+				if want := names[*nav.CountryShort]; *nav.Country != want {
+					t.Errorf("nav %s has Country %q, want %q", nav.Key(), *nav.Country, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCompletedItemsSurviveRevisitAndRestart(t *testing.T) {
+	path := seedTestDatabase(t)
+	sm := openTestStateManager(t, path)
+	mustNoError(t, sm.Init(InitOptions{Format: NavFormatCity, TargetCountry: "all"}))
+
+	completed := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		nav, err := sm.GetNextNav()
+		mustNoError(t, err)
+		if i == 0 {
+			mustNoError(t, sm.SaveBookmark("first"))
+		}
+		if _, err := sm.MarkComplete(); err != nil {
+			t.Fatal(err)
+		}
+		completed[nav.Nav.Key()] = true
+	}
+
+	// Revisiting a finished item must not reopen it
+	if _, err := sm.GotoBookmark("first"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Serving the same city under another plan must not touch this plan's rows
+	mustNoError(t, sm.Init(InitOptions{Format: NavFormatCity, TargetCountry: "US"}))
+	if _, err := sm.GetNextNav(); err != nil {
+		t.Fatal(err)
+	}
+	mustNoError(t, sm.Close())
+
+	restarted := openTestStateManager(t, path)
+	mustNoError(t, restarted.Init(InitOptions{Format: NavFormatCity, TargetCountry: "all"}))
+	nav, err := restarted.GetNextNav()
+	mustNoError(t, err)
+	if nav == nil {
+		t.Fatal("GetNextNav returned nil with one item left")
+	}
+	if completed[nav.Nav.Key()] {
+		t.Fatalf("GetNextNav served completed item %s after a restart", nav.Nav.Key())
+	}
+	if _, err := restarted.MarkComplete(); err != nil {
+		t.Fatal(err)
+	}
+	if !restarted.Done() {
+		t.Fatal("plan is not done after completing every item")
+	}
+}
+
+func TestSkipCountryResumesAfterRestart(t *testing.T) {
+	path := seedTestDatabase(t)
+	sm := openTestStateManager(t, path)
+	mustNoError(t, sm.Init(InitOptions{Format: NavFormatCity, TargetCountry: "all"}))
+	first := sm.GetCurrentNav()
+	if first == nil {
+		t.Fatal("no current nav after Init")
+	}
+
+	next, err := sm.SkipCountry(first.Country)
+	mustNoError(t, err)
+	if next == nil || next.Country == first.Country {
+		t.Fatalf("SkipCountry(%s) returned %+v, want an item of the next country", first.Country, next)
+	}
+	mustNoError(t, sm.Close())
+
+	restarted := openTestStateManager(t, path)
+	mustNoError(t, restarted.Init(InitOptions{Format: NavFormatCity, TargetCountry: "all"}))
+	if got := restarted.GetCurrentNav(); got == nil || got.Nav.Key() != next.Nav.Key() {
+		t.Fatalf("restarted at %+v, want %s", got, next.Nav.Key())
+	}
+
+	last, err := restarted.SkipCountry(next.Country)
+	mustNoError(t, err)
+	if last != nil {
+		t.Fatalf("SkipCountry on the last country returned %+v, want nil", last)
+	}
+	if session, err := restarted.currentSession(); err != nil || session != nil {
+		t.Fatalf("currentSession() = %+v, %v after skipping the last country", session, err)
+	}
+}
+
+func TestGetNextNavDoesNotLeakConnections(t *testing.T) {
+	sm := newTestStateManager(t)
+	mustNoError(t, sm.Init(InitOptions{Format: NavFormatQueryCity, TargetCountry: "all"}))
+
+	for i := 0; i < 5000; i++ {
+		if _, err := sm.GetNextNav(); err != nil {
+			t.Fatal(err)
+		}
+		if i%3 == 0 {
+			if _, err := sm.MarkComplete(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if sm.Done() {
+			mustNoError(t, sm.ResetNav())
+		}
+	}
+
+	stats := sm.db.db.Stats()
+	if stats.InUse != 0 {
+		t.Fatalf("%d connections still in use", stats.InUse)
+	}
+	if stats.OpenConnections > 2 {
+		t.Fatalf("%d connections open, want at most 2", stats.OpenConnections)
+	}
+}
+
+func TestResetCompletedBeforeIsSelective(t *testing.T) {
+	sm := newTestStateManager(t)
+	old := time.Now().UTC().Add(-48 * time.Hour)
+
+	completeCurrent := func(completedAt *time.Time) {
+		t.Helper()
+		if _, err := sm.GetNextNav(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sm.MarkComplete(); err != nil {
+			t.Fatal(err)
+		}
+		if completedAt != nil {
+			mustNoError(t, sm.db.UpdateNavSession(sm.sessionID, map[string]interface{}{"completedAt": *completedAt}))
+		}
+	}
+
+	// An old completion under another plan must survive the reset
+	mustNoError(t, sm.Init(InitOptions{Format: NavFormatCity, TargetCountry: "US"}))
+	completeCurrent(&old)
+
+	mustNoError(t, sm.Init(InitOptions{Format: NavFormatCity, TargetCountry: "all"}))
+	completeCurrent(&old)
+	completeCurrent(nil)
+	if _, err := sm.GetNextNav(); err != nil {
+		t.Fatal(err)
+	}
+
+	mustNoError(t, sm.ResetCompletedBefore(time.Now().Add(-time.Hour)))
+
+	if sm.currentIndex != 0 {
+		t.Fatalf("currentIndex = %d, want navigation back at the reopened item 0", sm.currentIndex)
+	}
+	if sm.IsIndexCompleted(0) || !sm.IsIndexCompleted(1) {
+		t.Fatalf("IsIndexCompleted(0) = %v, IsIndexCompleted(1) = %v, want only the recent item 1 completed", sm.IsIndexCompleted(0), sm.IsIndexCompleted(1))
+	}
+	other, err := sm.db.CountCompletedNavSessions(string(NavFormatCity), "US")
+	mustNoError(t, err)
+	if other != 1 {
+		t.Fatalf("another plan has %d completed items after the reset, want 1", other)
+	}
+}
+
+func TestDuplicateCountryWarningGoesToLogger(t *testing.T) {
+	writeTestLocationData(t, `{
+		"cityData": {
+			"US#United States": {"CA##California": ["Los Angeles"]},
+			"US#USA": {"TX##Texas": ["Austin"]}
+		},
+		"zipData": {}
+	}`)
+	sm := openTestStateManager(t, filepath.Join(t.TempDir(), "test.db"))
+
+	var logged bytes.Buffer
+	sm.SetLogger(log.New(&logged, "", 0))
+	mustNoError(t, sm.Init(InitOptions{Format: NavFormatCity, TargetCountry: "all"}))
+
+	if !strings.Contains(logged.String(), `country US is listed as both "USA" and "United States"`) {
+		t.Fatalf("logged %q, want a duplicate country warning", logged.String())
+	}
+	if sm.navTotal != 2 {
+		t.Fatalf("navTotal = %d, want both cities under the kept country", sm.navTotal)
+	}
+}
+
+func TestWarningsGoToStdoutWithoutLogger(t *testing.T) {
+	sm := newTestStateManager(t)
+
+	read, write, err := os.Pipe()
+	mustNoError(t, err)
+	stdout := os.Stdout
+	os.Stdout = write
+	sm.logf("Warning: %s", "something changed")
+	os.Stdout = stdout
+	mustNoError(t, write.Close())
+
+	printed, err := io.ReadAll(read)
+	mustNoError(t, err)
+	if string(printed) != "Warning: something changed\n" {
+		t.Fatalf("printed %q, want the warning on its own line", printed)
+	}
+}
+
+func TestMarkCompleteDoneOnlyWhenNothingIsOpen(t *testing.T) {
+	sm := newTestStateManager(t)
+	mustNoError(t, sm.Init(InitOptions{Format: NavFormatCity, TargetCountry: "all"}))
+
+	// Leave the first country unfinished and complete the last item
+	first := sm.GetCurrentNav()
+	if _, err := sm.SkipCountry(first.Country); err != nil {
+		t.Fatal(err)
+	}
+	done, err := sm.MarkComplete()
+	mustNoError(t, err)
+	if done {
+		t.Fatal("MarkComplete reported done with the first country unfinished")
+	}
+
+	mustNoError(t, sm.ResetNav())
+	for {
+		nav, err := sm.GetNextNav()
+		mustNoError(t, err)
+		if nav == nil {
+			t.Fatal("navigation ended before MarkComplete reported done")
+		}
+		done, err := sm.MarkComplete()
+		mustNoError(t, err)
+		if done {
+			break
+		}
+	}
+	if next, err := sm.GetNextNav(); err != nil || next != nil {
+		t.Fatalf("GetNextNav() = %+v, %v after MarkComplete reported done", next, err)
+	}
+}
+
+func TestNewStateManagerWithRecoveryReportsBackup(t *testing.T) {
+	writeTestLocationData(t, `{"cityData": {"US#United States": {"CA##California": ["Los Angeles"]}}, "zipData": {}}`)
+	path := filepath.Join(t.TempDir(), "test.db")
+	mustNoError(t, os.WriteFile(path, bytes.Repeat([]byte("not a database "), 512), 0644))
+
+	sm, err := NewStateManagerWithRecovery(path)
+	mustNoError(t, err)
+	defer sm.Close()
+
+	backup := sm.RecoveryBackup()
+	if backup == "" {
+		t.Fatal("RecoveryBackup() is empty after recovering a corrupt file")
+	}
+	if _, err := os.Stat(backup); err != nil {
+		t.Fatalf("backup %s: %v", backup, err)
+	}
+	mustNoError(t, sm.Init(InitOptions{Format: NavFormatCity, TargetCountry: "all"}))
+	if sm.navTotal != 1 {
+		t.Fatalf("navTotal = %d after recovery, want 1", sm.navTotal)
+	}
+}
+
+func TestPopulateFailureCommitsNothing(t *testing.T) {
+	writeTestLocationData(t, `{
+		"cityData": {"US#United States": {"CA##California": ["Los Angeles"]}},
+		"zipData": {"US": ["90001"]}
+	}`)
+	sm := openTestStateManager(t, filepath.Join(t.TempDir(), "test.db"))
+
+	// Fail the insert of cities, after countries and states went in
+	_, err := sm.db.db.Exec(`CREATE TRIGGER fail_cities BEFORE INSERT ON cities BEGIN SELECT RAISE(ABORT, 'injected failure'); END`)
+	mustNoError(t, err)
+	if err := sm.Init(InitOptions{Format: NavFormatCity, TargetCountry: "all"}); err == nil {
+		t.Fatal("Init succeeded despite the injected failure")
+	}
+
+	for _, table := range []string{"countries", "states", "cities", "zips", "country_metadata", "metadata"} {
+		var n int
+		mustNoError(t, sm.db.db.QueryRow(`SELECT COUNT(*) FROM `+table).Scan(&n))
+		if n != 0 {
+			t.Errorf("%s holds %d rows after the failed populate, want 0", table, n)
+		}
+	}
+	if sm.db.tx != nil {
+		t.Fatal("state manager is still bound to the failed transaction")
+	}
+
+	_, err = sm.db.db.Exec(`DROP TRIGGER fail_cities`)
+	mustNoError(t, err)
+	mustNoError(t, sm.Init(InitOptions{Format: NavFormatCity, TargetCountry: "all"}))
+	if sm.navTotal != 1 {
+		t.Fatalf("navTotal = %d after retrying, want 1", sm.navTotal)
+	}
+}
+
+func TestExecuteTransactionRollsBackOnPanic(t *testing.T) {
+	sm := newTestStateManager(t)
+	db := sm.db
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("panic was not propagated")
+			}
+		}()
+		sm.executeTransaction(func() error {
+			mustNoError(t, sm.db.AddQueries([]string{"electrician"}, true))
+			panic("injected panic")
+		})
+	}()
+
+	if sm.db != db {
+		t.Fatal("sm.db was not restored after a panic")
+	}
+	queries, err := sm.db.GetQueries()
+	mustNoError(t, err)
+	if len(queries) != 1 {
+		t.Fatalf("got %d queries after the panic, want the rolled back insert gone", len(queries))
+	}
+}
+
+func TestCountRemainingSkipsCompletedAndHonorsLimit(t *testing.T) {
+	sm := newTestStateManager(t)
+	mustNoError(t, sm.Init(InitOptions{Format: NavFormatCity, TargetCountry: "all"}))
+	if got := sm.CountRemaining(); got != 3 {
+		t.Fatalf("CountRemaining() = %d at the start, want 3", got)
+	}
+
+	if _, err := sm.MarkComplete(); err != nil {
+		t.Fatal(err)
+	}
+	if got := sm.CountRemaining(); got != 2 {
+		t.Fatalf("CountRemaining() = %d after completing the first item, want 2", got)
+	}
+
+	mustNoError(t, sm.Init(InitOptions{Format: NavFormatCity, TargetCountry: "all", Limit: 1}))
+	if got := sm.CountRemaining(); got != 1 {
+		t.Fatalf("CountRemaining() = %d with Limit 1, want 1", got)
+	}
+}
+
+func TestGetNextNavForCountryStaysInCountry(t *testing.T) {
+	sm := newTestStateManager(t)
+	mustNoError(t, sm.Init(InitOptions{Format: NavFormatCity, TargetCountry: "all"}))
+	first := sm.GetCurrentNav()
+	other := "CA"
+	if first.Country == other {
+		other = "US"
+	}
+
+	for i := 0; i < 2; i++ {
+		nav, err := sm.GetNextNavForCountry(other)
+		mustNoError(t, err)
+		if nav == nil || nav.Country != other {
+			t.Fatalf("GetNextNavForCountry(%s) = %+v, want an item of %s", other, nav, other)
+		}
+	}
+	if _, err := sm.MarkComplete(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The unfinished first item is served again when its country comes round
+	nav, err := sm.GetNextNavForCountry(first.Country)
+	mustNoError(t, err)
+	if nav == nil || nav.Nav.Key() != first.Nav.Key() {
+		t.Fatalf("GetNextNavForCountry(%s) = %+v, want the unfinished %s", first.Country, nav, first.Nav.Key())
+	}
+}
+
+func TestGetCityRecordsForCountryStateIgnoresCase(t *testing.T) {
+	sm := newTestStateManager(t)
+	cities, err := sm.GetCityRecordsForCountryState(" us", "ca ")
+	mustNoError(t, err)
+	if len(cities) != 1 || cities[0].City != "Los Angeles" || cities[0].County == nil {
+		t.Fatalf("GetCityRecordsForCountryState(us, ca) = %+v, want Los Angeles with its county", cities)
+	}
+}
+
+func TestResolveCountryCode(t *testing.T) {
+	sm := newTestStateManager(t)
+	mustNoError(t, sm.db.AddCountryMetadata([]CountryData{{Name: "United States", ISO2: "US", ISO3: "USA"}}))
+
+	for _, test := range []struct{ code, want string }{
+		{"usa", "US"},
+		{"USA", "US"},
+		{"us", "US"},
+		{" ca ", "CA"},
+		{"ALL", "all"},
+	} {
+		got, err := sm.ResolveCountryCode(test.code)
+		mustNoError(t, err)
+		if got != test.want {
+			t.Errorf("ResolveCountryCode(%q) = %q, want %q", test.code, got, test.want)
+		}
+	}
+
+	for _, code := range []string{"ZZ", "u", "usa1", "XYZ", ""} {
+		if got, err := sm.ResolveCountryCode(code); !errors.Is(err, ErrCountryNotFound) {
+			t.Errorf("ResolveCountryCode(%q) = %q, %v, want ErrCountryNotFound", code, got, err)
+		}
+	}
+}
+
+func TestRestoreResumesRepeatedNavInItsOwnPass(t *testing.T) {
+	path := seedTestDatabase(t)
+	sm := openTestStateManager(t, path)
+	mustNoError(t, sm.Init(InitOptions{Format: NavFormatQueryState, TargetCountry: "US"}))
+	mustNoError(t, sm.AddSearchQueriesWeighted(map[string]int{"plumber": 2}))
+
+	// plumber runs twice over California and Texas; stop on its second California
+	for i := 0; i < 2; i++ {
+		_, err := sm.MarkComplete()
+		mustNoError(t, err)
+		_, err = sm.GetNextNav()
+		mustNoError(t, err)
+	}
+	before := sm.GetCurrentNav()
+	if *before.Nav.Query != "plumber" || *before.Nav.State != "California" {
+		t.Fatalf("index 2 is %s, want plumber in California", before.Nav.Key())
+	}
+	mustNoError(t, sm.Close())
+
+	// A new query runs in the first pass, pushing the second plumber pass back
+	restarted := openTestStateManager(t, path)
+	mustNoError(t, restarted.db.AddQueries([]string{"electrician"}, false))
+	mustNoError(t, restarted.Init(InitOptions{Format: NavFormatQueryState, TargetCountry: "US"}))
+
+	after := restarted.GetCurrentNav()
+	if after.Index != 4 || after.Nav.Key() != before.Nav.Key() {
+		t.Fatalf("resumed at %d (%s), want 4 (%s)", after.Index, after.Nav.Key(), before.Nav.Key())
+	}
+}
+
+func BenchmarkRestoreRepeatedNav(b *testing.B) {
+	dir := b.TempDir()
+	SetDataFilePath(filepath.Join(dir, "missing.json"))
+	path := filepath.Join(dir, "bench.db")
+	db, err := NewDB(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	cities := make([]City, 5000)
+	for i := range cities {
+		cities[i] = City{City: fmt.Sprintf("City %04d", i), StateShort: "CA", CountryShort: "US"}
+	}
+	if err := db.AddCountries([]Country{{Country: "United States", CountryShort: "US"}}, false); err != nil {
+		b.Fatal(err)
+	}
+	if err := db.AddStates([]State{{State: "California", StateShort: "CA", CountryShort: "US"}}, false); err != nil {
+		b.Fatal(err)
+	}
+	if err := db.AddCities(cities, false); err != nil {
+		b.Fatal(err)
+	}
+	if err := db.AddWeightedQueries(map[string]int{"plumber": 3, "electrician": 1}, false); err != nil {
+		b.Fatal(err)
+	}
+	db.Close()
+
+	sm, err := NewStateManager(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sm.Close()
+	options := InitOptions{Format: NavFormatQueryCity, TargetCountry: "US"}
+	if err := sm.Init(options); err != nil {
+		b.Fatal(err)
+	}
+
+	// Park the session in the last pass, where its nav repeats the earlier ones
+	index := sm.navTotal - 10
+	if err := sm.db.SaveBookmark(Bookmark{Name: "late", Format: string(options.Format), TargetCountry: sm.planKey(), Index: index}); err != nil {
+		b.Fatal(err)
+	}
+	if _, err := sm.GotoBookmark("late"); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// A stale recorded position forces the lookup by entities
+		b.StopTimer()
+		if err := sm.db.UpdateNavSession(sm.sessionID, map[string]interface{}{"navIndex": index - 1}); err != nil {
+			b.Fatal(err)
+		}
+		if err := sm.db.SaveNavCursor(string(options.Format), sm.planKey(), index-1); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+
+		if err := sm.Init(options); err != nil {
+			b.Fatal(err)
+		}
+		if sm.currentIndex != index {
+			b.Fatalf("restored at %d, want %d", sm.currentIndex, index)
+		}
+	}
+	b.ReportMetric(float64(sm.navTotal), "navs")
+}
+
+// servedAustin seeds a database, serves Los Angeles and moves on to Austin,
+// then closes the manager, returning the database path
+func servedAustin(t *testing.T) string {
+	t.Helper()
+
+	path := seedTestDatabase(t)
+	sm := openTestStateManager(t, path)
+	mustNoError(t, sm.Init(InitOptions{Format: NavFormatCity, TargetCountry: "all"}))
+	_, err := sm.MarkComplete()
+	mustNoError(t, err)
+	nav, err := sm.GetNextNav()
+	mustNoError(t, err)
+	if nav.Index != 1 || *nav.Nav.City != "Austin" {
+		t.Fatalf("second item is %d (%s), want 1 (Austin)", nav.Index, nav.Nav.Key())
+	}
+	mustNoError(t, sm.Close())
+	return path
+}
+
+// execSQL runs statements directly against a closed database
+func execSQL(t *testing.T, path string, statements ...string) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", path)
+	mustNoError(t, err)
+	defer db.Close()
+	for _, statement := range statements {
+		_, err := db.Exec(statement)
+		mustNoError(t, err)
+	}
+}
+
+func TestRestoreFollowsShiftedNav(t *testing.T) {
+	path := servedAustin(t)
+
+	// An external city ahead of Austin moves it back one place
+	restarted := openTestStateManager(t, path)
+	mustNoError(t, restarted.db.AddCities([]City{{City: "Anaheim", StateShort: "CA", CountryShort: "US"}}, true))
+	mustNoError(t, restarted.Init(InitOptions{Format: NavFormatCity, TargetCountry: "all"}))
+
+	nav := restarted.GetCurrentNav()
+	if nav.Index != 2 || *nav.Nav.City != "Austin" {
+		t.Fatalf("resumed at %d (%s), want 2 (Austin)", nav.Index, nav.Nav.Key())
+	}
+}
+
+func TestRestoreRelocatesWhenNavIsRemoved(t *testing.T) {
+	path := servedAustin(t)
+	execSQL(t, path, `DELETE FROM cities WHERE city = 'Austin'`)
+
+	restarted := openTestStateManager(t, path)
+	var logged bytes.Buffer
+	restarted.SetLogger(log.New(&logged, "", 0))
+	mustNoError(t, restarted.Init(InitOptions{Format: NavFormatCity, TargetCountry: "all"}))
+
+	// Austin's old position now holds Toronto, the next open item
+	nav := restarted.GetCurrentNav()
+	if nav.Index != 1 || *nav.Nav.City != "Toronto" {
+		t.Fatalf("resumed at %d (%s), want 1 (Toronto)", nav.Index, nav.Nav.Key())
+	}
+	if !strings.Contains(logged.String(), "no longer matches the navigation order; resuming at index 1") {
+		t.Fatalf("logged %q, want a relocation warning", logged.String())
+	}
+}
+
+func TestRestoreWithoutPositionFailsWithSessionMismatch(t *testing.T) {
+	path := servedAustin(t)
+	execSQL(t, path,
+		`DELETE FROM cities WHERE city = 'Austin'`,
+		`UPDATE nav_sessions SET navIndex = NULL`,
+		`DELETE FROM nav_cursors`,
+	)
+
+	restarted := openTestStateManager(t, path)
+	err := restarted.Init(InitOptions{Format: NavFormatCity, TargetCountry: "all"})
+	if !errors.Is(err, ErrSessionMismatch) {
+		t.Fatalf("Init() = %v, want ErrSessionMismatch", err)
+	}
+}